@@ -1 +1 @@
-run -v {{.directory}}:/media/ -it --net=host --rm google/shaka-packager cd /media packager 'in=udp://{{.SdpHost}}:{{.UdpPort}},stream=audio,init_segment=audiodash.mp4,segment_template=audiodash_$Number$.m4s' 'in=udp://{{.SdpHost}}:{{.UdpPort}},stream=video,init_segment=videodash.mp4,segment_template=videodash_$Number$.m4s' --mpd_output outdash.mpd --allow_approximate_segment_timeline --preserved_segments_outside_live_window 30 --suggested_presentation_delay 1 --minimum_update_period 0.5 --min_buffer_time 1.5 --time_shift_buffer_depth 1 --hls_master_playlist_output outdash.m3u8 --hls_playlist_type live --segment_duration 1.5
\ No newline at end of file
+in={{.URLIn}},stream=video,init_segment=http://127.0.0.1:{{.Port}}/put/{{.Name}}/{{.InitSegment}}0.m4s,segment_template=http://127.0.0.1:{{.Port}}/put/{{.Name}}/chunk-stream0-$Number%05d$.m4s in={{.URLIn}},stream=audio,init_segment=http://127.0.0.1:{{.Port}}/put/{{.Name}}/{{.InitSegment}}1.m4s,segment_template=http://127.0.0.1:{{.Port}}/put/{{.Name}}/chunk-stream1-$Number%05d$.m4s --segment_duration {{.Params.segduration}} --allow_approximate_segment_timeline --preserved_segments_outside_live_window 30 --suggested_presentation_delay 1 --minimum_update_period 0.5 --min_buffer_time 1.5 --time_shift_buffer_depth 5 --mpd_output http://127.0.0.1:{{.Port}}/put/{{.Name}}/master.mpd --hls_playlist_type LIVE --hls_master_playlist_output http://127.0.0.1:{{.Port}}/put/{{.Name}}/master.m3u8
\ No newline at end of file
@@ -0,0 +1,220 @@
+package localconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// CmdDescExt is extension of command template descriptor: streamffmpeg.cmd -> streamffmpeg.cmd.json
+	CmdDescExt string = ".json"
+)
+
+// parameter types
+const (
+	ParamString string = "string"
+	ParamInt    string = "int"
+	ParamFloat  string = "float"
+	ParamBool   string = "bool"
+)
+
+// ParamDesc describe user defined parameter of command template, it is available in template as .Params.Name
+type ParamDesc struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type,omitempty"`
+	Default  string   `json:"default,omitempty"`
+	Required bool     `json:"required,omitempty"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	Values   []string `json:"values,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"` // регулярное выражение для всего значения string без values
+	Desc     string   `json:"desc,omitempty"`
+	pattern  *regexp.Regexp
+}
+
+// CmdDesc describe command template, it is loaded from file <template>.json near the template
+type CmdDesc struct {
+	Name     string        `json:"name"`
+	Desc     string        `json:"desc,omitempty"`
+	Runner   string        `json:"runner,omitempty"`   // программа для шаблона: ffmpeg, shaka-packager, gstreamer, exec
+	Env      []string      `json:"env,omitempty"`      // дополнительные переменные окружения NAME=value
+	Dir      string        `json:"dir,omitempty"`      // рабочий каталог процесса, относительный считается от каталога потока
+	Weight   float64       `json:"weight,omitempty"`   // доля лимита -maxJobs, которую занимает процесс, по умолчанию 1
+	Priority int           `json:"priority,omitempty"` // добавляется к приоритету потока или записи в очереди
+	Params   []ParamDesc   `json:"params,omitempty"`
+	Manifest ManifestRules `json:"manifest,omitempty"` // правила для манифестов, nil - DefaultManifestRules
+}
+
+func loadCmdDesc(path string, name string) (*CmdDesc, error) {
+	data, errRead := ioutil.ReadFile(path)
+	if errRead != nil {
+		return nil, errRead
+	}
+	res := CmdDesc{}
+	if errUnmarshal := json.Unmarshal(data, &res); errUnmarshal != nil {
+		return nil, fmt.Errorf("%s: %s", path, errUnmarshal.Error())
+	}
+	res.Name = name
+	for _, env := range res.Env {
+		if strings.Index(env, "=") <= 0 {
+			return nil, fmt.Errorf("%s: env must be 'NAME=value': %s", path, env)
+		}
+	}
+	if res.Weight < 0 {
+		return nil, fmt.Errorf("%s: weight must be >= 0", path)
+	}
+	if errManifest := res.Manifest.Check(); errManifest != nil {
+		return nil, fmt.Errorf("%s: manifest %s", path, errManifest.Error())
+	}
+	names := make(map[string]bool)
+	for i := range res.Params {
+		param := &res.Params[i]
+		if len(param.Name) == 0 {
+			return nil, fmt.Errorf("%s: param %d without name", path, i)
+		}
+		if names[param.Name] {
+			return nil, fmt.Errorf("%s: param %s is duplicated", path, param.Name)
+		}
+		names[param.Name] = true
+		if len(param.Type) == 0 {
+			param.Type = ParamString
+		}
+		switch param.Type {
+		case ParamString, ParamInt, ParamFloat, ParamBool:
+		default:
+			return nil, fmt.Errorf("%s: param %s has unknown type %s", path, param.Name, param.Type)
+		}
+		if len(param.Pattern) > 0 {
+			pattern, errPattern := regexp.Compile("^(?:" + param.Pattern + ")$")
+			if errPattern != nil {
+				return nil, fmt.Errorf("%s: param %s has bad pattern: %s", path, param.Name, errPattern.Error())
+			}
+			param.pattern = pattern
+		}
+		if len(param.Default) > 0 {
+			if errCheck := param.Check(param.Default); errCheck != nil {
+				return nil, fmt.Errorf("%s: default %s", path, errCheck.Error())
+			}
+		}
+	}
+	return &res, nil
+}
+
+// ManifestRules return rules for manifests of template
+func (d *CmdDesc) ManifestRules() ManifestRules {
+	if d.Manifest == nil {
+		return DefaultManifestRules()
+	}
+	return d.Manifest
+}
+
+// Check validate value of parameter
+func (p *ParamDesc) Check(value string) error {
+	var number float64
+	switch p.Type {
+	case ParamInt:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("param %s must be int: %s", p.Name, value)
+		}
+		number = float64(i)
+	case ParamFloat:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("param %s must be float: %s", p.Name, value)
+		}
+		number = f
+	case ParamBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("param %s must be bool: %s", p.Name, value)
+		}
+	case ParamString:
+		if len(p.Values) == 0 {
+			if errArg := CheckArg(value); errArg != nil {
+				return fmt.Errorf("param %s %s", p.Name, errArg.Error())
+			}
+			if p.pattern != nil && !p.pattern.MatchString(value) {
+				return fmt.Errorf("param %s must match %s: %s", p.Name, p.Pattern, value)
+			}
+		}
+	}
+	if p.Type == ParamInt || p.Type == ParamFloat {
+		if p.Min != nil && number < *p.Min {
+			return fmt.Errorf("param %s must be >= %v: %s", p.Name, *p.Min, value)
+		}
+		if p.Max != nil && number > *p.Max {
+			return fmt.Errorf("param %s must be <= %v: %s", p.Name, *p.Max, value)
+		}
+	}
+	if len(p.Values) > 0 {
+		for _, allowed := range p.Values {
+			if allowed == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("param %s must be one of %s: %s", p.Name, strings.Join(p.Values, ","), value)
+	}
+	return nil
+}
+
+// CheckArg return error if value of string param or url can become several arguments or an option of command:
+// command is split by spaces and quotes after template is executed
+func CheckArg(value string) error {
+	if strings.HasPrefix(value, "-") {
+		return fmt.Errorf("must not start with '-': %s", value)
+	}
+	if strings.ContainsAny(value, "\"'`\\") {
+		return fmt.Errorf("must not contain quotes and '\\': %s", value)
+	}
+	for _, r := range value {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("must not contain spaces: %q", value)
+		}
+	}
+	return nil
+}
+
+// BuildParams check parameters from request in form "name|value" and add defaults
+func (d *CmdDesc) BuildParams(params []string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, str := range params {
+		array := strings.SplitN(str, "|", 2)
+		if len(array) != 2 || len(array[0]) == 0 {
+			return nil, fmt.Errorf("param must be 'name|value': %s", str)
+		}
+		values[array[0]] = array[1]
+	}
+
+	res := make(map[string]string)
+	for _, param := range d.Params {
+		value, isFind := values[param.Name]
+		if !isFind {
+			if param.Required {
+				return nil, fmt.Errorf("param %s is required for %s", param.Name, d.Name)
+			}
+			res[param.Name] = param.Default
+			continue
+		}
+		if errCheck := param.Check(value); errCheck != nil {
+			return nil, errCheck
+		}
+		res[param.Name] = value
+		delete(values, param.Name)
+	}
+
+	if len(values) > 0 {
+		unknown := make([]string, 0, len(values))
+		for name := range values {
+			unknown = append(unknown, name)
+		}
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("params %s aren't declared in %s", strings.Join(unknown, ","), d.Name)
+	}
+	return res, nil
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -17,6 +18,18 @@ import (
 const (
 	// InitSegmentName is segment name for ffmpeg command
 	InitSegmentName string = "init-stream"
+	// ChunkSegmentName is name of media segments which ffmpeg dash muxer uses by default
+	ChunkSegmentName string = "chunk-stream"
+	// DVRDirName is directory of timeshift segments in workDir, stream names can't start with it
+	DVRDirName string = ".dvr"
+
+	// StreamFfmpegCmd - default command for stream ffmpeg execute
+	// StreamFfmpegCmd       string = "streamffmpeggpu.cmd"
+	StreamFfmpegCmd string = "streamffmpeg.cmd"
+
+	// StorageFfmpegCmd - default command for storage ffmpeg execute
+	// StorageFfmpegCmd       string = "ffmpeggpu.cmd"
+	StorageFfmpegCmd string = "repackffmpegfs.cmd"
 )
 
 // Config struct for store command arguments and it's derived objects
@@ -32,8 +45,43 @@ type Config struct {
 	ChankDur  *uint
 	Chanks    *uint
 
+	StreamCmd  *string
+	StorageCmd *string
+
+	RestartMin  *uint
+	RestartMax  *uint
+	StopTimeout *uint
+
+	ShutdownTimeout *uint
+
+	SegDur      *float64
+	StallFactor *uint
+
+	MaxJobs     *float64
+	MaxStreams  *float64
+	MaxStorages *float64
+	MaxQueue    *uint
+
+	CacheSize       *uint
+	StreamCacheSize *uint
+
+	Probe        *bool
+	ProbeTimeout *uint
+
+	Timeshift    *uint
+	DVRCacheSize *uint
+	DVRDir       *string
+
+	Upstream        *string
+	UpstreamTimeout *uint
+	UpstreamTTL     *float64
+
+	Bin *string
+	bin map[string]string
+
 	regexpIP []*regexp.Regexp
 	cmd      map[string]*template.Template
+	cmdDesc  map[string]*CmdDesc
 }
 
 func (c *Config) parsePort() error {
@@ -78,14 +126,49 @@ func (c *Config) parseIP() error {
 	return nil
 }
 
-func (c *Config) parseCmd() error {
+func (c *Config) parseBin() error {
+	c.bin = make(map[string]string)
+	array := strings.Split(*c.Bin, ";")
+	for _, item := range array {
+		if len(item) == 0 {
+			continue
+		}
+		pair := strings.SplitN(item, "=", 2)
+		if len(pair) != 2 || len(pair[0]) == 0 || len(pair[1]) == 0 {
+			return fmt.Errorf("bin must be 'runner=path': %s", item)
+		}
+		c.bin[pair[0]] = pair[1]
+	}
+	return nil
+}
+
+// GetBin return path of runner program set by -bin or def
+func (c *Config) GetBin(runner string, def string) string {
+	if res, ok := c.bin[runner]; ok {
+		return res
+	}
+	return def
+}
+
+// ParseCmd load command templates and their descriptors from -cmd directory
+func (c *Config) ParseCmd() error {
 	c.cmd = make(map[string]*template.Template)
+	c.cmdDesc = make(map[string]*CmdDesc)
 	files, errReadDir := ioutil.ReadDir(*c.Cmd)
 	if errReadDir != nil {
 		return errReadDir
 	}
 
+	descs := make([]string, 0)
 	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		// описатели шаблонов читаем после самих шаблонов
+		if strings.HasSuffix(f.Name(), CmdDescExt) {
+			descs = append(descs, f.Name())
+			continue
+		}
 		p, errPath := filepath.Abs(filepath.Join(*c.Cmd, f.Name()))
 		if errPath != nil {
 			return errPath
@@ -95,6 +178,19 @@ func (c *Config) parseCmd() error {
 			return errParseFiles
 		}
 		c.cmd[f.Name()] = tmpl
+		c.cmdDesc[f.Name()] = &CmdDesc{Name: f.Name()}
+	}
+
+	for _, d := range descs {
+		name := strings.TrimSuffix(d, CmdDescExt)
+		if _, ok := c.cmd[name]; !ok {
+			return fmt.Errorf("descriptor %s without template %s", d, name)
+		}
+		desc, errDesc := loadCmdDesc(filepath.Join(*c.Cmd, d), name)
+		if errDesc != nil {
+			return errDesc
+		}
+		c.cmdDesc[name] = desc
 	}
 
 	if len(c.cmd) == 0 {
@@ -109,12 +205,35 @@ func NewConfig(log *zap.Logger) *Config {
 	c.Addr = flag.String("addr", ":6060", "server listen addres")
 	c.Tmpl = flag.String("tmpl", "tmpl", "http template directory path")
 	c.Cmd = flag.String("cmd", "cmd", "command template directory path")
+	c.StreamCmd = flag.String("streamCmd", StreamFfmpegCmd, "default command template for stream")
+	c.StorageCmd = flag.String("storageCmd", StorageFfmpegCmd, "default command template for storage")
 	c.Static = flag.String("static", "static", "static directory path")
 	c.TrustedIP = flag.String("trustedIP", "127.0.0.1;", "tusted host - regexp: list of IP with any delimeter")
 	c.WorkDir = flag.String("workDir", "ffmpeg", "work directory")
 	c.StoreDir = flag.String("storeDir", "store", "store directory")
 	c.ChankDur = flag.Uint("chankDur", 60, "store chank duration, secons")
 	c.Chanks = flag.Uint("chanks", 10, "store chank number, number of files")
+	c.RestartMin = flag.Uint("restartMin", 1, "min delay before restart of crashed stream, seconds")
+	c.RestartMax = flag.Uint("restartMax", 60, "max delay before restart of crashed stream, seconds")
+	c.SegDur = flag.Float64("segDur", 1.0, "segment duration of stream if template hasn't param segduration, seconds")
+	c.StallFactor = flag.Uint("stallFactor", 10, "restart stream if no segments arrive during stallFactor*segDur, 0 - off")
+	c.MaxJobs = flag.Float64("maxJobs", 0, "max summary weight of running ffmpeg processes, 0 - unlimited")
+	c.MaxStreams = flag.Float64("maxStreams", 0, "max summary weight of running streams, 0 - limited by maxJobs only")
+	c.MaxStorages = flag.Float64("maxStorages", 0, "max summary weight of running storages, 0 - limited by maxJobs only")
+	c.MaxQueue = flag.Uint("maxQueue", 0, "max number of jobs waiting for limit, 0 - reject over limit with 429")
+	c.CacheSize = flag.Uint("cacheSize", 0, "max size of segment cache, MB, 0 - unlimited")
+	c.StreamCacheSize = flag.Uint("streamCacheSize", 0, "max size of segment cache for one stream, MB, 0 - unlimited")
+	c.Probe = flag.Bool("probe", true, "check url of stream with ffprobe before start")
+	c.ProbeTimeout = flag.Uint("probeTimeout", 10, "max time of ffprobe, seconds")
+	c.Timeshift = flag.Uint("timeshift", 0, "default timeshift depth of stream, seconds, 0 - only live")
+	c.DVRCacheSize = flag.Uint("dvrCacheSize", 64, "memory for timeshift segments of one stream, MB, older segments are moved to dvrDir")
+	c.DVRDir = flag.String("dvrDir", "", "directory for timeshift segments moved from memory, empty - workDir/"+DVRDirName+", it must not overlap storeDir")
+	c.Upstream = flag.String("upstream", "", "edge mode: url of upstream camctl, misses of /get are fetched from it, for example http://home:6161")
+	c.UpstreamTimeout = flag.Uint("upstreamTimeout", 10, "max time of request to upstream camctl, seconds")
+	c.UpstreamTTL = flag.Float64("upstreamTTL", 0.5, "time after which manifest fetched from upstream is fetched again, seconds")
+	c.Bin = flag.String("bin", "", "paths of runner programs: runner=path;runner=path, for example ffmpeg=/opt/ffmpeg/bin/ffmpeg")
+	c.ShutdownTimeout = flag.Uint("shutdownTimeout", 15, "max time of graceful shutdown on SIGTERM, seconds")
+	c.StopTimeout = flag.Uint("stopTimeout", 10, "wait ffmpeg exit after SIGQUIT before SIGKILL, seconds")
 	flag.Parse()
 
 	if err := c.parsePort(); err != nil {
@@ -127,11 +246,33 @@ func NewConfig(log *zap.Logger) *Config {
 		return nil
 	}
 
-	if err := c.parseCmd(); err != nil {
+	if err := c.parseBin(); err != nil {
+		log.Error("parse bin", zap.Error(err))
+		return nil
+	}
+
+	if err := c.ParseCmd(); err != nil {
 		log.Error("parse cmd", zap.Error(err))
 		return nil
 	}
 
+	if len(*c.DVRDir) == 0 {
+		*c.DVRDir = filepath.Join(*c.WorkDir, DVRDirName)
+	}
+	if err := c.checkDVRDir(); err != nil {
+		log.Error("check dvrDir", zap.Error(err))
+		return nil
+	}
+
+	if _, ok := c.GetTmpl(*c.StreamCmd); !ok {
+		log.Sugar().Errorf("streamCmd %s not found in %s", *c.StreamCmd, *c.Cmd)
+		return nil
+	}
+	if _, ok := c.GetTmpl(*c.StorageCmd); !ok {
+		log.Sugar().Errorf("storageCmd %s not found in %s", *c.StorageCmd, *c.Cmd)
+		return nil
+	}
+
 	errDir := os.MkdirAll(*c.WorkDir, os.ModePerm)
 	if errDir != nil {
 		log.Sugar().Error(errDir)
@@ -141,13 +282,32 @@ func NewConfig(log *zap.Logger) *Config {
 	log.Sugar().Warn("addr", *c.Addr)
 	log.Sugar().Warn("tmpl", *c.Tmpl)
 	log.Sugar().Warn("cmd", *c.Cmd)
+	log.Sugar().Warn("streamCmd", *c.StreamCmd)
+	log.Sugar().Warn("storageCmd", *c.StorageCmd)
 	log.Sugar().Warn("static", *c.Static)
 	log.Sugar().Warn("workDir", *c.WorkDir)
+	log.Sugar().Warn("dvrDir", *c.DVRDir)
 	log.Sugar().Warn("trustedIP", *c.TrustedIP)
 
 	return c
 }
 
+// checkDVRDir check that dvrDir doesn't overlap storeDir: cleaning of storeDir would remove timeshift segments
+func (c *Config) checkDVRDir() error {
+	dvrDir, errAbs := filepath.Abs(*c.DVRDir)
+	if errAbs != nil {
+		return errAbs
+	}
+	storeDir, errAbs := filepath.Abs(*c.StoreDir)
+	if errAbs != nil {
+		return errAbs
+	}
+	if HasPathPrefix(dvrDir, storeDir) || HasPathPrefix(storeDir, dvrDir) {
+		return fmt.Errorf("dvrDir %s overlaps storeDir %s", *c.DVRDir, *c.StoreDir)
+	}
+	return nil
+}
+
 // IsTrustedIP is check input ip with trusted
 func (c *Config) IsTrustedIP(ip string) bool {
 	end := strings.LastIndex(ip, ":")
@@ -168,3 +328,24 @@ func (c *Config) GetTmpl(key string) (*template.Template, bool) {
 	res, ok := c.cmd[key]
 	return res, ok
 }
+
+// IsEdge return true if camctl fetches segments from upstream camctl
+func (c *Config) IsEdge() bool {
+	return len(*c.Upstream) > 0
+}
+
+// GetCmdDesc return descriptor of command template by key
+func (c *Config) GetCmdDesc(key string) (*CmdDesc, bool) {
+	res, ok := c.cmdDesc[key]
+	return res, ok
+}
+
+// CmdNames return sorted names of loaded command templates
+func (c *Config) CmdNames() []string {
+	res := make([]string, 0, len(c.cmd))
+	for name := range c.cmd {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,119 @@
+package localconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/antchfx/xpath"
+)
+
+// operations of manifest rules
+const (
+	RuleSetAttr    string = "setattr"    // MPD: атрибут Name=Value у всех узлов Path
+	RuleAddElement string = "addelement" // MPD: элемент Name в узлах Path, если его нет, с атрибутами Attrs
+	RuleDelElement string = "delelement" // MPD: удалить все узлы Path
+	RuleSetTag     string = "settag"     // HLS: атрибуты Attrs или значение Value у тегов #Name, без них - тег без значения
+)
+
+// ManifestRule describe one change of manifest which is applied when ffmpeg PUT it into cache
+type ManifestRule struct {
+	Op      string            `json:"op"`
+	File    string            `json:"file,omitempty"` // маска имени манифеста, пусто - все манифесты
+	Path    string            `json:"path,omitempty"` // xpath для MPD
+	Name    string            `json:"name,omitempty"` // атрибут, элемент или тег HLS без '#'
+	Value   string            `json:"value,omitempty"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+	Missing bool              `json:"missing,omitempty"` // не менять то, что уже есть в манифесте
+}
+
+// ManifestRules is ordered list of manifest rules
+type ManifestRules []ManifestRule
+
+// DefaultManifestRules return rules which are used when template and stream don't set their own
+func DefaultManifestRules() ManifestRules {
+	return ManifestRules{
+		{Op: RuleSetAttr, Path: "//MPD", Name: "minimumUpdatePeriod", Value: "PT30S"},
+		{Op: RuleAddElement, Path: "//MPD/ServiceDescription", Name: "Latency", Attrs: map[string]string{"target": "2000", "min": "1500", "max": "3000"}},
+		// ffmpeg не пишет EXT-X-STREAM-INF для одного audio - без него hls.js не играет
+		{Op: RuleSetTag, File: "master.m3u8", Name: "EXT-X-STREAM-INF", Attrs: map[string]string{"BANDWIDTH": "132056", "CODECS": "\"avc1.64001e\""}, Missing: true},
+	}
+}
+
+// ParseManifestRules parse rules from json and check them
+func ParseManifestRules(data []byte) (ManifestRules, error) {
+	res := ManifestRules{}
+	if errUnmarshal := json.Unmarshal(data, &res); errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+	if errCheck := res.Check(); errCheck != nil {
+		return nil, errCheck
+	}
+	return res, nil
+}
+
+// Check validate rules
+func (r ManifestRules) Check() error {
+	for i := range r {
+		if errCheck := r[i].Check(); errCheck != nil {
+			return fmt.Errorf("rule %d: %s", i, errCheck.Error())
+		}
+	}
+	return nil
+}
+
+// Check validate rule
+func (r *ManifestRule) Check() error {
+	if len(r.File) > 0 {
+		if _, errMatch := filepath.Match(r.File, ""); errMatch != nil {
+			return fmt.Errorf("bad file mask %s", r.File)
+		}
+	}
+	switch r.Op {
+	case RuleSetAttr, RuleAddElement, RuleDelElement:
+		if len(r.Path) == 0 {
+			return fmt.Errorf("%s without path", r.Op)
+		}
+		if _, errCompile := xpath.Compile(r.Path); errCompile != nil {
+			return fmt.Errorf("bad path %s: %s", r.Path, errCompile.Error())
+		}
+		if r.Op != RuleDelElement && len(r.Name) == 0 {
+			return fmt.Errorf("%s without name", r.Op)
+		}
+	case RuleSetTag:
+		if len(r.Name) == 0 {
+			return fmt.Errorf("%s without name", r.Op)
+		}
+		if len(r.Value) > 0 && len(r.Attrs) > 0 {
+			return fmt.Errorf("%s with both value and attrs", r.Op)
+		}
+	default:
+		return fmt.Errorf("unknown op %s", r.Op)
+	}
+	return nil
+}
+
+// Match return true if rule is applied to manifest with file name
+func (r *ManifestRule) Match(file string) bool {
+	if len(r.File) == 0 {
+		return true
+	}
+	res, _ := filepath.Match(r.File, filepath.Base(file))
+	return res
+}
+
+// IsHLS return true if rule changes HLS playlists, otherwise it changes MPD
+func (r *ManifestRule) IsHLS() bool {
+	return r.Op == RuleSetTag
+}
+
+// AttrNames return names of Attrs in sorted order, so manifest doesn't change from PUT to PUT
+func (r *ManifestRule) AttrNames() []string {
+	res := make([]string, 0, len(r.Attrs))
+	for name := range r.Attrs {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,45 @@
+package localconf
+
+import "testing"
+
+func TestParseManifestRules(t *testing.T) {
+	tests := []struct {
+		data  string
+		isErr bool
+	}{
+		{`[{"op": "setattr", "path": "//MPD", "name": "minimumUpdatePeriod", "value": "PT10S"}]`, false},
+		{`[{"op": "delelement", "path": "//MPD/UTCTiming"}]`, false},
+		{`[{"op": "settag", "file": "media_*.m3u8", "name": "EXT-X-START", "attrs": {"TIME-OFFSET": "-3"}}]`, false},
+		{`[{"op": "setattr", "name": "minimumUpdatePeriod"}]`, true},
+		{`[{"op": "setattr", "path": "//MPD["}]`, true},
+		{`[{"op": "addelement", "path": "//MPD"}]`, true},
+		{`[{"op": "settag", "name": "EXT-X-START", "value": "x", "attrs": {"TIME-OFFSET": "-3"}}]`, true},
+		{`[{"op": "settag", "file": "[", "name": "EXT-X-START"}]`, true},
+		{`[{"op": "rename", "path": "//MPD"}]`, true},
+		{`{"op": "setattr"}`, true},
+	}
+	for _, test := range tests {
+		if _, err := ParseManifestRules([]byte(test.data)); (err != nil) != test.isErr {
+			t.Errorf("ParseManifestRules(%s) = %v, want error %v", test.data, err, test.isErr)
+		}
+	}
+}
+
+func TestManifestRuleMatch(t *testing.T) {
+	tests := []struct {
+		file string
+		key  string
+		res  bool
+	}{
+		{"", "/user/cam/master.mpd", true},
+		{"master.m3u8", "/user/cam/master.m3u8", true},
+		{"master.m3u8", "/user/cam/media_0.m3u8", false},
+		{"media_*.m3u8", "/user/cam/media_1.m3u8", true},
+	}
+	for _, test := range tests {
+		rule := ManifestRule{Op: RuleSetTag, File: test.file, Name: "EXT-X-START"}
+		if res := rule.Match(test.key); res != test.res {
+			t.Errorf("rule %q Match(%q) = %v, want %v", test.file, test.key, res, test.res)
+		}
+	}
+}
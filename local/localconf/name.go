@@ -0,0 +1,55 @@
+package localconf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StreamName return stream name of any depth after route prefix: "/stream/start/org/site/cam" -> "org/site/cam"
+func StreamName(path string, prefix string) (string, error) {
+	if !strings.HasPrefix(path, prefix) {
+		return "", fmt.Errorf("must be '%sname'", prefix)
+	}
+	name := strings.Trim(path[len(prefix):], "/")
+	return name, CheckName(name)
+}
+
+// CheckName return error if name is empty, has empty, "." or ".." parts or is inside directory of timeshift segments
+func CheckName(name string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("name isn't set in path")
+	}
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	for _, part := range parts {
+		if len(part) == 0 || part == "." || part == ".." || strings.Contains(part, "\\") {
+			return fmt.Errorf("bad part '%s' of name '%s'", part, name)
+		}
+	}
+	if parts[0] == DVRDirName {
+		// каталог сегментов timeshift в workDir не может быть потоком
+		return fmt.Errorf("name '%s' is inside reserved directory %s", name, DVRDirName)
+	}
+	return nil
+}
+
+// HasPathPrefix return true if name is prefix or is inside it by whole parts: /org/site is inside /org, /org2 isn't
+func HasPathPrefix(name string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return len(prefix) == 0 || name == prefix || strings.HasPrefix(name, prefix+"/")
+}
+
+// GroupName cut name to first depth parts: "/org/site/cam" and 2 -> "/org/site", depth 0 return name
+func GroupName(name string, depth int) string {
+	if depth <= 0 {
+		return name
+	}
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	if depth < len(parts) {
+		parts = parts[:depth]
+	}
+	res := strings.Join(parts, "/")
+	if strings.HasPrefix(name, "/") {
+		res = "/" + res
+	}
+	return res
+}
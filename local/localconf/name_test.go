@@ -0,0 +1,93 @@
+package localconf
+
+import "testing"
+
+func TestStreamName(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		name   string
+		isErr  bool
+	}{
+		{"/stream/start/user/cam", "/stream/start/", "user/cam", false},
+		{"/stream/start/org/site/building/cam/", "/stream/start/", "org/site/building/cam", false},
+		{"/stream/start/cam", "/stream/start/", "cam", false},
+		{"/stream/start/", "/stream/start/", "", true},
+		{"/stream/stop/user/cam", "/stream/start/", "", true},
+		{"/stream/start/user//cam", "/stream/start/", "user//cam", true},
+		{"/stream/start/user/../cam", "/stream/start/", "user/../cam", true},
+		{"/stream/start/user/./cam", "/stream/start/", "user/./cam", true},
+	}
+	for _, test := range tests {
+		name, err := StreamName(test.path, test.prefix)
+		if name != test.name || (err != nil) != test.isErr {
+			t.Errorf("StreamName(%q, %q) = %q, %v, want %q, error %v", test.path, test.prefix, name, err, test.name, test.isErr)
+		}
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		name  string
+		isErr bool
+	}{
+		{"user/cam", false},
+		{"/user/cam", false},
+		{"org/site/building/cam", false},
+		{".dvr/cam", true},
+		{"/.dvr/cam", true},
+		{".dvr", true},
+		{"user/.dvr", false},
+		{".dvr2/cam", false},
+		{"", true},
+		{"user/", true},
+		{"user/..", true},
+		{"./cam", true},
+		{"user\\cam", true},
+	}
+	for _, test := range tests {
+		if err := CheckName(test.name); (err != nil) != test.isErr {
+			t.Errorf("CheckName(%q) = %v, want error %v", test.name, err, test.isErr)
+		}
+	}
+}
+
+func TestHasPathPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		res    bool
+	}{
+		{"/org/site/cam", "/org", true},
+		{"/org/site/cam", "/org/", true},
+		{"/org/site/cam", "/org/site/cam", true},
+		{"/org/site/cam", "", true},
+		{"/org2/site/cam", "/org", false},
+		{"/org", "/org/site", false},
+	}
+	for _, test := range tests {
+		if res := HasPathPrefix(test.name, test.prefix); res != test.res {
+			t.Errorf("HasPathPrefix(%q, %q) = %v, want %v", test.name, test.prefix, res, test.res)
+		}
+	}
+}
+
+func TestGroupName(t *testing.T) {
+	tests := []struct {
+		name  string
+		depth int
+		res   string
+	}{
+		{"/org/site/cam", 1, "/org"},
+		{"/org/site/cam", 2, "/org/site"},
+		{"/org/site/cam", 3, "/org/site/cam"},
+		{"/org/site/cam", 5, "/org/site/cam"},
+		{"/org/site/cam", 0, "/org/site/cam"},
+		{"org/site/cam", 1, "org"},
+	}
+	for _, test := range tests {
+		if res := GroupName(test.name, test.depth); res != test.res {
+			t.Errorf("GroupName(%q, %d) = %q, want %q", test.name, test.depth, res, test.res)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package localffmpeg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"camctl/local/localconf"
+	"camctl/local/localproxy"
+)
+
+const (
+	// CameraFile - file in workDir with camera inventory
+	CameraFile string = "cameras.json"
+)
+
+var (
+	// ErrCameraInUse is returned when camera is deleted while its streams or storage jobs are started
+	ErrCameraInUse = errors.New("camera is in use")
+)
+
+// Camera describe camera in inventory, streams and storage jobs started by ?camera=id take its settings
+type Camera struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`             // имя потока и записи: org/site/cam
+	URL        string   `json:"url"`              // основной поток камеры
+	SubURL     string   `json:"suburl,omitempty"` // второй поток камеры, обычно меньшего разрешения
+	User       string   `json:"user,omitempty"`   // подставляется в url, если в нем нет логина
+	Password   string   `json:"password,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	Location   string   `json:"location,omitempty"`
+	Cmd        string   `json:"cmd,omitempty"`        // шаблон потока, пусто - streamCmd
+	StorageCmd string   `json:"storagecmd,omitempty"` // шаблон записи, пусто - storageCmd
+	Params     []string `json:"params,omitempty"`     // параметры шаблона потока name|value
+	Stream     bool     `json:"stream,omitempty"`     // запускать поток при старте camctl
+	Record     bool     `json:"record,omitempty"`     // запускать запись при старте camctl
+}
+
+// checkID return error if id of camera is empty or isn't one part of path
+func checkID(id string) error {
+	if errName := localconf.CheckName(id); errName != nil {
+		return errName
+	}
+	if strings.Contains(id, "/") {
+		return fmt.Errorf("id of camera must not contain '/': %s", id)
+	}
+	return nil
+}
+
+// Check return error if camera can't be started
+func (c *Camera) Check() error {
+	if errID := checkID(c.ID); errID != nil {
+		return errID
+	}
+	if errName := localconf.CheckName(c.Name); errName != nil {
+		return errName
+	}
+	if !strings.Contains(c.Name, "/") {
+		return fmt.Errorf("name of camera must be 'path1/path2[/...]': %s", c.Name)
+	}
+	if len(c.URL) == 0 {
+		return fmt.Errorf("url of camera %s isn't set", c.ID)
+	}
+	for _, param := range c.Params {
+		if !strings.Contains(param, "|") {
+			return fmt.Errorf("param must be 'name|value': %s", param)
+		}
+	}
+	return nil
+}
+
+// StreamURL return main or sub url of camera with credentials, url with own login is returned as is
+func (c *Camera) StreamURL(sub bool) string {
+	res := c.URL
+	if sub && len(c.SubURL) > 0 {
+		res = c.SubURL
+	}
+	if len(c.User) == 0 {
+		return res
+	}
+	parsed, errParse := url.Parse(res)
+	if errParse != nil || parsed.User != nil {
+		return res
+	}
+	if len(c.Password) > 0 {
+		parsed.User = url.UserPassword(c.User, c.Password)
+	} else {
+		parsed.User = url.User(c.User)
+	}
+	return parsed.String()
+}
+
+// HideUser return url without login and password for pages and lists available to any client
+func HideUser(raw string) string {
+	parsed, errParse := url.Parse(raw)
+	if errParse != nil || parsed.User == nil {
+		return raw
+	}
+	parsed.User = nil
+	return parsed.String()
+}
+
+// HasTag return true if camera is marked by tag
+func (c *Camera) HasTag(tag string) bool {
+	for _, curr := range c.Tags {
+		if curr == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Cameras is camera inventory stored in json file
+type Cameras struct {
+	path   string
+	mut    *sync.RWMutex
+	items  map[string]Camera
+	states map[string]*StateFile // state файлы потоков и записей, по ним видно, кто запущен от камеры
+}
+
+// NewCameras load camera inventory from file path
+func NewCameras(logger *zap.Logger, path string) *Cameras {
+	res := Cameras{path: path, mut: new(sync.RWMutex), items: make(map[string]Camera), states: make(map[string]*StateFile)}
+	data, errRead := ioutil.ReadFile(path)
+	if errRead != nil {
+		if !os.IsNotExist(errRead) {
+			logger.Error("load cameras", zap.Error(errRead))
+		}
+		return &res
+	}
+	if len(data) > 0 {
+		if errUnmarshal := json.Unmarshal(data, &res.items); errUnmarshal != nil {
+			logger.Error("load cameras", zap.Error(errUnmarshal))
+		}
+	}
+	return &res
+}
+
+// write is called under lock
+func (c *Cameras) write() error {
+	data, errMarshal := json.MarshalIndent(c.items, "", "  ")
+	if errMarshal != nil {
+		return errMarshal
+	}
+	// пишем во временный файл и переименовываем, чтобы не потерять камеры при падении
+	tmp := c.path + ".tmp"
+	if errWrite := ioutil.WriteFile(tmp, data, 0600); errWrite != nil {
+		return errWrite
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// Get return camera by id
+func (c *Cameras) Get(id string) (Camera, bool) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	res, isFind := c.items[id]
+	return res, isFind
+}
+
+// ByName return camera whose stream has name: org/site/cam
+func (c *Cameras) ByName(name string) (Camera, bool) {
+	name = strings.Trim(name, "/")
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	for _, camera := range c.items {
+		if camera.Name == name {
+			return camera, true
+		}
+	}
+	return Camera{}, false
+}
+
+// List return cameras sorted by id, empty tag return all cameras
+func (c *Cameras) List(tag string) []Camera {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	res := make([]Camera, 0, len(c.items))
+	for _, camera := range c.items {
+		if len(tag) == 0 || camera.HasTag(tag) {
+			res = append(res, camera)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// Set check and store camera, existing camera with same id is replaced
+func (c *Cameras) Set(camera Camera) error {
+	if errCheck := camera.Check(); errCheck != nil {
+		return errCheck
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	// две камеры с одним именем писали бы в одни файлы
+	for id, curr := range c.items {
+		if id != camera.ID && curr.Name == camera.Name {
+			return fmt.Errorf("name %s is used by camera %s", camera.Name, id)
+		}
+	}
+	old, isFind := c.items[camera.ID]
+	c.items[camera.ID] = camera
+	if errWrite := c.write(); errWrite != nil {
+		if isFind {
+			c.items[camera.ID] = old
+		} else {
+			delete(c.items, camera.ID)
+		}
+		return errWrite
+	}
+	return nil
+}
+
+// watch bind state file of started jobs of kind (stream, storage), it is called by constructors of handlers
+func (c *Cameras) watch(kind string, state *StateFile) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.states[kind] = state
+}
+
+// users return jobs started by camera id and not stopped, it is called under lock
+func (c *Cameras) users(id string) ([]string, error) {
+	res := make([]string, 0)
+	for kind, state := range c.states {
+		items, errLoad := state.Load()
+		if errLoad != nil {
+			return nil, errLoad
+		}
+		for _, item := range items {
+			if item.Query.Get("camera") == id {
+				res = append(res, kind+" "+item.Name)
+			}
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Del remove camera by id, return false if it isn't found. Camera with started streams or storage jobs
+// isn't removed: after restart of camctl they couldn't be restored without it
+func (c *Cameras) Del(id string) (bool, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	old, isFind := c.items[id]
+	if !isFind {
+		return false, nil
+	}
+	users, errUsers := c.users(id)
+	if errUsers != nil {
+		return true, errUsers
+	}
+	if len(users) > 0 {
+		return true, fmt.Errorf("%w: %s, stop them first", ErrCameraInUse, strings.Join(users, ", "))
+	}
+	delete(c.items, id)
+	if errWrite := c.write(); errWrite != nil {
+		c.items[id] = old
+		return false, errWrite
+	}
+	return true, nil
+}
+
+// Inherit fill parameters of start by camera from ?camera=id: empty name, url, template and its params
+// are taken from camera record, sub=1 select second stream of camera. Query without camera is returned as is
+func (c *Cameras) Inherit(name string, query url.Values, storage bool) (string, url.Values, error) {
+	id := query.Get("camera")
+	if len(id) == 0 {
+		return name, query, nil
+	}
+	camera, isFind := c.Get(id)
+	if !isFind {
+		return name, query, fmt.Errorf("camera %s not found", id)
+	}
+	if len(name) == 0 {
+		name = camera.Name
+	}
+	// query сохраняется в state как есть, чтобы после перезапуска взять свежие настройки камеры
+	res := make(url.Values, len(query))
+	for key, values := range query {
+		res[key] = append([]string(nil), values...)
+	}
+	if len(res.Get("url")) == 0 {
+		sub, _ := strconv.ParseBool(res.Get("sub"))
+		res.Set("url", camera.StreamURL(sub))
+	}
+	cmd := camera.Cmd
+	if storage {
+		cmd = camera.StorageCmd
+	}
+	if len(res.Get("cmd")) == 0 && len(cmd) > 0 {
+		res.Set("cmd", cmd)
+	}
+	// параметры описаны для шаблона потока, шаблон записи их может не знать
+	if !storage && len(res["param"]) == 0 && len(camera.Params) > 0 {
+		res["param"] = append([]string(nil), camera.Params...)
+	}
+	return name, res, nil
+}
+
+// CameraHandler describe http handler object for camera inventory
+type CameraHandler struct {
+	log     *zap.Logger
+	conf    *localconf.Config
+	cameras *Cameras
+}
+
+// NewCameraHandler create http handler
+func NewCameraHandler(logger *zap.Logger, config *localconf.Config, cameras *Cameras) *CameraHandler {
+	res := CameraHandler{log: logger, conf: config, cameras: cameras}
+	return &res
+}
+
+// cameraID return id of camera after route prefix: "/camera/get/cam1" -> "cam1"
+func cameraID(path string, prefix string) (string, error) {
+	if !strings.HasPrefix(path, prefix) {
+		return "", fmt.Errorf("must be '%sid'", prefix)
+	}
+	id := strings.Trim(path[len(prefix):], "/")
+	return id, checkID(id)
+}
+
+func (h *CameraHandler) list(c *gin.Context) {
+	c.JSON(http.StatusOK, localproxy.Response{Errno: localproxy.OK, Error: "ok", Data: h.cameras.List(c.Request.FormValue("tag"))})
+}
+
+func (h *CameraHandler) get(c *gin.Context) {
+	id, errID := cameraID(c.Request.URL.Path, "/camera/get/")
+	if errID != nil {
+		localproxy.Error(c, errID.Error(), http.StatusBadRequest)
+		return
+	}
+	camera, isFind := h.cameras.Get(id)
+	if !isFind {
+		c.JSON(http.StatusNotFound, localproxy.Response{Errno: localproxy.NotFound, Error: "camera not found"})
+		return
+	}
+	c.JSON(http.StatusOK, localproxy.Response{Errno: localproxy.OK, Error: "ok", Data: camera})
+}
+
+// set create or replace camera by json from body, id is taken from path
+func (h *CameraHandler) set(c *gin.Context) {
+	id, errID := cameraID(c.Request.URL.Path, "/camera/set/")
+	if errID != nil {
+		localproxy.Error(c, errID.Error(), http.StatusBadRequest)
+		return
+	}
+	body, errRead := ioutil.ReadAll(c.Request.Body)
+	if errRead != nil {
+		localproxy.Error(c, errRead.Error(), http.StatusBadRequest)
+		return
+	}
+	var camera Camera
+	if errUnmarshal := json.Unmarshal(body, &camera); errUnmarshal != nil {
+		localproxy.Error(c, "camera: "+errUnmarshal.Error(), http.StatusBadRequest)
+		return
+	}
+	camera.ID = id
+	if errSet := h.cameras.Set(camera); errSet != nil {
+		localproxy.Error(c, errSet.Error(), http.StatusBadRequest)
+		return
+	}
+	h.log.Sugar().Infof("camera %s is set: %s", camera.ID, camera.Name)
+	c.JSON(http.StatusOK, localproxy.Response{Errno: localproxy.OK, Error: "ok", Data: camera})
+}
+
+func (h *CameraHandler) del(c *gin.Context) {
+	id, errID := cameraID(c.Request.URL.Path, "/camera/del/")
+	if errID != nil {
+		localproxy.Error(c, errID.Error(), http.StatusBadRequest)
+		return
+	}
+	isFind, errDel := h.cameras.Del(id)
+	if errors.Is(errDel, ErrCameraInUse) {
+		localproxy.Error(c, errDel.Error(), http.StatusConflict)
+		return
+	}
+	if errDel != nil {
+		h.log.Error("delete camera", zap.String("id", id), zap.Error(errDel))
+		localproxy.Error(c, errDel.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !isFind {
+		localproxy.Error(c, "not found", http.StatusNotFound)
+		return
+	}
+	h.log.Sugar().Infof("camera %s is deleted", id)
+	localproxy.Error(c, "deleted", http.StatusOK)
+}
+
+func (h *CameraHandler) ServeHTTP(c *gin.Context) {
+	// в записях камер логины и пароли, поэтому только для доверенных ip
+	if !h.conf.IsTrustedIP(c.Request.RemoteAddr) {
+		h.log.Sugar().Errorf("forbidden by remote ip %s", c.Request.RemoteAddr)
+		localproxy.Error(c, "forbidden", http.StatusForbidden)
+		return
+	}
+	if strings.HasPrefix(c.Request.URL.Path, "/camera/list") {
+		h.list(c)
+	} else if strings.HasPrefix(c.Request.URL.Path, "/camera/get/") {
+		h.get(c)
+	} else if strings.HasPrefix(c.Request.URL.Path, "/camera/set/") {
+		h.set(c)
+	} else if strings.HasPrefix(c.Request.URL.Path, "/camera/del/") {
+		h.del(c)
+	} else {
+		localproxy.Error(c, "bad path", http.StatusBadRequest)
+		return
+	}
+}
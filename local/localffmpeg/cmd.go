@@ -0,0 +1,47 @@
+package localffmpeg
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"camctl/local/localconf"
+	"camctl/local/localproxy"
+)
+
+// CmdList describe loaded command templates and defaults for response
+type CmdList struct {
+	Templates []string             `json:"templates"`
+	Descs     []*localconf.CmdDesc `json:"descs,omitempty"`
+	Stream    string               `json:"stream,omitempty"`
+	Storage   string               `json:"storage,omitempty"`
+}
+
+// CmdHandler describe http handler object for command templates
+type CmdHandler struct {
+	log  *zap.Logger
+	conf *localconf.Config
+}
+
+// NewCmdHandler create http handler
+func NewCmdHandler(logger *zap.Logger, config *localconf.Config) *CmdHandler {
+	res := CmdHandler{log: logger, conf: config}
+	return &res
+}
+
+// List return loaded command templates
+func (h *CmdHandler) List() CmdList {
+	names := h.conf.CmdNames()
+	descs := make([]*localconf.CmdDesc, 0, len(names))
+	for _, name := range names {
+		if desc, ok := h.conf.GetCmdDesc(name); ok {
+			descs = append(descs, desc)
+		}
+	}
+	return CmdList{Templates: names, Descs: descs, Stream: *h.conf.StreamCmd, Storage: *h.conf.StorageCmd}
+}
+
+func (h *CmdHandler) ServeHTTP(c *gin.Context) {
+	c.JSON(http.StatusOK, localproxy.Response{Errno: localproxy.OK, Error: "ok", Data: h.List()})
+}
@@ -1,10 +1,12 @@
 package localffmpeg
 
 import (
+	"camctl/local/localconf"
 	"camctl/local/locallog"
 	"camctl/local/localnotif"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -12,21 +14,61 @@ import (
 type FFMPEG struct {
 	Name          string                     `json:"name,omitempty"`
 	Dir           string                     `json:"dir,omitempty"`
+	Cmd           string                     `json:"cmd,omitempty"`
+	Runner        string                     `json:"runner,omitempty"`
+	Params        map[string]string          `json:"params,omitempty"`
 	TimeStr       string                     `json:"time,omitempty"`
 	Notifications []*localnotif.Notification `json:"notification,omitempty"`
 	OnStart       []*localnotif.Webhook      `json:"onstart,omitempty"`
 	OnStop        []*localnotif.Webhook      `json:"onstop,omitempty"`
 	OnError       []*localnotif.Webhook      `json:"onerror,omitempty"`
+	Restarts      int                        `json:"restarts"`
+	LastExit      string                     `json:"lastexit,omitempty"`
 	Log           *locallog.BuffLog          `json:"-"`
+	exitMut       *sync.RWMutex
+}
+
+// SetExit store reason of process exit and increment restart counter
+func (f *FFMPEG) SetExit(reason string) int {
+	f.exitMut.Lock()
+	defer f.exitMut.Unlock()
+	f.Restarts++
+	f.LastExit = reason
+	return f.Restarts
+}
+
+// Exit return restart counter and reason of last process exit
+func (f *FFMPEG) Exit() (int, string) {
+	f.exitMut.RLock()
+	defer f.exitMut.RUnlock()
+	return f.Restarts, f.LastExit
 }
 
 // StreamFFMPEG describe cache object
 type StreamFFMPEG struct {
 	FFMPEG
-	URLIn       string `json:"urlin,omitempty"`
-	Port        uint   `json:"port,omitempty"`
-	InitSegment string `json:"init,omitempty"`
-	ExtraWindow uint   `json:"extra,omitempty"`
+	URLIn       string                  `json:"urlin,omitempty"`
+	Port        uint                    `json:"port,omitempty"`
+	InitSegment string                  `json:"init,omitempty"`
+	ExtraWindow uint                    `json:"extra,omitempty"`
+	Probe       *Probe                  `json:"probe,omitempty"`
+	Manifest    localconf.ManifestRules `json:"manifest"`
+	Timeshift   uint                    `json:"timeshift,omitempty"` // глубина timeshift, секунды
+	Progress    *ProgressHistory        `json:"-"`
+}
+
+// SetManifest replace rules for manifests of stream
+func (f *StreamFFMPEG) SetManifest(rules localconf.ManifestRules) {
+	f.exitMut.Lock()
+	defer f.exitMut.Unlock()
+	f.Manifest = rules
+}
+
+// GetManifest return rules for manifests of stream
+func (f *StreamFFMPEG) GetManifest() localconf.ManifestRules {
+	f.exitMut.RLock()
+	defer f.exitMut.RUnlock()
+	return f.Manifest
 }
 
 // StorageFFMPEG describe cache object
@@ -63,12 +105,12 @@ func BuildFFMPEG(name string, workDir string, notifications []string, onstart []
 	}
 	onStart := convertToWebhooks(onstart)
 	onStop := convertToWebhooks(onstop)
-	onError := convertToWebhooks(onstop)
-	return FFMPEG{Name: name, Dir: workDir, TimeStr: nowStr, Notifications: nt, OnStart: onStart, OnStop: onStop, OnError: onError}
+	onError := convertToWebhooks(onerror)
+	return FFMPEG{Name: name, Dir: workDir, TimeStr: nowStr, Notifications: nt, OnStart: onStart, OnStop: onStop, OnError: onError, exitMut: new(sync.RWMutex)}
 }
 
 func BuildStreamFFMPEG(name string, workDir string, URLIn string, port uint, initSegment string, extraWindow uint, notifications []string, onstart []string, onstop []string, onerror []string) *StreamFFMPEG {
-	data := StreamFFMPEG{URLIn: URLIn, Port: port, InitSegment: initSegment, ExtraWindow: extraWindow, FFMPEG: BuildFFMPEG(name, workDir, notifications, onstart, onstop, onerror)}
+	data := StreamFFMPEG{URLIn: URLIn, Port: port, InitSegment: initSegment, ExtraWindow: extraWindow, Progress: NewProgressHistory(ProgressHistorySize), FFMPEG: BuildFFMPEG(name, workDir, notifications, onstart, onstop, onerror)}
 	return &data
 }
 
@@ -77,31 +119,23 @@ func BuildStorageFFMPEG(name string, workDir string, URLIn string, URLOut string
 	return &data
 }
 
-// SplitArgs каждый специальный аргумент должен быть заключен в кавычки, а кавычки не должны граничить с пробелами внутри аргумента
-// "id=0,streams=v id=1,streams=a" - хорошо
-// "id=0,streams=v id=1,streams=a " - плохо
-// " id=0,streams=v id=1,streams=a" - плохо
+// SplitArgs делит аргументы по пробелам, текст в кавычках - один аргумент, пустые кавычки пропускаются
+// -adaptation_sets "id=0,streams=v id=1,streams=a" -> [-adaptation_sets, id=0,streams=v id=1,streams=a]
 func SplitArgs(argsStr string) []string {
 	firstSplit := strings.Split(argsStr, "\"")
 	array := make([]string, 0)
-	for _, item := range firstSplit {
-		isSingle := true
-		if strings.HasPrefix(item, " ") {
-			item = item[1:]
-			isSingle = false
-		}
-		if strings.HasSuffix(item, " ") {
-			item = item[0 : len(item)-1]
-			isSingle = false
-		}
-		if len(item) == 0 {
+	for i, item := range firstSplit {
+		if i%2 == 1 {
+			// внутри кавычек
+			if len(item) > 0 {
+				array = append(array, item)
+			}
 			continue
 		}
-		if isSingle {
-			array = append(array, item)
-		} else {
-			add := strings.Split(item, " ")
-			array = append(array, add...)
+		for _, arg := range strings.Split(item, " ") {
+			if len(arg) > 0 {
+				array = append(array, arg)
+			}
 		}
 	}
 	return array
@@ -0,0 +1,39 @@
+package localffmpeg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		args string
+		res  []string
+	}{
+		{"-i rtsp://cam -c copy out.mp4", []string{"-i", "rtsp://cam", "-c", "copy", "out.mp4"}},
+		{"-adaptation_sets \"id=0,streams=v id=1,streams=a\" -f dash", []string{"-adaptation_sets", "id=0,streams=v id=1,streams=a", "-f", "dash"}},
+		{"\"a b\"", []string{"a b"}},
+		{"-x \"\" -y", []string{"-x", "-y"}},
+		{"", []string{}},
+	}
+	for _, test := range tests {
+		if res := SplitArgs(test.args); !reflect.DeepEqual(res, test.res) {
+			t.Errorf("SplitArgs(%q) = %q, want %q", test.args, res, test.res)
+		}
+	}
+}
+
+func TestSplitArgsTemplates(t *testing.T) {
+	tests := []struct {
+		args string
+		res  []string
+	}{
+		{"in=udp://127.0.0.1:1234,stream=video --segment_duration 1.5  --hls_playlist_type LIVE", []string{"in=udp://127.0.0.1:1234,stream=video", "--segment_duration", "1.5", "--hls_playlist_type", "LIVE"}},
+		{"-re -i \"rtsp://cam\" -c:v copy \"out_%04Y.ts\"", []string{"-re", "-i", "rtsp://cam", "-c:v", "copy", "out_%04Y.ts"}},
+	}
+	for _, test := range tests {
+		if res := SplitArgs(test.args); !reflect.DeepEqual(res, test.res) {
+			t.Errorf("SplitArgs(%q) = %q, want %q", test.args, res, test.res)
+		}
+	}
+}
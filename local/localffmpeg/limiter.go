@@ -0,0 +1,198 @@
+package localffmpeg
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// classes of ffmpeg jobs
+const (
+	ClassStream  string = "stream"
+	ClassStorage string = "storage"
+)
+
+// default priorities of classes, job with higher priority leaves the queue first
+const (
+	StreamPriority  int = 0
+	StoragePriority int = 10
+)
+
+var (
+	// ErrLimit is returned when limit is reached and queue is off
+	ErrLimit = errors.New("too many ffmpeg jobs")
+	// ErrQueueFull is returned when queue of ffmpeg jobs is full
+	ErrQueueFull = errors.New("queue of ffmpeg jobs is full")
+	// ErrTooHeavy is returned when weight of job is over total or class limit, such job never starts
+	ErrTooHeavy = errors.New("weight of ffmpeg job is over limit")
+)
+
+// limitStatus return http status of refusal by Limiter: full queue is temporary, over limit is refused until jobs stop
+func limitStatus(err error) int {
+	if err == ErrQueueFull {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusTooManyRequests
+}
+
+// Ticket describe place of ffmpeg job in Limiter
+type Ticket struct {
+	Class    string
+	Name     string
+	Weight   float64
+	Priority int
+	limiter  *Limiter
+	ready    chan struct{}
+	granted  bool
+	released bool
+}
+
+// Limiter limit summary weight of running ffmpeg jobs, total and per class, jobs over the limit wait in queue by priority
+type Limiter struct {
+	mut      *sync.Mutex
+	total    float64            // 0 - без ограничения
+	classes  map[string]float64 // 0 - без ограничения
+	maxQueue int                // 0 - сверх лимита сразу отказ
+	used     float64
+	usedBy   map[string]float64
+	queue    []*Ticket
+}
+
+// NewLimiter build Limiter, zero limit means unlimited
+func NewLimiter(total float64, classes map[string]float64, maxQueue int) *Limiter {
+	res := Limiter{mut: new(sync.Mutex), total: total, classes: classes, maxQueue: maxQueue, usedBy: make(map[string]float64)}
+	return &res
+}
+
+func (l *Limiter) fitTotal(t *Ticket) bool {
+	return l.total <= 0 || l.used+t.Weight <= l.total
+}
+
+func (l *Limiter) fitClass(t *Ticket) bool {
+	limit := l.classes[t.Class]
+	return limit <= 0 || l.usedBy[t.Class]+t.Weight <= limit
+}
+
+// dispatch grant waiting tickets in order of queue, it is called under lock
+func (l *Limiter) dispatch() {
+	rest := l.queue[:0]
+	blocked := false
+	for _, t := range l.queue {
+		if blocked || !l.fitClass(t) {
+			// упершийся в лимит своего класса не мешает другим классам
+			rest = append(rest, t)
+			continue
+		}
+		if !l.fitTotal(t) {
+			// за ним никого не пропускаем, иначе мелкие задачи будут вечно обгонять крупные
+			blocked = true
+			rest = append(rest, t)
+			continue
+		}
+		l.used += t.Weight
+		l.usedBy[t.Class] += t.Weight
+		t.granted = true
+		close(t.ready)
+	}
+	for i := len(rest); i < len(l.queue); i++ {
+		l.queue[i] = nil
+	}
+	l.queue = rest
+}
+
+func (l *Limiter) remove(t *Ticket) {
+	for i, find := range l.queue {
+		if find == t {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// Acquire put job into queue, return ticket and position in queue: 0 if job can start now
+func (l *Limiter) Acquire(class string, name string, weight float64, priority int) (*Ticket, int, error) {
+	if weight <= 0 {
+		weight = 1
+	}
+	t := &Ticket{Class: class, Name: name, Weight: weight, Priority: priority, limiter: l, ready: make(chan struct{})}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if limit := l.classes[class]; (l.total > 0 && weight > l.total) || (limit > 0 && weight > limit) {
+		// в очереди такая задача ждала бы вечно и держала бы всех за собой
+		return nil, 0, ErrTooHeavy
+	}
+	// вставляем после всех с таким же или более высоким приоритетом
+	pos := len(l.queue)
+	for i, find := range l.queue {
+		if find.Priority < priority {
+			pos = i
+			break
+		}
+	}
+	l.queue = append(l.queue, nil)
+	copy(l.queue[pos+1:], l.queue[pos:])
+	l.queue[pos] = t
+	l.dispatch()
+	if t.granted {
+		return t, 0, nil
+	}
+	if l.maxQueue == 0 {
+		l.remove(t)
+		return nil, 0, ErrLimit
+	}
+	if len(l.queue) > l.maxQueue {
+		l.remove(t)
+		return nil, 0, ErrQueueFull
+	}
+	return t, l.position(t), nil
+}
+
+func (l *Limiter) position(t *Ticket) int {
+	for i, find := range l.queue {
+		if find == t {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Position return position of job in queue starting from 1, 0 if job isn't queued
+func (l *Limiter) Position(class string, name string) int {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	for i, find := range l.queue {
+		if find.Class == class && find.Name == name {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Wait wait until job may start, return false if stop is closed before
+func (t *Ticket) Wait(stop <-chan struct{}) bool {
+	select {
+	case <-t.ready:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// Release return weight of job to Limiter or remove job from queue
+func (t *Ticket) Release() {
+	l := t.limiter
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if t.released {
+		return
+	}
+	t.released = true
+	if t.granted {
+		l.used -= t.Weight
+		l.usedBy[t.Class] -= t.Weight
+	} else {
+		l.remove(t)
+	}
+	l.dispatch()
+}
@@ -0,0 +1,140 @@
+package localffmpeg
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLimiterTooHeavy(t *testing.T) {
+	l := NewLimiter(4, map[string]float64{ClassStream: 2}, 10)
+	tests := []struct {
+		class  string
+		weight float64
+		err    error
+	}{
+		{ClassStream, 3, ErrTooHeavy},
+		{ClassStorage, 5, ErrTooHeavy},
+		{ClassStorage, 4, nil},
+	}
+	for _, test := range tests {
+		ticket, _, err := l.Acquire(test.class, "/user/cam", test.weight, 0)
+		if err != test.err {
+			t.Errorf("Acquire(%s, %v) = %v, want %v", test.class, test.weight, err, test.err)
+		}
+		if ticket != nil {
+			ticket.Release()
+		}
+	}
+	if n := len(l.queue); n != 0 {
+		t.Errorf("%d jobs are left in queue", n)
+	}
+}
+
+// testAcquire acquire ticket which must be given
+func testAcquire(t *testing.T, l *Limiter, class string, name string, weight float64, priority int) (*Ticket, int) {
+	t.Helper()
+	ticket, pos, err := l.Acquire(class, name, weight, priority)
+	if err != nil {
+		t.Fatalf("Acquire(%s, %s) = %v", class, name, err)
+	}
+	return ticket, pos
+}
+
+func isGranted(ticket *Ticket) bool {
+	select {
+	case <-ticket.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestLimiterPriority(t *testing.T) {
+	l := NewLimiter(1, nil, 10)
+	running, pos := testAcquire(t, l, ClassStream, "/user/cam0", 1, StreamPriority)
+	if pos != 0 || !isGranted(running) {
+		t.Fatalf("first job isn't started: position %d", pos)
+	}
+	stream, pos := testAcquire(t, l, ClassStream, "/user/cam1", 1, StreamPriority)
+	if pos != 1 {
+		t.Errorf("stream position %d, want 1", pos)
+	}
+	// запись пришла позже, но ее приоритет выше
+	storage, pos := testAcquire(t, l, ClassStorage, "/user/cam1", 1, StoragePriority)
+	if pos != 1 {
+		t.Errorf("storage position %d, want 1", pos)
+	}
+	if n := l.Position(ClassStream, "/user/cam1"); n != 2 {
+		t.Errorf("Position of stream %d, want 2", n)
+	}
+	if n := l.Position(ClassStream, "/user/cam0"); n != 0 {
+		t.Errorf("Position of running job %d, want 0", n)
+	}
+
+	running.Release()
+	if !isGranted(storage) || isGranted(stream) {
+		t.Fatalf("after Release storage granted %v, stream granted %v", isGranted(storage), isGranted(stream))
+	}
+	if n := l.Position(ClassStream, "/user/cam1"); n != 1 {
+		t.Errorf("Position of stream after Release %d, want 1", n)
+	}
+	// повторный Release ничего не отдает второй раз
+	running.Release()
+	if isGranted(stream) {
+		t.Error("second Release of the same ticket starts job")
+	}
+	storage.Release()
+	if !isGranted(stream) {
+		t.Error("stream isn't started after Release of storage")
+	}
+	stream.Release()
+	if l.used != 0 || len(l.queue) != 0 {
+		t.Errorf("used %v, queue %d after all Release", l.used, len(l.queue))
+	}
+}
+
+func TestLimiterClass(t *testing.T) {
+	l := NewLimiter(4, map[string]float64{ClassStream: 2}, 10)
+	testAcquire(t, l, ClassStream, "/user/cam0", 2, StreamPriority)
+	// стрим уперся в лимит класса, но не держит за собой запись даже с тем же приоритетом
+	stream, pos := testAcquire(t, l, ClassStream, "/user/cam1", 1, StreamPriority)
+	if pos != 1 || isGranted(stream) {
+		t.Errorf("stream over class limit: position %d, granted %v", pos, isGranted(stream))
+	}
+	storage, pos := testAcquire(t, l, ClassStorage, "/user/cam0", 2, StreamPriority)
+	if pos != 0 || !isGranted(storage) {
+		t.Errorf("storage behind class limit of streams: position %d, granted %v", pos, isGranted(storage))
+	}
+
+	// отказ из очереди освобождает место следующему
+	stream.Release()
+	if n := l.Position(ClassStream, "/user/cam1"); n != 0 || len(l.queue) != 0 {
+		t.Errorf("released ticket is left in queue at %d", n)
+	}
+}
+
+func TestLimiterQueue(t *testing.T) {
+	l := NewLimiter(1, nil, 1)
+	testAcquire(t, l, ClassStream, "/user/cam0", 1, StreamPriority)
+	testAcquire(t, l, ClassStream, "/user/cam1", 1, StreamPriority)
+	_, _, err := l.Acquire(ClassStream, "/user/cam2", 1, StreamPriority)
+	if err != ErrQueueFull {
+		t.Errorf("Acquire over queue = %v, want %v", err, ErrQueueFull)
+	}
+	if code := limitStatus(err); code != http.StatusServiceUnavailable {
+		t.Errorf("status of %v = %d, want %d", err, code, http.StatusServiceUnavailable)
+	}
+
+	// без очереди сверх лимита сразу отказ
+	l = NewLimiter(1, nil, 0)
+	testAcquire(t, l, ClassStream, "/user/cam0", 1, StreamPriority)
+	_, _, err = l.Acquire(ClassStream, "/user/cam1", 1, StreamPriority)
+	if err != ErrLimit {
+		t.Errorf("Acquire without queue = %v, want %v", err, ErrLimit)
+	}
+	for _, err := range []error{ErrLimit, ErrTooHeavy} {
+		if code := limitStatus(err); code != http.StatusTooManyRequests {
+			t.Errorf("status of %v = %d, want %d", err, code, http.StatusTooManyRequests)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package localffmpeg
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"camctl/local/localconf"
+	"camctl/local/localproxy"
+)
+
+// ProcInfo describe state of process for list response
+type ProcInfo struct {
+	State  ProcState `json:"state"`
+	Pid    int       `json:"pid,omitempty"`
+	Uptime float64   `json:"uptime"`          // секунды с момента запуска
+	Queue  int       `json:"queue,omitempty"` // место в очереди лимита
+}
+
+// StreamInfo describe stream for /stream/list
+type StreamInfo struct {
+	StreamFFMPEG
+	ProcInfo
+	Segments   int                         `json:"segments"`
+	Cache      localproxy.CacheStats       `json:"cache"`
+	Tracks     []localproxy.TrackInfo      `json:"tracks"`
+	DVR        *localproxy.DVRStats        `json:"dvr,omitempty"`
+	Generation *localproxy.GenerationStats `json:"generation,omitempty"`
+}
+
+// StorageInfo describe storage job for /storage/list
+type StorageInfo struct {
+	StorageFFMPEG
+	ProcInfo
+}
+
+// Uptime return time since FFMPEG was created
+func (f *FFMPEG) Uptime() time.Duration {
+	started, errParse := strconv.ParseFloat(f.TimeStr, 64)
+	if errParse != nil {
+		return 0
+	}
+	return time.Since(time.Unix(0, int64(started*float64(time.Second))))
+}
+
+// Snapshot return copy of StreamFFMPEG which can be read while ffmpeg works
+func (f *StreamFFMPEG) Snapshot() StreamFFMPEG {
+	f.exitMut.RLock()
+	defer f.exitMut.RUnlock()
+	return *f
+}
+
+// Snapshot return copy of StorageFFMPEG which can be read while ffmpeg works
+func (f *StorageFFMPEG) Snapshot() StorageFFMPEG {
+	f.exitMut.RLock()
+	defer f.exitMut.RUnlock()
+	return *f
+}
+
+func buildProcInfo(ctrl *Controller, limiter *Limiter, class string, key string, f *FFMPEG) ProcInfo {
+	res := ProcInfo{State: StateStarting, Uptime: f.Uptime().Seconds(), Queue: limiter.Position(class, key)}
+	if proc := ctrl.Get(key); proc != nil {
+		res.State = proc.State()
+		res.Pid = proc.Pid()
+	}
+	return res
+}
+
+// sortedKeys return keys of procArgs inside "/"+user in sorted order, user is prefix of name of any depth: org or org/site
+func sortedKeys(keys []string, user string) []string {
+	res := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if localconf.HasPathPrefix(key, "/"+strings.Trim(user, "/")) {
+			res = append(res, key)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// List return streams which names start with user, empty user return all streams
+func (h *StreamHandler) List(user string) []StreamInfo {
+	h.procArgsMut.RLock()
+	keys := make([]string, 0, len(h.procArgs))
+	for key := range h.procArgs {
+		keys = append(keys, key)
+	}
+	h.procArgsMut.RUnlock()
+
+	res := make([]StreamInfo, 0, len(keys))
+	for _, key := range sortedKeys(keys, user) {
+		find := h.GetProcArgs(key)
+		if find == nil {
+			continue
+		}
+		info := StreamInfo{StreamFFMPEG: find.Snapshot(), ProcInfo: buildProcInfo(h.ctrl, h.limiter, ClassStream, key, &find.FFMPEG)}
+		info.URLIn = HideUser(info.URLIn)
+		info.Segments = h.items.Count(key + "/")
+		info.Cache = h.items.Stats(key)
+		info.Tracks = h.items.Tracks(key)
+		if dvr, ok := h.items.DVRStats(key); ok {
+			info.DVR = &dvr
+		}
+		if generation, ok := h.items.Generation(key); ok {
+			info.Generation = &generation
+		}
+		res = append(res, info)
+	}
+	return res
+}
+
+func (h *StreamHandler) list(c *gin.Context) {
+	res := h.List(c.Query("user"))
+	depth, _ := strconv.Atoi(c.Query("depth"))
+	if depth <= 0 {
+		c.JSON(http.StatusOK, localproxy.Response{Errno: localproxy.OK, Error: "ok", Data: res})
+		return
+	}
+	// группы по первым depth частям имени: depth=1 - организации, depth=2 - площадки
+	groups := make(map[string][]StreamInfo)
+	for _, info := range res {
+		group := localconf.GroupName("/"+strings.TrimPrefix(info.Name, "/"), depth)
+		groups[group] = append(groups[group], info)
+	}
+	c.JSON(http.StatusOK, localproxy.Response{Errno: localproxy.OK, Error: "ok", Data: groups})
+}
+
+// List return storage jobs which names start with user, empty user return all jobs
+func (h *StorageHandler) List(user string) []StorageInfo {
+	h.procArgsMut.RLock()
+	keys := make([]string, 0, len(h.procArgs))
+	for key := range h.procArgs {
+		keys = append(keys, key)
+	}
+	h.procArgsMut.RUnlock()
+
+	res := make([]StorageInfo, 0, len(keys))
+	for _, key := range sortedKeys(keys, user) {
+		find := h.GetProcArgs(key)
+		if find == nil {
+			continue
+		}
+		info := StorageInfo{StorageFFMPEG: find.Snapshot(), ProcInfo: buildProcInfo(h.ctrl, h.limiter, ClassStorage, key, &find.FFMPEG)}
+		info.URLIn = HideUser(info.URLIn)
+		res = append(res, info)
+	}
+	return res
+}
+
+func (h *StorageHandler) list(c *gin.Context) {
+	res := h.List(c.Query("user"))
+	depth, _ := strconv.Atoi(c.Query("depth"))
+	if depth <= 0 {
+		c.JSON(http.StatusOK, localproxy.Response{Errno: localproxy.OK, Error: "ok", Data: res})
+		return
+	}
+	groups := make(map[string][]StorageInfo)
+	for _, info := range res {
+		group := localconf.GroupName("/"+strings.TrimPrefix(info.Name, "/"), depth)
+		groups[group] = append(groups[group], info)
+	}
+	c.JSON(http.StatusOK, localproxy.Response{Errno: localproxy.OK, Error: "ok", Data: groups})
+}
@@ -0,0 +1,126 @@
+package localffmpeg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProbeStream describe one stream of camera found by ffprobe
+type ProbeStream struct {
+	Index      int     `json:"index"`
+	Type       string  `json:"type"`
+	Codec      string  `json:"codec,omitempty"`
+	Width      int     `json:"width,omitempty"`
+	Height     int     `json:"height,omitempty"`
+	FPS        float64 `json:"fps,omitempty"`
+	SampleRate int     `json:"samplerate,omitempty"`
+	Channels   int     `json:"channels,omitempty"`
+}
+
+// Probe describe result of ffprobe for input url
+type Probe struct {
+	Time    time.Time     `json:"time"`
+	Format  string        `json:"format,omitempty"`
+	Video   bool          `json:"video"`
+	Audio   bool          `json:"audio"`
+	Streams []ProbeStream `json:"streams"`
+}
+
+// ffprobeOutput is part of ffprobe -print_format json output
+type ffprobeOutput struct {
+	Streams []struct {
+		Index        int    `json:"index"`
+		CodecType    string `json:"codec_type"`
+		CodecName    string `json:"codec_name"`
+		Width        int    `json:"width"`
+		Height       int    `json:"height"`
+		AvgFrameRate string `json:"avg_frame_rate"`
+		RFrameRate   string `json:"r_frame_rate"`
+		SampleRate   string `json:"sample_rate"`
+		Channels     int    `json:"channels"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string `json:"format_name"`
+	} `json:"format"`
+}
+
+// parseRate parse frame rate of ffprobe: "25/1", "30000/1001" or "0/0"
+func parseRate(rate string) float64 {
+	array := strings.SplitN(rate, "/", 2)
+	num, errNum := strconv.ParseFloat(array[0], 64)
+	if errNum != nil {
+		return 0
+	}
+	if len(array) == 1 {
+		return num
+	}
+	den, errDen := strconv.ParseFloat(array[1], 64)
+	if errDen != nil || den == 0 {
+		return 0
+	}
+	return num / den
+}
+
+// RunProbe run ffprobe for url and wait its result not longer than timeout
+func RunProbe(bin string, urlIn string, timeout time.Duration) (*Probe, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, bin, "-v", "error", "-analyzeduration", "5M", "-probesize", "5M", "-print_format", "json", "-show_streams", "-show_format", urlIn)
+	stdout := bytes.Buffer{}
+	stderr := bytes.Buffer{}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Run()
+	}()
+	var errRun error
+	select {
+	case errRun = <-done:
+	case <-ctx.Done():
+		// ffprobe убит контекстом, но его потомки могут держать пайпы - не ждем их
+		return nil, fmt.Errorf("ffprobe timeout %s", timeout)
+	}
+	if errRun != nil {
+		mess := strings.TrimSpace(stderr.String())
+		if len(mess) == 0 {
+			mess = errRun.Error()
+		}
+		return nil, fmt.Errorf("ffprobe: %s", mess)
+	}
+	return parseProbe(stdout.Bytes())
+}
+
+// parseProbe build Probe from json output of ffprobe, input without video is error but its Probe is returned too
+func parseProbe(data []byte) (*Probe, error) {
+	out := ffprobeOutput{}
+	if errUnmarshal := json.Unmarshal(data, &out); errUnmarshal != nil {
+		return nil, fmt.Errorf("ffprobe output: %s", errUnmarshal.Error())
+	}
+	res := Probe{Time: time.Now(), Format: out.Format.FormatName, Streams: make([]ProbeStream, 0, len(out.Streams))}
+	for _, s := range out.Streams {
+		stream := ProbeStream{Index: s.Index, Type: s.CodecType, Codec: s.CodecName, Width: s.Width, Height: s.Height, Channels: s.Channels}
+		switch s.CodecType {
+		case "video":
+			res.Video = true
+			stream.FPS = parseRate(s.AvgFrameRate)
+			if stream.FPS == 0 {
+				stream.FPS = parseRate(s.RFrameRate)
+			}
+		case "audio":
+			res.Audio = true
+			stream.SampleRate, _ = strconv.Atoi(s.SampleRate)
+		}
+		res.Streams = append(res.Streams, stream)
+	}
+	if !res.Video {
+		return &res, fmt.Errorf("no video stream in %s", res.Format)
+	}
+	return &res, nil
+}
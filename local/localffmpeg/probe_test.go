@@ -0,0 +1,99 @@
+package localffmpeg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate string
+		want float64
+	}{
+		{"25/1", 25},
+		{"30000/1001", 30000.0 / 1001},
+		{"25", 25},
+		{"0/0", 0},
+		{"25/0", 0},
+		{"", 0},
+		{"N/A", 0},
+		{"25/x", 0},
+	}
+	for _, test := range tests {
+		if res := parseRate(test.rate); res != test.want {
+			t.Errorf("parseRate(%q) = %v, want %v", test.rate, res, test.want)
+		}
+	}
+}
+
+// testProbeOutput is output of ffprobe -print_format json -show_streams -show_format for rtsp camera, cut to used fields
+const testProbeOutput = `{
+	"streams": [
+		{"index": 0, "codec_name": "h264", "codec_type": "video", "width": 1920, "height": 1080, "r_frame_rate": "25/1", "avg_frame_rate": "0/0"},
+		{"index": 1, "codec_name": "aac", "codec_type": "audio", "sample_rate": "16000", "channels": 1, "r_frame_rate": "0/0", "avg_frame_rate": "0/0"},
+		{"index": 2, "codec_name": "hevc", "codec_type": "video", "width": 640, "height": 360, "r_frame_rate": "30/1", "avg_frame_rate": "30000/1001"}
+	],
+	"format": {"format_name": "rtsp"}
+}`
+
+func TestParseProbe(t *testing.T) {
+	res, errParse := parseProbe([]byte(testProbeOutput))
+	if errParse != nil {
+		t.Fatal(errParse)
+	}
+	if res.Format != "rtsp" || !res.Video || !res.Audio || len(res.Streams) != 3 || res.Time.IsZero() {
+		t.Fatalf("parseProbe = %+v", res)
+	}
+	want := []ProbeStream{
+		// avg_frame_rate 0/0 у живого потока - берем r_frame_rate
+		{Index: 0, Type: "video", Codec: "h264", Width: 1920, Height: 1080, FPS: 25},
+		{Index: 1, Type: "audio", Codec: "aac", SampleRate: 16000, Channels: 1},
+		{Index: 2, Type: "video", Codec: "hevc", Width: 640, Height: 360, FPS: 30000.0 / 1001},
+	}
+	for i, w := range want {
+		if res.Streams[i] != w {
+			t.Errorf("stream %d = %+v, want %+v", i, res.Streams[i], w)
+		}
+	}
+
+	// без видео - ошибка, но найденное возвращается для ответа
+	res, errParse = parseProbe([]byte(`{"streams": [{"index": 0, "codec_name": "pcm_alaw", "codec_type": "audio", "sample_rate": "8000", "channels": 1}], "format": {"format_name": "rtsp"}}`))
+	if errParse == nil || res == nil || res.Video || !res.Audio || len(res.Streams) != 1 {
+		t.Errorf("parseProbe of audio only = %+v, %v", res, errParse)
+	}
+	if res, errParse := parseProbe([]byte(`{"streams": [], "format": {}}`)); errParse == nil || res == nil || res.Video {
+		t.Errorf("parseProbe without streams = %+v, %v", res, errParse)
+	}
+	if res, errParse := parseProbe([]byte("rtsp://cam: Connection refused")); errParse == nil || res != nil {
+		t.Errorf("parseProbe of text = %+v, %v", res, errParse)
+	}
+}
+
+// testProbeBin write shell script which is run instead of ffprobe
+func testProbeBin(t *testing.T, script string) string {
+	res := filepath.Join(t.TempDir(), "ffprobe")
+	if errWrite := ioutil.WriteFile(res, []byte("#!/bin/sh\n"+script+"\n"), 0755); errWrite != nil {
+		t.Fatal(errWrite)
+	}
+	return res
+}
+
+func TestRunProbe(t *testing.T) {
+	bin := testProbeBin(t, "cat <<'EOF'\n"+testProbeOutput+"\nEOF")
+	if res, errProbe := RunProbe(bin, "rtsp://cam", time.Second); errProbe != nil || len(res.Streams) != 3 {
+		t.Errorf("RunProbe = %+v, %v", res, errProbe)
+	}
+
+	bin = testProbeBin(t, "echo 'rtsp://cam: Connection refused' >&2; exit 1")
+	if _, errProbe := RunProbe(bin, "rtsp://cam", time.Second); errProbe == nil || errProbe.Error() != "ffprobe: rtsp://cam: Connection refused" {
+		t.Errorf("RunProbe of failed ffprobe = %v", errProbe)
+	}
+
+	bin = testProbeBin(t, "exec sleep 10")
+	begin := time.Now()
+	if _, errProbe := RunProbe(bin, "rtsp://cam", 100*time.Millisecond); errProbe == nil || time.Since(begin) > time.Second {
+		t.Errorf("RunProbe of hanging ffprobe = %v after %s", errProbe, time.Since(begin))
+	}
+}
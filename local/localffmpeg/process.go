@@ -0,0 +1,324 @@
+package localffmpeg
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ProcState describe state of controlled process
+type ProcState string
+
+// process states
+const (
+	StateQueued   ProcState = "queued"
+	StateStarting ProcState = "starting"
+	StateRunning  ProcState = "running"
+	StateStopping ProcState = "stopping"
+	StateExited   ProcState = "exited"
+	StateFailed   ProcState = "failed"
+)
+
+// IsFinal return true if process can't change state anymore
+func (s ProcState) IsFinal() bool {
+	return s == StateExited || s == StateFailed
+}
+
+// Process describe one controlled ffmpeg process with its restarts
+type Process struct {
+	Name     string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stop     chan struct{} // закрывается при запросе остановки
+	done     chan struct{} // закрывается когда процесс завершен окончательно
+	stopOnce *sync.Once
+	doneOnce *sync.Once
+	mut      *sync.RWMutex
+	state    ProcState
+	cmd      *exec.Cmd
+	pid      int
+	stopSig  syscall.Signal
+	killed   bool
+}
+
+func newProcess(name string) *Process {
+	ctx, cancel := context.WithCancel(context.Background())
+	res := Process{Name: name, ctx: ctx, cancel: cancel, stop: make(chan struct{}), done: make(chan struct{}), stopOnce: new(sync.Once), doneOnce: new(sync.Once), mut: new(sync.RWMutex), state: StateStarting, stopSig: syscall.SIGQUIT}
+	return &res
+}
+
+// Command build command bound with process context, cancel of context kill the process
+func (p *Process) Command(name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(p.ctx, name, args...)
+}
+
+// Stopping return channel which is closed when stop of process is requested
+func (p *Process) Stopping() <-chan struct{} {
+	return p.stop
+}
+
+// Done return channel which is closed when process is finished
+func (p *Process) Done() <-chan struct{} {
+	return p.done
+}
+
+// Queued mark process as waiting for limit or return it to starting
+func (p *Process) Queued(isQueued bool) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if isQueued && p.state == StateStarting {
+		p.state = StateQueued
+	} else if !isQueued && p.state == StateQueued {
+		p.state = StateStarting
+	}
+}
+
+// Started store running command and signal of its graceful stop
+func (p *Process) Started(cmd *exec.Cmd, stopSig syscall.Signal) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.cmd = cmd
+	p.stopSig = stopSig
+	if cmd.Process != nil {
+		p.pid = cmd.Process.Pid
+	}
+	if p.state == StateStarting {
+		p.state = StateRunning
+	}
+}
+
+// Exited forget command after its exit, process state becomes starting if it will be restarted
+func (p *Process) Exited() {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.cmd = nil
+	p.pid = 0
+	if p.state == StateRunning {
+		p.state = StateStarting
+	}
+}
+
+// State return current state of process
+func (p *Process) State() ProcState {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	return p.state
+}
+
+// Pid return pid of running command or 0
+func (p *Process) Pid() int {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	return p.pid
+}
+
+// IsStopping return true if stop of process is requested
+func (p *Process) IsStopping() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Killed return true if process was killed after stop timeout
+func (p *Process) Killed() bool {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	return p.killed
+}
+
+// Finish set final state of process and release waiters of Stop
+func (p *Process) Finish(state ProcState) {
+	p.mut.Lock()
+	if p.killed {
+		state = StateFailed
+	}
+	p.state = state
+	p.cmd = nil
+	p.pid = 0
+	p.mut.Unlock()
+	p.doneOnce.Do(func() {
+		p.cancel()
+		close(p.done)
+	})
+}
+
+func (p *Process) signal(sig syscall.Signal) error {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	if p.cmd == nil || p.cmd.Process == nil {
+		return nil
+	}
+	return p.cmd.Process.Signal(sig)
+}
+
+// Interrupt send signal of graceful stop to running command
+func (p *Process) Interrupt() error {
+	p.mut.RLock()
+	sig := p.stopSig
+	p.mut.RUnlock()
+	return p.signal(sig)
+}
+
+// Stop request stop of process: send stop signal of runner and wait timeout, then kill it. Return final state
+func (p *Process) Stop(timeout time.Duration) (ProcState, error) {
+	return p.StopContext(context.Background(), timeout)
+}
+
+// StopContext is Stop which doesn't wait longer than ctx: process is killed when ctx is done before timeout
+func (p *Process) StopContext(ctx context.Context, timeout time.Duration) (ProcState, error) {
+	p.stopOnce.Do(func() {
+		p.mut.Lock()
+		if !p.state.IsFinal() {
+			p.state = StateStopping
+		}
+		p.mut.Unlock()
+		close(p.stop)
+	})
+	errSig := p.Interrupt()
+
+	stopTimer := time.NewTimer(timeout)
+	defer stopTimer.Stop()
+	select {
+	case <-p.done:
+		return p.State(), errSig
+	case <-stopTimer.C:
+	case <-ctx.Done():
+	}
+
+	// ffmpeg не завершился штатно или вышел срок остановки всего сервера - убиваем
+	p.mut.Lock()
+	p.killed = true
+	p.mut.Unlock()
+	p.cancel()
+	killTimer := time.NewTimer(timeout)
+	defer killTimer.Stop()
+	select {
+	case <-p.done:
+		return p.State(), fmt.Errorf("process %s killed after %s", p.Name, timeout)
+	case <-killTimer.C:
+	case <-ctx.Done():
+		// после kill процесс завершается сразу, даем ему это сделать и в истекшем сроке
+		select {
+		case <-p.done:
+			return p.State(), fmt.Errorf("process %s killed by %s", p.Name, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return p.State(), fmt.Errorf("process %s not finished after kill", p.Name)
+}
+
+// Controller store processes by name
+type Controller struct {
+	procs  map[string]*Process
+	mut    *sync.RWMutex
+	closed bool // после StopAll новые процессы не запускаются
+}
+
+// NewController build empty Controller
+func NewController() *Controller {
+	res := Controller{procs: make(map[string]*Process), mut: new(sync.RWMutex)}
+	return &res
+}
+
+// Add register new process by name, return error if process with the name isn't finished
+func (c *Controller) Add(name string) (*Process, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.closed {
+		return nil, fmt.Errorf("process %s isn't started: server is shutting down", name)
+	}
+	if find, isFind := c.procs[name]; isFind && !find.State().IsFinal() {
+		return nil, fmt.Errorf("process %s is %s", name, find.State())
+	}
+	res := newProcess(name)
+	c.procs[name] = res
+	return res, nil
+}
+
+// Get return process by name or nil
+func (c *Controller) Get(name string) *Process {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	return c.procs[name]
+}
+
+// Del remove process from controller if it is still registered by the name
+func (c *Controller) Del(name string, proc *Process) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if find, isFind := c.procs[name]; isFind && find == proc {
+		delete(c.procs, name)
+	}
+}
+
+// Names return sorted names of registered processes
+func (c *Controller) Names() []string {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	res := make([]string, 0, len(c.procs))
+	for name := range c.procs {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Stop stop process by name and wait its finish, return false if process isn't found
+func (c *Controller) Stop(name string, timeout time.Duration) (ProcState, bool, error) {
+	proc := c.Get(name)
+	if proc == nil {
+		return "", false, nil
+	}
+	state, err := proc.Stop(timeout)
+	return state, true, err
+}
+
+// StopAll stop all processes in parallel and wait their finish not longer than ctx, return final states by name.
+// Processes which don't stop in timeout or till ctx is done are killed. New processes aren't added after it
+func (c *Controller) StopAll(ctx context.Context, timeout time.Duration) map[string]ProcState {
+	c.mut.Lock()
+	c.closed = true
+	c.mut.Unlock()
+	names := c.Names()
+	res := make(map[string]ProcState)
+	mut := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			proc := c.Get(name)
+			if proc == nil {
+				return
+			}
+			state, _ := proc.StopContext(ctx, timeout)
+			mut.Lock()
+			res[name] = state
+			mut.Unlock()
+		}(name)
+	}
+	wg.Wait()
+	return res
+}
+
+// waitGroupContext wait wg or ctx, return false if ctx is done before wg
+func waitGroupContext(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
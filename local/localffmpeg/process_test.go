@@ -0,0 +1,150 @@
+package localffmpeg
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testRun start shell script as supervisor of stream does, process is finished when script exits
+func testRun(t *testing.T, proc *Process, stopSig syscall.Signal, script string) {
+	t.Helper()
+	cmd := proc.Command("sh", "-c", script)
+	if errStart := cmd.Start(); errStart != nil {
+		t.Fatalf("start %s: %v", script, errStart)
+	}
+	proc.Started(cmd, stopSig)
+	go func() {
+		errWait := cmd.Wait()
+		proc.Exited()
+		if errWait != nil && !proc.IsStopping() {
+			proc.Finish(StateFailed)
+			return
+		}
+		proc.Finish(StateExited)
+	}()
+}
+
+func TestProcessStates(t *testing.T) {
+	ctrl := NewController()
+	proc, errAdd := ctrl.Add("/user/cam")
+	if errAdd != nil {
+		t.Fatal(errAdd)
+	}
+	if state := proc.State(); state != StateStarting {
+		t.Errorf("new process is %s", state)
+	}
+	proc.Queued(true)
+	if state := proc.State(); state != StateQueued {
+		t.Errorf("queued process is %s", state)
+	}
+	proc.Queued(false)
+	if state := proc.State(); state != StateStarting {
+		t.Errorf("process out of queue is %s", state)
+	}
+	testRun(t, proc, syscall.SIGTERM, "exec sleep 10")
+	if state := proc.State(); state != StateRunning || proc.Pid() == 0 {
+		t.Errorf("started process is %s, pid %d", state, proc.Pid())
+	}
+	if _, errAdd := ctrl.Add("/user/cam"); errAdd == nil {
+		t.Error("second process with the same name is added")
+	}
+
+	state, isFind, errStop := ctrl.Stop("/user/cam", time.Second)
+	if !isFind || errStop != nil || state != StateExited || proc.Killed() {
+		t.Errorf("Stop = %s, %v, %v, killed %v", state, isFind, errStop, proc.Killed())
+	}
+	if proc.Pid() != 0 {
+		t.Errorf("pid %d of finished process", proc.Pid())
+	}
+	select {
+	case <-proc.Done():
+	default:
+		t.Error("Done isn't closed after Stop")
+	}
+	// имя освобождается после завершения
+	if _, errAdd := ctrl.Add("/user/cam"); errAdd != nil {
+		t.Errorf("Add after finish: %v", errAdd)
+	}
+}
+
+func TestProcessExit(t *testing.T) {
+	ctrl := NewController()
+	proc, _ := ctrl.Add("/user/cam")
+	testRun(t, proc, syscall.SIGTERM, "exit 1")
+	select {
+	case <-proc.Done():
+	case <-time.After(time.Second):
+		t.Fatal("process isn't finished after exit of command")
+	}
+	if state := proc.State(); state != StateFailed {
+		t.Errorf("process after exit 1 is %s", state)
+	}
+}
+
+func TestProcessStopKill(t *testing.T) {
+	ctrl := NewController()
+	proc, _ := ctrl.Add("/user/cam")
+	// сигнал остановки раннера игнорируется, остается только kill по отмене контекста
+	testRun(t, proc, syscall.SIGTERM, "trap '' TERM; while :; do sleep 0.05; done")
+	time.Sleep(50 * time.Millisecond)
+	begin := time.Now()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if state := proc.State(); state != StateStopping {
+			t.Errorf("process is %s while it is stopped", state)
+		}
+	}()
+	state, errStop := proc.Stop(100 * time.Millisecond)
+	if errStop == nil || state != StateFailed || !proc.Killed() {
+		t.Errorf("Stop = %s, %v, killed %v", state, errStop, proc.Killed())
+	}
+	if wait := time.Since(begin); wait < 100*time.Millisecond {
+		t.Errorf("process is killed after %s before stop timeout", wait)
+	}
+}
+
+func TestControllerStopAll(t *testing.T) {
+	ctrl := NewController()
+	names := []string{"/user/cam0", "/user/cam1"}
+	for _, name := range names {
+		proc, errAdd := ctrl.Add(name)
+		if errAdd != nil {
+			t.Fatal(errAdd)
+		}
+		testRun(t, proc, syscall.SIGTERM, "exec sleep 10")
+	}
+	begin := time.Now()
+	res := ctrl.StopAll(context.Background(), time.Second)
+	// останавливаются параллельно, а не по очереди
+	if wait := time.Since(begin); wait > time.Second {
+		t.Errorf("StopAll takes %s", wait)
+	}
+	for _, name := range names {
+		if state := res[name]; state != StateExited {
+			t.Errorf("%s is %s after StopAll", name, state)
+		}
+	}
+	if _, errAdd := ctrl.Add("/user/cam2"); errAdd == nil {
+		t.Error("process is added after StopAll")
+	}
+}
+
+func TestControllerStopAllDeadline(t *testing.T) {
+	ctrl := NewController()
+	proc, _ := ctrl.Add("/user/cam")
+	testRun(t, proc, syscall.SIGTERM, "trap '' TERM; while :; do sleep 0.05; done")
+	time.Sleep(50 * time.Millisecond)
+	// срок остановки сервера короче таймаута остановки процесса: убиваем по сроку
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	res := ctrl.StopAll(ctx, 10*time.Second)
+	if wait := time.Since(begin); wait > time.Second {
+		t.Errorf("StopAll takes %s with deadline 100ms", wait)
+	}
+	if state := res["/user/cam"]; state != StateFailed || !proc.Killed() {
+		t.Errorf("process is %s, killed %v", state, proc.Killed())
+	}
+}
@@ -0,0 +1,156 @@
+package localffmpeg
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ProgressHistorySize - number of stored ffmpeg progress blocks, ffmpeg writes it every 0.5 second
+	ProgressHistorySize int = 240
+)
+
+// Progress describe one block of ffmpeg -progress output
+type Progress struct {
+	Time       time.Time `json:"time"`
+	Frame      int64     `json:"frame"`
+	FPS        float64   `json:"fps"`
+	Bitrate    float64   `json:"bitrate"` // kbit/s
+	TotalSize  int64     `json:"totalsize"`
+	OutTimeUs  int64     `json:"outtimeus"`
+	OutTime    string    `json:"outtime,omitempty"`
+	DupFrames  int64     `json:"dup"`
+	DropFrames int64     `json:"drop"`
+	Speed      float64   `json:"speed"`
+	State      string    `json:"progress,omitempty"`
+}
+
+// ProgressHistory store last ffmpeg progress blocks
+type ProgressHistory struct {
+	mut   *sync.RWMutex
+	items []Progress
+	head  int
+	size  int
+}
+
+// NewProgressHistory build ProgressHistory with capacity
+func NewProgressHistory(capacity int) *ProgressHistory {
+	res := ProgressHistory{mut: new(sync.RWMutex), items: make([]Progress, capacity)}
+	return &res
+}
+
+// Add store progress block, the oldest one is overwritten
+func (h *ProgressHistory) Add(p Progress) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.items[h.head] = p
+	h.head++
+	if h.head == len(h.items) {
+		h.head = 0
+	}
+	if h.size < len(h.items) {
+		h.size++
+	}
+}
+
+// Last return the newest progress block, false if history is empty
+func (h *ProgressHistory) Last() (Progress, bool) {
+	h.mut.RLock()
+	defer h.mut.RUnlock()
+	if h.size == 0 {
+		return Progress{}, false
+	}
+	i := h.head - 1
+	if i < 0 {
+		i = len(h.items) - 1
+	}
+	return h.items[i], true
+}
+
+// List return up to capacity the newest progress blocks from old to new
+func (h *ProgressHistory) List(capacity int) []Progress {
+	h.mut.RLock()
+	defer h.mut.RUnlock()
+	if capacity > h.size || capacity <= 0 {
+		capacity = h.size
+	}
+	res := make([]Progress, 0, capacity)
+	begin := h.head - capacity
+	if begin < 0 {
+		begin += len(h.items)
+	}
+	for i := 0; i < capacity; i++ {
+		res = append(res, h.items[(begin+i)%len(h.items)])
+	}
+	return res
+}
+
+// ProgressParser collect key=value lines of ffmpeg -progress output into Progress blocks
+type ProgressParser struct {
+	curr    Progress
+	history *ProgressHistory
+}
+
+// NewProgressParser build parser which store blocks into history
+func NewProgressParser(history *ProgressHistory) *ProgressParser {
+	res := ProgressParser{history: history}
+	return &res
+}
+
+func parseInt(value string) int64 {
+	res, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	return res
+}
+
+func parseFloat(value string) float64 {
+	res, _ := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	return res
+}
+
+// Line parse one line, return false if line isn't part of progress output
+func (p *ProgressParser) Line(line string) bool {
+	eq := strings.Index(line, "=")
+	if eq <= 0 {
+		return false
+	}
+	key := strings.TrimSpace(line[:eq])
+	value := strings.TrimSpace(line[eq+1:])
+	switch key {
+	case "frame":
+		p.curr.Frame = parseInt(value)
+	case "fps":
+		p.curr.FPS = parseFloat(value)
+	case "bitrate":
+		// 1234.5kbits/s или N/A
+		p.curr.Bitrate = parseFloat(strings.TrimSuffix(value, "kbits/s"))
+	case "total_size":
+		p.curr.TotalSize = parseInt(value)
+	case "out_time_us":
+		p.curr.OutTimeUs = parseInt(value)
+	case "out_time":
+		p.curr.OutTime = value
+	case "dup_frames":
+		p.curr.DupFrames = parseInt(value)
+	case "drop_frames":
+		p.curr.DropFrames = parseInt(value)
+	case "speed":
+		// 1.01x или N/A
+		p.curr.Speed = parseFloat(strings.TrimSuffix(value, "x"))
+	case "progress":
+		// последняя строка блока
+		p.curr.State = value
+		p.curr.Time = time.Now()
+		p.history.Add(p.curr)
+		p.curr = Progress{}
+	case "out_time_ms":
+		// в микросекундах, как и out_time_us, оставлен ffmpeg для совместимости
+	default:
+		// stream_0_0_q, stream_0_0_psnr_y - это тоже progress, но не храним, остальное - обычный вывод процесса
+		if !strings.HasPrefix(key, "stream_") || strings.ContainsAny(key, " \t") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package localffmpeg
+
+import (
+	"strings"
+	"testing"
+)
+
+// testProgressBlock is block of ffmpeg -progress pipe:1 of live stream
+const testProgressBlock = `frame=1250
+fps=25.00
+stream_0_0_q=-1.0
+bitrate=1536.2kbits/s
+total_size=9600000
+out_time_us=50000000
+out_time_ms=50000000
+out_time=00:00:50.000000
+dup_frames=1
+drop_frames=3
+speed=1.01x
+progress=continue`
+
+func testProgressLines(parser *ProgressParser, block string) int {
+	rejected := 0
+	for _, line := range strings.Split(block, "\n") {
+		if !parser.Line(line) {
+			rejected++
+		}
+	}
+	return rejected
+}
+
+func TestProgressParser(t *testing.T) {
+	history := NewProgressHistory(4)
+	parser := NewProgressParser(history)
+	if rejected := testProgressLines(parser, testProgressBlock); rejected != 0 {
+		t.Errorf("%d lines of progress are rejected", rejected)
+	}
+	last, ok := history.Last()
+	if !ok {
+		t.Fatal("progress block isn't stored")
+	}
+	if last.Frame != 1250 || last.FPS != 25 || last.Bitrate != 1536.2 || last.TotalSize != 9600000 || last.OutTimeUs != 50000000 ||
+		last.OutTime != "00:00:50.000000" || last.DupFrames != 1 || last.DropFrames != 3 || last.Speed != 1.01 || last.State != "continue" || last.Time.IsZero() {
+		t.Errorf("progress %+v", last)
+	}
+
+	// N/A в начале работы не ломает блок
+	testProgressLines(parser, "frame=0\nbitrate=N/A\nspeed=N/A\nprogress=continue")
+	if last, _ := history.Last(); last.Frame != 0 || last.Bitrate != 0 || last.Speed != 0 {
+		t.Errorf("progress with N/A %+v", last)
+	}
+
+	// прочий вывод процесса логируется, а не глотается как progress
+	for _, line := range []string{"", "=1", "some text", "[hls @ 0x5581] Opening 'x.m4s' for writing", "shaka: key=value", "option=value", "Stream mapping:"} {
+		if parser.Line(line) {
+			t.Errorf("line %q is taken as progress", line)
+		}
+	}
+}
+
+func TestProgressHistory(t *testing.T) {
+	history := NewProgressHistory(3)
+	if _, ok := history.Last(); ok {
+		t.Error("Last of empty history return block")
+	}
+	if res := history.List(10); len(res) != 0 {
+		t.Errorf("List of empty history %+v", res)
+	}
+	for i := int64(1); i <= 5; i++ {
+		history.Add(Progress{Frame: i})
+	}
+	// 1 и 2 перезаписаны, порядок от старых к новым
+	want := []int64{3, 4, 5}
+	res := history.List(0)
+	if len(res) != len(want) {
+		t.Fatalf("List = %+v", res)
+	}
+	for i, w := range want {
+		if res[i].Frame != w {
+			t.Errorf("List[%d].Frame = %d, want %d", i, res[i].Frame, w)
+		}
+	}
+	if res := history.List(2); len(res) != 2 || res[0].Frame != 4 || res[1].Frame != 5 {
+		t.Errorf("List(2) = %+v", res)
+	}
+	if last, _ := history.Last(); last.Frame != 5 {
+		t.Errorf("Last = %+v", last)
+	}
+	history.Add(Progress{Frame: 6})
+	if last, _ := history.Last(); last.Frame != 6 {
+		t.Errorf("Last after wraparound = %+v", last)
+	}
+}
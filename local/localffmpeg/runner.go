@@ -0,0 +1,123 @@
+package localffmpeg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"camctl/local/localconf"
+)
+
+// names of runners
+const (
+	RunnerFFMPEG    string = "ffmpeg"
+	RunnerPackager  string = "shaka-packager"
+	RunnerGStreamer string = "gstreamer"
+	RunnerExec      string = "exec"
+)
+
+// ErrNoRunner is returned when template or runner of started job isn't loaded anymore, such job isn't restarted
+var ErrNoRunner = errors.New("runner isn't found")
+
+// LineParser parse line of process output, return true if line is consumed
+type LineParser interface {
+	Line(line string) bool
+}
+
+// Runner describe program which is started for command template
+type Runner struct {
+	Name       string
+	Binary     string                                    // пусто - программа это первый аргумент шаблона
+	Args       []string                                  // аргументы перед аргументами шаблона
+	Progress   []string                                  // аргументы, включающие вывод статистики в stdout
+	StopSignal syscall.Signal                            // сигнал штатной остановки
+	OutParser  func(history *ProgressHistory) LineParser // разбор stdout, nil - stdout только в лог
+}
+
+// Runners store known runners by name
+var Runners = map[string]Runner{
+	RunnerFFMPEG: {
+		Name:       RunnerFFMPEG,
+		Binary:     "ffmpeg",
+		Progress:   []string{"-progress", "pipe:1"},
+		StopSignal: syscall.SIGQUIT,
+		OutParser: func(history *ProgressHistory) LineParser {
+			return NewProgressParser(history)
+		},
+	},
+	RunnerPackager: {
+		Name:       RunnerPackager,
+		Binary:     "packager",
+		StopSignal: syscall.SIGINT,
+	},
+	RunnerGStreamer: {
+		Name:       RunnerGStreamer,
+		Binary:     "gst-launch-1.0",
+		Args:       []string{"-e"}, // по SIGINT дописывает EOS и закрывает файлы
+		StopSignal: syscall.SIGINT,
+	},
+	RunnerExec: {
+		Name:       RunnerExec,
+		StopSignal: syscall.SIGTERM,
+	},
+}
+
+// GetRunner return runner by name with path of program from -bin, empty name is ffmpeg
+func GetRunner(conf *localconf.Config, name string) (*Runner, bool) {
+	if len(name) == 0 {
+		name = RunnerFFMPEG
+	}
+	find, ok := Runners[name]
+	if !ok {
+		return nil, false
+	}
+	find.Binary = conf.GetBin(name, find.Binary)
+	return &find, true
+}
+
+// JobRunner return runner and descriptor of template of started job
+func JobRunner(conf *localconf.Config, cmd string, runner string) (*Runner, *localconf.CmdDesc, error) {
+	desc, ok := conf.GetCmdDesc(cmd)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: template %s not found", ErrNoRunner, cmd)
+	}
+	res, ok := GetRunner(conf, runner)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: runner %s of %s not found", ErrNoRunner, runner, cmd)
+	}
+	return res, desc, nil
+}
+
+// Command build command of process for arguments of template.
+// progress add arguments of statistics, dir is relative to jobDir, env is added to environment of camctl
+func (r *Runner) Command(proc *Process, args []string, progress bool, jobDir string, dir string, env []string) (*exec.Cmd, error) {
+	binary := r.Binary
+	if len(binary) == 0 {
+		if len(args) == 0 {
+			return nil, errors.New("program isn't set in template")
+		}
+		binary = args[0]
+		args = args[1:]
+	}
+	full := make([]string, 0, len(r.Args)+len(r.Progress)+len(args))
+	full = append(full, r.Args...)
+	if progress {
+		full = append(full, r.Progress...)
+	}
+	full = append(full, args...)
+
+	cmd := proc.Command(binary, full...)
+	if len(dir) > 0 {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(jobDir, dir)
+		}
+		cmd.Dir = dir
+	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd, nil
+}
@@ -0,0 +1,106 @@
+package localffmpeg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	// StreamStateFile - file in workDir with started streams
+	StreamStateFile string = "stream.state.json"
+	// StorageStateFile - file in workDir with started storage jobs
+	StorageStateFile string = "storage.state.json"
+)
+
+// StateItem describe started process, it is enough for start process again
+type StateItem struct {
+	Name  string     `json:"name"`
+	Cmd   string     `json:"cmd,omitempty"`
+	Time  string     `json:"time,omitempty"`
+	Query url.Values `json:"query"`
+}
+
+// StateFile store started processes in json file, so they can be started after restart of camctl
+type StateFile struct {
+	path string
+	mut  *sync.Mutex
+}
+
+// NewStateFile build StateFile for file path
+func NewStateFile(path string) *StateFile {
+	res := StateFile{path: path, mut: new(sync.Mutex)}
+	return &res
+}
+
+func (s *StateFile) read() (map[string]StateItem, error) {
+	res := make(map[string]StateItem)
+	data, errRead := ioutil.ReadFile(s.path)
+	if errRead != nil {
+		if os.IsNotExist(errRead) {
+			return res, nil
+		}
+		return res, errRead
+	}
+	if len(data) == 0 {
+		return res, nil
+	}
+	errUnmarshal := json.Unmarshal(data, &res)
+	return res, errUnmarshal
+}
+
+func (s *StateFile) write(items map[string]StateItem) error {
+	data, errMarshal := json.MarshalIndent(items, "", "  ")
+	if errMarshal != nil {
+		return errMarshal
+	}
+	// пишем во временный файл и переименовываем, чтобы не потерять состояние при падении
+	tmp := s.path + ".tmp"
+	if errWrite := ioutil.WriteFile(tmp, data, 0600); errWrite != nil {
+		return errWrite
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Load return stored processes sorted by name
+func (s *StateFile) Load() ([]StateItem, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	items, err := s.read()
+	res := make([]StateItem, 0, len(items))
+	for _, item := range items {
+		res = append(res, item)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, err
+}
+
+// Set store process, existing process with same name is replaced
+func (s *StateFile) Set(item StateItem) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	items, errRead := s.read()
+	if errRead != nil {
+		return errRead
+	}
+	items[item.Name] = item
+	return s.write(items)
+}
+
+// Del remove process by name, return false if it isn't found
+func (s *StateFile) Del(name string) (bool, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	items, errRead := s.read()
+	if errRead != nil {
+		return false, errRead
+	}
+	if _, isFind := items[name]; !isFind {
+		return false, nil
+	}
+	delete(items, name)
+	return true, s.write(items)
+}
@@ -0,0 +1,84 @@
+package localffmpeg
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), StreamStateFile)
+	state := NewStateFile(path)
+	if items, errLoad := state.Load(); errLoad != nil || len(items) != 0 {
+		t.Fatalf("Load of missing file = %+v, %v", items, errLoad)
+	}
+
+	names := []string{"org/site/cam", "org/site", "org/site/cam2", "user/cam"}
+	for _, name := range names {
+		if errSet := state.Set(StateItem{Name: name, Cmd: "hls", Time: "1.5", Query: url.Values{"url": {"rtsp://" + name}}}); errSet != nil {
+			t.Fatal(errSet)
+		}
+	}
+	// замена по тому же имени
+	if errSet := state.Set(StateItem{Name: "user/cam", Cmd: "dash", Query: url.Values{"url": {"rtsp://other"}}}); errSet != nil {
+		t.Fatal(errSet)
+	}
+	if _, errStat := os.Stat(path + ".tmp"); !os.IsNotExist(errStat) {
+		t.Errorf("temporary file is left: %v", errStat)
+	}
+
+	// удаляется только точное имя, вложенные и соседние потоки остаются
+	if isFind, errDel := state.Del("org/site"); !isFind || errDel != nil {
+		t.Errorf("Del(org/site) = %v, %v", isFind, errDel)
+	}
+	if isFind, errDel := state.Del("org/site/ca"); isFind || errDel != nil {
+		t.Errorf("Del of missing name = %v, %v", isFind, errDel)
+	}
+
+	// новый StateFile читает то же, что после перезапуска camctl
+	items, errLoad := NewStateFile(path).Load()
+	if errLoad != nil {
+		t.Fatal(errLoad)
+	}
+	want := []string{"org/site/cam", "org/site/cam2", "user/cam"}
+	if len(items) != len(want) {
+		t.Fatalf("Load = %+v", items)
+	}
+	for i, name := range want {
+		if items[i].Name != name {
+			t.Errorf("item %d is %s, want %s", i, items[i].Name, name)
+		}
+	}
+	if last := items[2]; last.Cmd != "dash" || last.Query.Get("url") != "rtsp://other" {
+		t.Errorf("replaced item %+v", last)
+	}
+	if first := items[0]; first.Cmd != "hls" || first.Time != "1.5" || first.Query.Get("url") != "rtsp://org/site/cam" {
+		t.Errorf("item %+v", first)
+	}
+}
+
+func TestStateFileBroken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), StorageStateFile)
+	if errWrite := ioutil.WriteFile(path, []byte("{broken"), 0600); errWrite != nil {
+		t.Fatal(errWrite)
+	}
+	state := NewStateFile(path)
+	if _, errLoad := state.Load(); errLoad == nil {
+		t.Error("Load of broken file without error")
+	}
+	// битый файл не затирается новым состоянием
+	if errSet := state.Set(StateItem{Name: "user/cam"}); errSet == nil {
+		t.Error("Set into broken file without error")
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "{broken" {
+		t.Errorf("broken file is overwritten: %s", data)
+	}
+
+	// пустой файл - пустое состояние
+	ioutil.WriteFile(path, nil, 0600)
+	if items, errLoad := state.Load(); errLoad != nil || len(items) != 0 {
+		t.Errorf("Load of empty file = %+v, %v", items, errLoad)
+	}
+}
@@ -3,15 +3,15 @@ package localffmpeg
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -20,26 +20,27 @@ import (
 
 	"camctl/local/localconf"
 	"camctl/local/locallog"
+	"camctl/local/localnotif"
 	"camctl/local/localproxy"
 )
 
-const (
-	// StorageFfmpegCmd - command for ffmpeg execute
-	// StorageFfmpegCmd       string = "ffmpeggpu.cmd"
-	StorageFfmpegCmd string = "repackffmpegfs.cmd"
-)
-
 // StorageHandler describe http handler object
 type StorageHandler struct {
 	log         *zap.Logger
 	conf        *localconf.Config
 	procArgs    map[string]*StorageFFMPEG
 	procArgsMut *sync.RWMutex
+	state       *StateFile
+	ctrl        *Controller
+	limiter     *Limiter
+	notifyWg    *sync.WaitGroup
+	cameras     *Cameras
 }
 
 // NewStorageHandler create http handler
-func NewStorageHandler(logger *zap.Logger, config *localconf.Config) *StorageHandler {
-	res := StorageHandler{log: logger, conf: config, procArgs: make(map[string]*StorageFFMPEG), procArgsMut: new(sync.RWMutex)}
+func NewStorageHandler(logger *zap.Logger, config *localconf.Config, limiter *Limiter, cameras *Cameras) *StorageHandler {
+	res := StorageHandler{log: logger, conf: config, procArgs: make(map[string]*StorageFFMPEG), procArgsMut: new(sync.RWMutex), state: NewStateFile(filepath.Join(*config.WorkDir, StorageStateFile)), ctrl: NewController(), limiter: limiter, notifyWg: new(sync.WaitGroup), cameras: cameras}
+	cameras.watch("storage", res.state)
 	return &res
 }
 
@@ -109,7 +110,16 @@ func (h *StorageHandler) delEmptyDir(path string) error {
 /*
 -master_pl_name master.m3u8 опция игнорируется ffmpeg можно написать master_pl_name out.m3u8 но генерироваться будет master.m3u8
 */
-func (h *StorageHandler) runFFMPEG(txtPath string, argsStr string, procArgs *StorageFFMPEG) {
+func (h *StorageHandler) runFFMPEG(proc *Process, ticket *Ticket, txtPath string, argsStr string, procArgs *StorageFFMPEG) {
+	state := StateFailed
+	defer func() {
+		// webhooks запускаются до Finish, так Shutdown после StopAll их дождется
+		h.notifyStop(procArgs, state != StateExited)
+		ticket.Release()
+		h.ctrl.Del("/"+procArgs.Name, proc)
+		proc.Finish(state)
+	}()
+
 	cfg := zap.NewProductionConfig()
 	cfg.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.StampNano)
 	cfg.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
@@ -121,15 +131,36 @@ func (h *StorageHandler) runFFMPEG(txtPath string, argsStr string, procArgs *Sto
 	procArgs.Log.Log.Sugar().Warnf("start runFFMPEG for %s", txtPath)
 
 	for _, n := range procArgs.Notifications {
-		go n.Notify(procArgs.Log.Log)
+		h.notify(n, procArgs.Log.Log)
 	}
 
 	h.setProcArgs("/"+procArgs.Name, procArgs)
+	defer h.delProcArgs("/" + procArgs.Name)
+
+	// ждем своей очереди, если лимит процессов занят
+	if !ticket.Wait(proc.Stopping()) {
+		h.log.Sugar().Warnf("stop queued runFFMPEG for %s", txtPath)
+		procArgs.Log.Log.Sugar().Warnf("stop queued runFFMPEG for %s", txtPath)
+		state = StateExited
+		return
+	}
+	proc.Queued(false)
 
 	args := SplitArgs(argsStr)
-	h.log.Sugar().Warnf(fmt.Sprintf("%s %v", "ffmpeg", args))
-	procArgs.Log.Log.Sugar().Warnf(fmt.Sprintf("%s %v", "ffmpeg", args))
-	cmd := exec.Command("ffmpeg", args...)
+	h.log.Sugar().Warnf(fmt.Sprintf("%s %v", procArgs.Runner, args))
+	procArgs.Log.Log.Sugar().Warnf(fmt.Sprintf("%s %v", procArgs.Runner, args))
+	runner, desc, errRunner := JobRunner(h.conf, procArgs.Cmd, procArgs.Runner)
+	if errRunner != nil {
+		h.log.Sugar().Errorf("runner for %s return error: %s", txtPath, errRunner.Error())
+		procArgs.Log.Log.Sugar().Errorf("runner for %s return error: %s", txtPath, errRunner.Error())
+		return
+	}
+	cmd, errCmd := runner.Command(proc, args, false, procArgs.Dir, desc.Dir, desc.Env)
+	if errCmd != nil {
+		h.log.Sugar().Errorf("build command for %s return error: %s", txtPath, errCmd.Error())
+		procArgs.Log.Log.Sugar().Errorf("build command for %s return error: %s", txtPath, errCmd.Error())
+		return
+	}
 	logFile, errFile := os.Create(txtPath + ".log")
 	if errFile != nil {
 		h.log.Sugar().Errorf("os.Create() for %s.log return error: %s", txtPath, errFile.Error())
@@ -137,6 +168,7 @@ func (h *StorageHandler) runFFMPEG(txtPath string, argsStr string, procArgs *Sto
 		return
 	}
 	defer os.Remove(txtPath + ".log")
+	defer logFile.Close()
 	defer h.delEmptyDir(filepath.Dir(txtPath))
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
@@ -153,180 +185,315 @@ func (h *StorageHandler) runFFMPEG(txtPath string, argsStr string, procArgs *Sto
 	}
 	defer stdout.Close()
 
-	go func() {
-		procArgs.Log.Log.Sugar().Warnf("start cmd.Run() for %s", txtPath)
-		errRun := cmd.Run()
-		if errRun != nil {
-			procArgs.Log.Log.Sugar().Errorf("stop cmd.Run() for %s return error: %s", txtPath, errRun.Error())
-			time.Sleep(time.Millisecond * 200)
-			os.Remove(txtPath)
-			return
+	mutex := sync.Mutex{}
+	atomicWrite := func(text ...string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		var sb strings.Builder
+		for _, str := range text {
+			sb.WriteString(str)
 		}
-		procArgs.Log.Log.Sugar().Warnf("stop cmd.Run() for %s", txtPath)
-		os.Remove(txtPath)
-	}()
-
-	{
-		mutex := sync.Mutex{}
-		atomicWrite := func(text ...string) {
-			mutex.Lock()
-			defer mutex.Unlock()
-			var sb strings.Builder
-			for _, str := range text {
-				sb.WriteString(str)
-			}
-			logFile.WriteString(sb.String())
-			logFile.WriteString("\n")
-			procArgs.Log.Log.Sugar().Info(sb.String())
-			sb.Reset()
+		logFile.WriteString(sb.String())
+		logFile.WriteString("\n")
+		procArgs.Log.Log.Sugar().Info(sb.String())
+		sb.Reset()
+	}
+	atomicWriteSync := func(text ...string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		var sb strings.Builder
+		for _, str := range text {
+			sb.WriteString(str)
 		}
-		atomicWriteSync := func(text ...string) {
-			mutex.Lock()
-			defer mutex.Unlock()
-			var sb strings.Builder
-			for _, str := range text {
-				sb.WriteString(str)
-			}
-			logFile.WriteString(sb.String())
-			logFile.WriteString("\n")
-			logFile.Sync()
-			procArgs.Log.Log.Sugar().Info(sb.String())
-			sb.Reset()
+		logFile.WriteString(sb.String())
+		logFile.WriteString("\n")
+		logFile.Sync()
+		procArgs.Log.Log.Sugar().Info(sb.String())
+		sb.Reset()
+	}
+	atomicWriteSync(runner.Name, " ", argsStr)
+
+	procArgs.Log.Log.Sugar().Warnf("start cmd.Start() for %s", txtPath)
+	if errStart := cmd.Start(); errStart != nil {
+		procArgs.Log.Log.Sugar().Errorf("cmd.Start() for %s return error: %s", txtPath, errStart.Error())
+		return
+	}
+	proc.Started(cmd, runner.StopSignal)
+	select {
+	case <-proc.Stopping():
+		// остановка запрошена до регистрации команды - сигнал мог не дойти
+		proc.Interrupt()
+	default:
+	}
+
+	readers := sync.WaitGroup{}
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		procArgs.Log.Log.Sugar().Warnf("start read err channel for %s", txtPath)
+		scannerErr := bufio.NewScanner(stderr)
+		for scannerErr.Scan() {
+			atomicWriteSync("FFMPEG error stream: ", scannerErr.Text()) // Println will add back the final '\n'
 		}
-		atomicWriteSync("ffmpeg ", argsStr)
-		go func() {
-			procArgs.Log.Log.Sugar().Warnf("start read err channel for %s", txtPath)
-			scannerErr := bufio.NewScanner(stderr)
-			for scannerErr.Scan() {
-				atomicWriteSync("FFMPEG error stream: ", scannerErr.Text()) // Println will add back the final '\n'
-			}
-			procArgs.Log.Log.Sugar().Warnf("stop read err channel for %s", txtPath)
-			defer h.delEmptyDir(filepath.Dir(txtPath))
-		}()
-		go func() {
-			procArgs.Log.Log.Sugar().Warnf("start read out channel for %s", txtPath)
-			scannerOut := bufio.NewScanner(stdout)
-			for scannerOut.Scan() {
-				atomicWrite("FFMPEG out stream: ", scannerOut.Text()) // Println will add back the final '\n'
-			}
-			procArgs.Log.Log.Sugar().Warnf("stop read out channel for %s", txtPath)
-			defer h.delEmptyDir(filepath.Dir(txtPath))
-		}()
-	}
-
-	for {
-		time.Sleep(time.Millisecond * 200)
-		check, errOpen := os.Open(txtPath)
-		check.Close()
-		if errOpen != nil {
-			break
+		procArgs.Log.Log.Sugar().Warnf("stop read err channel for %s", txtPath)
+	}()
+	go func() {
+		defer readers.Done()
+		procArgs.Log.Log.Sugar().Warnf("start read out channel for %s", txtPath)
+		scannerOut := bufio.NewScanner(stdout)
+		for scannerOut.Scan() {
+			atomicWrite("FFMPEG out stream: ", scannerOut.Text()) // Println will add back the final '\n'
 		}
-	}
+		procArgs.Log.Log.Sugar().Warnf("stop read out channel for %s", txtPath)
+	}()
 
-	errSig := cmd.Process.Signal(syscall.SIGQUIT)
-	if errSig != nil {
-		h.log.Sugar().Warnf("Process.Signal %s", errSig.Error())
+	// Wait закрывает пайпы, поэтому сначала дочитываем их
+	readers.Wait()
+	errRun := cmd.Wait()
+	proc.Exited()
+	if errRun != nil {
+		procArgs.Log.Log.Sugar().Errorf("stop cmd.Wait() for %s return error: %s", txtPath, errRun.Error())
+	} else {
+		procArgs.Log.Log.Sugar().Warnf("stop cmd.Wait() for %s", txtPath)
+	}
+	if errRun == nil || proc.IsStopping() {
+		state = StateExited
 	}
 
-	h.delProcArgs("/" + procArgs.Name)
 	h.log.Sugar().Warnf("stop runFFMPEG for %s", txtPath)
 	procArgs.Log.Log.Sugar().Warnf("stop runFFMPEG for %s", txtPath)
 }
 
 func (h *StorageHandler) start(c *gin.Context) {
-
-	url := c.Request.URL.Query().Get("url")
-	if len(url) == 0 {
-		localproxy.Error(c, "url isn't set in query", http.StatusBadRequest)
+	query := c.Request.URL.Query()
+	name, errName := localconf.StreamName(c.Request.URL.Path, "/storage/start/")
+	// /storage/start/?camera=cam1 берет имя из записи камеры
+	if errName != nil && (len(name) > 0 || len(query.Get("camera")) == 0) {
+		localproxy.Error(c, errName.Error(), http.StatusBadRequest)
 		return
 	}
+	code, mess := h.startFFMPEG(name, query)
+	localproxy.Error(c, mess, code)
+}
 
-	path := c.Request.URL.Path
-	nameBegin := strings.LastIndex(path, "/start/")
-	name := path[nameBegin+7:]
-	if len(name) == 0 {
-		localproxy.Error(c, "name isn't set in path", http.StatusBadRequest)
-		return
+// startFFMPEG create storage job by name and query parameters, return http code and message for response
+func (h *StorageHandler) startFFMPEG(name string, request url.Values) (int, string) {
+	name, query, errCamera := h.cameras.Inherit(name, request, true)
+	if errCamera != nil {
+		return http.StatusNotFound, errCamera.Error()
+	}
+	urlIn := query.Get("url")
+	if len(urlIn) == 0 {
+		return http.StatusBadRequest, "url isn't set in query"
+	}
+	// команда делится на аргументы по пробелам и кавычкам после подстановки url
+	if errArg := localconf.CheckArg(urlIn); errArg != nil {
+		return http.StatusBadRequest, "url " + errArg.Error()
+	}
+
+	if errName := localconf.CheckName(name); errName != nil {
+		return http.StatusBadRequest, errName.Error()
 	}
 
 	dirEnd := strings.LastIndex(name, "/")
 	if dirEnd == -1 {
-		localproxy.Error(c, "must bee '/start/path1/path2'", http.StatusBadRequest)
-		return
+		return http.StatusBadRequest, "must bee '/start/path1/path2[/...]'"
 	}
 	dir := name[0:dirEnd]
 
 	// создаем каталог
 	storeDir, pathError := filepath.Abs(filepath.Join(*h.conf.StoreDir, dir))
 	if pathError != nil {
-		localproxy.Error(c, "Unable build path to file ", http.StatusInternalServerError)
-		return
+		return http.StatusInternalServerError, "Unable build path to file "
 	}
 	dirError := os.MkdirAll(storeDir, os.ModePerm)
 	if dirError != nil {
-		localproxy.Error(c, "error create dir", http.StatusBadRequest)
-		return
+		return http.StatusBadRequest, "error create dir"
 	}
 
-	// создаем файл sdp
+	// путь для лога ffmpeg
 	txtPath, pathError := filepath.Abs(filepath.Join(*h.conf.StoreDir, name+".txt"))
 	if pathError != nil {
-		localproxy.Error(c, "Unable build path to file ", http.StatusInternalServerError)
-		return
+		return http.StatusInternalServerError, "Unable build path to file "
 	}
 
-	file, errCreate := os.Create(txtPath)
-	if errCreate != nil {
-		localproxy.Error(c, "Unable to create file "+txtPath, http.StatusInternalServerError)
-		return
-	}
-	defer file.Close()
-
 	// ищем шаблон для команды и аргументы
-	tmplName := StorageFfmpegCmd
-	procArgs := BuildStorageFFMPEG(name, storeDir, url, storeDir+name[dirEnd:], *h.conf.ChankDur, *h.conf.Chanks, c.Request.URL.Query()["notify"], c.Request.URL.Query()["onstart"], c.Request.URL.Query()["onstop"], c.Request.URL.Query()["onerror"])
+	tmplName := query.Get("cmd")
+	if len(tmplName) == 0 {
+		tmplName = *h.conf.StorageCmd
+	}
+	procArgs := BuildStorageFFMPEG(name, storeDir, urlIn, storeDir+name[dirEnd:], *h.conf.ChankDur, *h.conf.Chanks, query["notify"], query["onstart"], query["onstop"], query["onerror"])
 	tmpl, ok := h.conf.GetTmpl(tmplName)
 	if !ok {
-		localproxy.Error(c, tmplName+" not found", http.StatusInternalServerError)
 		os.Remove(storeDir)
-		return
+		return http.StatusBadRequest, tmplName + " not found"
+	}
+	procArgs.Cmd = tmplName
+	// пользовательские параметры шаблона проверяем до запуска ffmpeg
+	desc, _ := h.conf.GetCmdDesc(tmplName)
+	params, errParams := desc.BuildParams(query["param"])
+	if errParams != nil {
+		os.Remove(storeDir)
+		return http.StatusBadRequest, errParams.Error()
+	}
+	procArgs.Params = params
+	runner, ok := GetRunner(h.conf, desc.Runner)
+	if !ok {
+		os.Remove(storeDir)
+		return http.StatusBadRequest, "runner " + desc.Runner + " not found"
 	}
+	procArgs.Runner = runner.Name
 	// строим команду запуска
 	buf := bytes.NewBufferString("")
 	errTmpl := tmpl.Execute(buf, *procArgs)
 	if errTmpl != nil {
 		h.log.Error("build command", zap.Error(errTmpl))
-		localproxy.Error(c, tmplName+" not build", http.StatusInternalServerError)
 		os.Remove(storeDir)
-		return
+		return http.StatusInternalServerError, tmplName + " not build"
+	}
+
+	proc, errAdd := h.ctrl.Add("/" + name)
+	if errAdd != nil {
+		return http.StatusConflict, errAdd.Error()
+	}
+
+	// место в лимите процессов, сверх лимита - отказ или очередь
+	ticket, queue, errLimit := h.limiter.Acquire(ClassStorage, "/"+name, desc.Weight, StoragePriority+desc.Priority)
+	if errLimit != nil {
+		h.ctrl.Del("/"+name, proc)
+		proc.Finish(StateFailed)
+		return limitStatus(errLimit), errLimit.Error()
+	}
+	if queue > 0 {
+		proc.Queued(true)
 	}
 
-	// сначала ответ
-	localproxy.Error(c, "created", http.StatusCreated)
+	// запоминаем запись, чтобы поднять ее после перезапуска camctl
+	errState := h.state.Set(StateItem{Name: name, Cmd: tmplName, Time: procArgs.TimeStr, Query: request})
+	if errState != nil {
+		h.log.Error("save state", zap.String("name", name), zap.Error(errState))
+	}
 
-	go h.runFFMPEG(txtPath, buf.String(), procArgs)
+	go h.runFFMPEG(proc, ticket, txtPath, buf.String(), procArgs)
+	if queue > 0 {
+		return http.StatusAccepted, fmt.Sprintf("queued %d", queue)
+	}
+	return http.StatusCreated, "created"
+}
+
+// Restore start storage jobs stored in state file, return number of started jobs
+func (h *StorageHandler) Restore() int {
+	items, errLoad := h.state.Load()
+	if errLoad != nil {
+		h.log.Error("load state", zap.Error(errLoad))
+	}
+	count := 0
+	for _, item := range items {
+		if item.Query == nil {
+			item.Query = make(url.Values)
+		}
+		// шаблон по умолчанию мог поменяться - поднимаем с тем, с которым запускали, шаблон камеры берем из ее записи
+		if len(item.Query.Get("cmd")) == 0 && len(item.Cmd) > 0 && len(item.Query.Get("camera")) == 0 {
+			item.Query.Set("cmd", item.Cmd)
+		}
+		code, mess := h.startFFMPEG(item.Name, item.Query)
+		if code != http.StatusCreated && code != http.StatusAccepted {
+			h.log.Sugar().Errorf("restore storage %s return %d: %s", item.Name, code, mess)
+			continue
+		}
+		h.log.Sugar().Warnf("restore storage %s", item.Name)
+		count++
+	}
+	return count
+}
+
+// Boot start storage jobs of cameras marked to record at boot, jobs restored from state file are skipped.
+// Return number of started jobs
+func (h *StorageHandler) Boot() int {
+	count := 0
+	for _, camera := range h.cameras.List("") {
+		if !camera.Record {
+			continue
+		}
+		code, mess := h.startFFMPEG(camera.Name, url.Values{"camera": []string{camera.ID}})
+		if code == http.StatusConflict {
+			continue
+		}
+		if code != http.StatusCreated && code != http.StatusAccepted {
+			h.log.Sugar().Errorf("boot camera %s return %d: %s", camera.ID, code, mess)
+			continue
+		}
+		h.log.Sugar().Warnf("boot camera %s storage %s", camera.ID, camera.Name)
+		count++
+	}
+	return count
 }
 
 func (h *StorageHandler) stop(c *gin.Context) {
-	path := c.Request.URL.Path
-	nameBegin := strings.LastIndex(path, "/stop/")
-	name := path[nameBegin+6:]
-	if len(name) == 0 {
-		localproxy.Error(c, "name isn't set in path", http.StatusBadRequest)
+	name, errName := localconf.StreamName(c.Request.URL.Path, "/storage/stop/")
+	if errName != nil {
+		localproxy.Error(c, errName.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// создаем файл sdp
-	sdpPath, pathError := filepath.Abs(filepath.Join(*h.conf.StoreDir, name+".txt"))
-	if pathError != nil {
-		localproxy.Error(c, "Unable build path to file ", http.StatusInternalServerError)
+	// запись остановлена штатно - после перезапуска camctl ее поднимать не нужно
+	if _, errState := h.state.Del(name); errState != nil {
+		h.log.Error("delete state", zap.String("name", name), zap.Error(errState))
+	}
+
+	// останавливаем ffmpeg и ждем его завершения
+	state, isFind, errStop := h.ctrl.Stop("/"+name, time.Duration(*h.conf.StopTimeout)*time.Second)
+	if !isFind {
+		localproxy.Error(c, "not found", http.StatusNotFound)
 		return
 	}
+	if errStop != nil {
+		h.log.Sugar().Errorf("stop %s: %s", name, errStop.Error())
+		localproxy.Error(c, string(state)+": "+errStop.Error(), http.StatusInternalServerError)
+		return
+	}
+	localproxy.Error(c, string(state), http.StatusOK)
+}
+
+// notify send notification in background, Shutdown waits its finish
+func (h *StorageHandler) notify(n *localnotif.Notification, log *zap.Logger) {
+	h.notifyWg.Add(1)
+	go func() {
+		defer h.notifyWg.Done()
+		n.Notify(log)
+	}()
+}
 
-	// удаляем файл
-	os.Remove(sdpPath)
+// webhook call webhook in background, Shutdown waits its finish
+func (h *StorageHandler) webhook(webhook *localnotif.Webhook) {
+	h.notifyWg.Add(1)
+	go func() {
+		defer h.notifyWg.Done()
+		webhook.Notify(h.log)
+	}()
+}
 
-	localproxy.Error(c, "deleted", http.StatusAccepted)
+// notifyStop send onstop webhooks of storage job, or onerror webhooks if job was not stopped correctly
+func (h *StorageHandler) notifyStop(procArgs *StorageFFMPEG, isFailed bool) {
+	webhooks := procArgs.OnStop
+	if isFailed {
+		webhooks = procArgs.OnError
+	}
+	for _, webhook := range webhooks {
+		h.webhook(webhook)
+	}
+}
+
+// Shutdown stop all storage jobs without removing them from state file and wait webhooks and notifications
+func (h *StorageHandler) Shutdown(ctx context.Context) int {
+	states := h.ctrl.StopAll(ctx, time.Duration(*h.conf.StopTimeout)*time.Second)
+	for name, state := range states {
+		h.log.Sugar().Warnf("shutdown storage %s: %s", name, state)
+	}
+	if !waitGroupContext(ctx, h.notifyWg) {
+		h.log.Sugar().Errorf("shutdown storages: %s", ctx.Err())
+	}
+	return len(states)
 }
 
 func (h *StorageHandler) ServeHTTP(c *gin.Context) {
@@ -336,9 +503,12 @@ func (h *StorageHandler) ServeHTTP(c *gin.Context) {
 		localproxy.Error(c, "forbidden", http.StatusForbidden)
 		return
 	}
-	if strings.Contains(c.Request.URL.Path, "/start") {
+	// в списке есть url камер вместе с паролями, поэтому он только для доверенных ip
+	if strings.HasPrefix(c.Request.URL.Path, "/storage/list") {
+		h.list(c)
+	} else if strings.HasPrefix(c.Request.URL.Path, "/storage/start/") {
 		h.start(c)
-	} else if strings.Contains(c.Request.URL.Path, "/stop") {
+	} else if strings.HasPrefix(c.Request.URL.Path, "/storage/stop/") {
 		h.stop(c)
 	} else {
 		localproxy.Error(c, "bad path", http.StatusBadRequest)
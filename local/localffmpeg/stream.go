@@ -3,12 +3,16 @@ package localffmpeg
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -24,11 +28,8 @@ import (
 	"camctl/local/localproxy"
 )
 
-const (
-	// StreamFfmpegCmd - command for ffmpeg execute
-	// StreamFfmpegCmd       string = "streamffmpeggpu.cmd"
-	StreamFfmpegCmd string = "streamffmpeg.cmd"
-)
+// watchdogInterval is period of check of segment arrivals
+var watchdogInterval = time.Second
 
 // StreamHandler describe http handler object
 type StreamHandler struct {
@@ -37,11 +38,17 @@ type StreamHandler struct {
 	items       *localproxy.Items
 	procArgs    map[string]*StreamFFMPEG
 	procArgsMut *sync.RWMutex
+	state       *StateFile
+	ctrl        *Controller
+	limiter     *Limiter
+	notifyWg    *sync.WaitGroup
+	cameras     *Cameras
 }
 
 // NewStreamHandler create http handler
-func NewStreamHandler(logger *zap.Logger, config *localconf.Config, items *localproxy.Items) *StreamHandler {
-	res := StreamHandler{log: logger, conf: config, items: items, procArgs: make(map[string]*StreamFFMPEG), procArgsMut: new(sync.RWMutex)}
+func NewStreamHandler(logger *zap.Logger, config *localconf.Config, items *localproxy.Items, limiter *Limiter, cameras *Cameras) *StreamHandler {
+	res := StreamHandler{log: logger, conf: config, items: items, procArgs: make(map[string]*StreamFFMPEG), procArgsMut: new(sync.RWMutex), state: NewStateFile(filepath.Join(*config.WorkDir, StreamStateFile)), ctrl: NewController(), limiter: limiter, notifyWg: new(sync.WaitGroup), cameras: cameras}
+	cameras.watch("stream", res.state)
 	return &res
 }
 
@@ -108,10 +115,189 @@ func (h *StreamHandler) delEmptyDir(path string) error {
 	return os.Remove(path)
 }
 
+// execFFMPEG run ffmpeg once and wait its exit. Return true if stream was stopped and error of process
+func (h *StreamHandler) execFFMPEG(proc *Process, key string, sdpPath string, argsStr string, args []string, logFile *os.File, procArgs *StreamFFMPEG) (bool, error) {
+	runner, desc, errRunner := JobRunner(h.conf, procArgs.Cmd, procArgs.Runner)
+	if errRunner != nil {
+		h.log.Sugar().Errorf("runner for %s return error: %s", sdpPath, errRunner.Error())
+		procArgs.Log.Log.Sugar().Errorf("runner for %s return error: %s", sdpPath, errRunner.Error())
+		return false, errRunner
+	}
+	// статистика ffmpeg идет в stdout в виде key=value
+	cmd, errCmd := runner.Command(proc, args, true, procArgs.Dir, desc.Dir, desc.Env)
+	if errCmd != nil {
+		h.log.Sugar().Errorf("build command for %s return error: %s", sdpPath, errCmd.Error())
+		procArgs.Log.Log.Sugar().Errorf("build command for %s return error: %s", sdpPath, errCmd.Error())
+		return false, errCmd
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		h.log.Sugar().Errorf("cmd.StderrPipe() for %s return error: %s", sdpPath, err.Error())
+		procArgs.Log.Log.Sugar().Errorf("cmd.StderrPipe() for %s return error: %s", sdpPath, err.Error())
+		return false, err
+	}
+	defer stderr.Close()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		h.log.Sugar().Errorf("cmd.StderrPipe() for %s return error: %s", sdpPath, err.Error())
+		procArgs.Log.Log.Sugar().Errorf("cmd.StderrPipe() for %s return error: %s", sdpPath, err.Error())
+		return false, err
+	}
+	defer stdout.Close()
+
+	mutex := sync.Mutex{}
+	atomicWrite := func(text ...string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		var sb strings.Builder
+		for _, str := range text {
+			sb.WriteString(str)
+		}
+		logFile.WriteString(sb.String())
+		logFile.WriteString("\n")
+		procArgs.Log.Log.Sugar().Info(sb.String())
+		sb.Reset()
+	}
+	atomicWriteSync := func(text ...string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		var sb strings.Builder
+		for _, str := range text {
+			sb.WriteString(str)
+		}
+		logFile.WriteString(sb.String())
+		logFile.WriteString("\n")
+		logFile.Sync()
+		procArgs.Log.Log.Sugar().Info(sb.String())
+		sb.Reset()
+	}
+	atomicWriteSync(runner.Name, " ", argsStr)
+
+	procArgs.Log.Log.Sugar().Warnf("start cmd.Start() for %s", sdpPath)
+	if errStart := cmd.Start(); errStart != nil {
+		procArgs.Log.Log.Sugar().Errorf("cmd.Start() for %s return error: %s", sdpPath, errStart.Error())
+		return false, errStart
+	}
+	proc.Started(cmd, runner.StopSignal)
+	defer proc.Exited()
+	select {
+	case <-proc.Stopping():
+		// остановка запрошена до регистрации команды - сигнал мог не дойти
+		proc.Interrupt()
+	default:
+	}
+
+	readers := sync.WaitGroup{}
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		procArgs.Log.Log.Sugar().Warnf("start read err channel for %s", sdpPath)
+		scannerErr := bufio.NewScanner(stderr)
+		for scannerErr.Scan() {
+			atomicWriteSync("FFMPEG error stream: ", scannerErr.Text()) // Println will add back the final '\n'
+		}
+		procArgs.Log.Log.Sugar().Warnf("stop read err channel for %s", sdpPath)
+	}()
+	go func() {
+		defer readers.Done()
+		procArgs.Log.Log.Sugar().Warnf("start read out channel for %s", sdpPath)
+		var parser LineParser
+		if runner.OutParser != nil {
+			parser = runner.OutParser(procArgs.Progress)
+		}
+		scannerOut := bufio.NewScanner(stdout)
+		for scannerOut.Scan() {
+			if parser != nil && parser.Line(scannerOut.Text()) {
+				continue
+			}
+			atomicWrite("FFMPEG out stream: ", scannerOut.Text()) // Println will add back the final '\n'
+		}
+		procArgs.Log.Log.Sugar().Warnf("stop read out channel for %s", sdpPath)
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		// Wait закрывает пайпы, поэтому сначала дочитываем их
+		readers.Wait()
+		done <- cmd.Wait()
+	}()
+
+	errRun := h.watchdog(proc, key, done, procArgs)
+	if errRun != nil {
+		procArgs.Log.Log.Sugar().Errorf("stop cmd.Wait() for %s return error: %s", sdpPath, errRun.Error())
+	} else {
+		procArgs.Log.Log.Sugar().Warnf("stop cmd.Wait() for %s", sdpPath)
+	}
+	select {
+	case <-proc.Stopping():
+		return true, errRun
+	default:
+		return false, errRun
+	}
+}
+
+// stallTimeout return time without segments after which stream is restarted, 0 - watchdog is off
+func (h *StreamHandler) stallTimeout(procArgs *StreamFFMPEG) time.Duration {
+	segDur := *h.conf.SegDur
+	if value, isFind := procArgs.Params["segduration"]; isFind {
+		if parsed, errParse := strconv.ParseFloat(value, 64); errParse == nil && parsed > 0 {
+			segDur = parsed
+		}
+	}
+	return time.Duration(float64(*h.conf.StallFactor) * segDur * float64(time.Second))
+}
+
+// watchdog wait exit of ffmpeg, if no segment arrives into cache in stallTimeout ffmpeg is stopped with ErrStalled
+func (h *StreamHandler) watchdog(proc *Process, key string, done <-chan error, procArgs *StreamFFMPEG) error {
+	stall := h.stallTimeout(procArgs)
+	if stall <= 0 {
+		return <-done
+	}
+	begin := time.Now()
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case errRun := <-done:
+			return errRun
+		case <-ticker.C:
+			if proc.IsStopping() {
+				continue
+			}
+			last, isFind := h.items.LastArrival(key)
+			if !isFind || last.Before(begin) {
+				last = begin
+			}
+			wait := time.Since(last)
+			if wait <= stall {
+				continue
+			}
+			// процесс жив, но сегменты не приходят: камера молча перестала отдавать кадры
+			h.log.Sugar().Errorf("stream %s stalled: no segments for %s", key, wait)
+			procArgs.Log.Log.Sugar().Errorf("stream %s stalled: no segments for %s", key, wait)
+			proc.Interrupt()
+			select {
+			case <-done:
+			case <-time.After(time.Duration(*h.conf.StopTimeout) * time.Second):
+				proc.signal(syscall.SIGKILL)
+				<-done
+			}
+			return ErrStalled
+		}
+	}
+}
+
 /*
 -master_pl_name master.m3u8 опция игнорируется ffmpeg можно написать master_pl_name out.m3u8 но генерироваться будет master.m3u8
 */
-func (h *StreamHandler) runFFMPEG(sdpPath string, argsStr string, procArgs *StreamFFMPEG) {
+func (h *StreamHandler) runFFMPEG(proc *Process, ticket *Ticket, sdpPath string, argsStr string, procArgs *StreamFFMPEG) {
+	state := StateFailed
+	defer func() {
+		ticket.Release()
+		h.ctrl.Del("/"+procArgs.Name, proc)
+		proc.Finish(state)
+	}()
+
 	cfg := zap.NewProductionConfig()
 	cfg.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.StampNano)
 	cfg.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
@@ -123,38 +309,34 @@ func (h *StreamHandler) runFFMPEG(sdpPath string, argsStr string, procArgs *Stre
 	procArgs.Log.Log.Sugar().Warnf("start runFFMPEG for %s", sdpPath)
 
 	for _, n := range procArgs.Notifications {
-		go n.Notify(procArgs.Log.Log)
+		h.notify(n, procArgs.Log.Log)
 	}
 
 	h.setProcArgs("/"+procArgs.Name, procArgs)
+	defer h.delProcArgs("/" + procArgs.Name)
+
+	// ждем своей очереди, если лимит процессов занят
+	if !ticket.Wait(proc.Stopping()) {
+		h.log.Sugar().Warnf("stop queued runFFMPEG for %s", sdpPath)
+		procArgs.Log.Log.Sugar().Warnf("stop queued runFFMPEG for %s", sdpPath)
+		state = StateExited
+		return
+	}
+	proc.Queued(false)
 
 	args := SplitArgs(argsStr)
-	h.log.Sugar().Warnf(fmt.Sprintf("%s %v", "ffmpeg", args))
-	procArgs.Log.Log.Sugar().Warnf(fmt.Sprintf("%s %v", "ffmpeg", args))
-	cmd := exec.Command("ffmpeg", args...)
+	h.log.Sugar().Warnf(fmt.Sprintf("%s %v", procArgs.Runner, args))
+	procArgs.Log.Log.Sugar().Warnf(fmt.Sprintf("%s %v", procArgs.Runner, args))
 	logFile, errFile := os.Create(sdpPath + ".log")
 	if errFile != nil {
 		h.log.Sugar().Errorf("os.Create() for %s.log return error: %s", sdpPath, errFile.Error())
 		procArgs.Log.Log.Sugar().Errorf("os.Create() for %s.log return error: %s", sdpPath, errFile.Error())
 		return
 	}
+	defer logFile.Close()
 	// defer os.Remove(sdpPath + ".log")
 
 	defer h.delEmptyDir(filepath.Dir(sdpPath))
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		h.log.Sugar().Errorf("cmd.StderrPipe() for %s return error: %s", sdpPath, err.Error())
-		procArgs.Log.Log.Sugar().Errorf("cmd.StderrPipe() for %s return error: %s", sdpPath, err.Error())
-		return
-	}
-	defer stderr.Close()
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		h.log.Sugar().Errorf("cmd.StderrPipe() for %s return error: %s", sdpPath, err.Error())
-		procArgs.Log.Log.Sugar().Errorf("cmd.StderrPipe() for %s return error: %s", sdpPath, err.Error())
-		return
-	}
-	defer stdout.Close()
 
 	var key string
 	wd, errAbs := filepath.Abs(*h.conf.WorkDir)
@@ -165,108 +347,65 @@ func (h *StreamHandler) runFFMPEG(sdpPath string, argsStr string, procArgs *Stre
 			key = strings.Replace(key, ext, "", 1)
 		}
 		h.items.AddNotifications(key, procArgs.Notifications, procArgs.OnStart, procArgs.OnStop, procArgs.OnError)
+		h.items.SetManifestRules(key, procArgs.GetManifest())
+		h.items.SetTimeshift(key, time.Duration(procArgs.Timeshift)*time.Second)
 	}
 
-	go func() {
-		procArgs.Log.Log.Sugar().Warnf("start cmd.Run() for %s", sdpPath)
-		errRun := cmd.Run()
-		if errRun != nil {
-			procArgs.Log.Log.Sugar().Errorf("stop cmd.Run() for %s return error: %s", sdpPath, errRun.Error())
-			time.Sleep(time.Millisecond * 200)
-			os.Remove(sdpPath)
-			h.items.DelOnStopWebhooks(key)
-			delOnErrorWebhooks, isFind := h.items.DelOnErrorWebhooks(key)
-			if isFind && delOnErrorWebhooks != nil {
-				for _, webhook := range delOnErrorWebhooks {
-					go webhook.Notify(h.log)
-				}
-			}
-			return
+	// супервизор: пока остановка не запрошена, упавший ffmpeg перезапускается с экспоненциальной задержкой
+	backoff := NewBackoff(time.Duration(*h.conf.RestartMin)*time.Second, time.Duration(*h.conf.RestartMax)*time.Second)
+	var generation uint64
+	for {
+		begin := time.Now()
+		// сегменты каждого запуска ffmpeg скрыты до его первого манифеста, потом прежние удаляются разом
+		if errAbs == nil {
+			generation = h.items.NewGeneration(key)
 		}
-		procArgs.Log.Log.Sugar().Warnf("stop cmd.Run() for %s", sdpPath)
-		os.Remove(sdpPath)
-		h.items.DelOnErrorWebhooks(key)
-		delOnStopWebhooks, isFind := h.items.DelOnStopWebhooks(key)
-		if isFind && delOnStopWebhooks != nil {
-			for _, webhook := range delOnStopWebhooks {
-				go webhook.Notify(h.log)
+		isStopped, errRun := h.execFFMPEG(proc, key, sdpPath, argsStr, args, logFile, procArgs)
+		if isStopped {
+			state = StateExited
+			if proc.Killed() {
+				state = StateFailed
 			}
+			h.notifyStop(key, state == StateFailed)
+			break
 		}
-	}()
-
-	{
-		mutex := sync.Mutex{}
-		atomicWrite := func(text ...string) {
-			mutex.Lock()
-			defer mutex.Unlock()
-			var sb strings.Builder
-			for _, str := range text {
-				sb.WriteString(str)
-			}
-			logFile.WriteString(sb.String())
-			logFile.WriteString("\n")
-			procArgs.Log.Log.Sugar().Info(sb.String())
-			sb.Reset()
-		}
-		atomicWriteSync := func(text ...string) {
-			mutex.Lock()
-			defer mutex.Unlock()
-			var sb strings.Builder
-			for _, str := range text {
-				sb.WriteString(str)
-			}
-			logFile.WriteString(sb.String())
-			logFile.WriteString("\n")
-			logFile.Sync()
-			procArgs.Log.Log.Sugar().Info(sb.String())
-			sb.Reset()
-		}
-		atomicWriteSync("ffmpeg ", argsStr)
-		go func() {
-			procArgs.Log.Log.Sugar().Warnf("start read err channel for %s", sdpPath)
-			scannerErr := bufio.NewScanner(stderr)
-			for scannerErr.Scan() {
-				atomicWriteSync("FFMPEG error stream: ", scannerErr.Text()) // Println will add back the final '\n'
-			}
-			procArgs.Log.Log.Sugar().Warnf("stop read err channel for %s", sdpPath)
-			defer h.delEmptyDir(filepath.Dir(sdpPath))
-		}()
-		go func() {
-			procArgs.Log.Log.Sugar().Warnf("start read out channel for %s", sdpPath)
-			scannerOut := bufio.NewScanner(stdout)
-			for scannerOut.Scan() {
-				atomicWrite("FFMPEG out stream: ", scannerOut.Text()) // Println will add back the final '\n'
-			}
-			procArgs.Log.Log.Sugar().Warnf("stop read out channel for %s", sdpPath)
-			defer h.delEmptyDir(filepath.Dir(sdpPath))
-		}()
-	}
-
-	for {
-		time.Sleep(time.Millisecond * 200)
-		check, errOpen := os.Open(sdpPath)
-		check.Close()
-		if errOpen != nil {
+		if errors.Is(errRun, ErrNoRunner) {
+			// без шаблона перезапуск не поможет
+			h.notifyStop(key, true)
 			break
 		}
-	}
 
-	delOnErrorWebhooks, isFindErr := h.items.DelOnErrorWebhooks(key)
-	delOnStopWebhooks, isFindStop := h.items.DelOnStopWebhooks(key)
+		reason := "exited"
+		if errRun != nil {
+			reason = errRun.Error()
+		}
+		restarts := procArgs.SetExit(reason)
+		for _, webhook := range procArgs.OnError {
+			h.webhookReason(webhook, reason)
+		}
 
-	errSig := cmd.Process.Signal(syscall.SIGQUIT)
-	if errSig != nil {
-		h.log.Sugar().Warnf("Process.Signal %s", errSig.Error())
-		if isFindErr && delOnErrorWebhooks != nil {
-			for _, webhook := range delOnErrorWebhooks {
-				go webhook.Notify(h.log)
-			}
+		if time.Since(begin) > backoff.Max {
+			backoff.Reset()
 		}
-	} else {
-		if isFindStop && delOnStopWebhooks != nil {
-			for _, webhook := range delOnStopWebhooks {
-				go webhook.Notify(h.log)
-			}
+		delay := backoff.Next()
+		h.log.Sugar().Warnf("ffmpeg for %s crashed (%s), restart %d in %s", sdpPath, reason, restarts, delay)
+		procArgs.Log.Log.Sugar().Warnf("ffmpeg for %s crashed (%s), restart %d in %s", sdpPath, reason, restarts, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-proc.Stopping():
+			timer.Stop()
+		case <-timer.C:
+		}
+		if proc.IsStopping() {
+			// остановили во время ожидания: процесса уже нет
+			state = StateExited
+			h.notifyStop(key, false)
+			break
+		}
+
+		// после восстановления снова шлем onstart на первом init сегменте
+		if errAbs == nil {
+			h.items.SetOnStartWebhooks(key, procArgs.OnStart)
 		}
 	}
 
@@ -277,123 +416,488 @@ func (h *StreamHandler) runFFMPEG(sdpPath string, argsStr string, procArgs *Stre
 			delNotifications.Close()
 		}
 		h.items.DelOnStartWebhooks(key)
+		h.items.DelArrival(key)
+		h.items.DelManifestRules(key)
+		h.items.DelTracks(key)
+		h.items.DelTimeshift(key)
+		h.items.DelGeneration(key, generation)
 	}
 
-	h.delProcArgs("/" + procArgs.Name)
 	h.log.Sugar().Warnf("stop runFFMPEG for %s", sdpPath)
 	procArgs.Log.Log.Sugar().Warnf("stop runFFMPEG for %s", sdpPath)
 }
 
-func (h *StreamHandler) start(c *gin.Context) {
+// notify start sending of notifications, Shutdown waits while the channel is flushed
+func (h *StreamHandler) notify(n *localnotif.Notification, log *zap.Logger) {
+	h.notifyWg.Add(1)
+	go func() {
+		defer h.notifyWg.Done()
+		n.Notify(log)
+	}()
+}
 
-	url := c.Request.URL.Query().Get("url")
-	if len(url) == 0 {
-		localproxy.Error(c, "url isn't set in query", http.StatusBadRequest)
-		return
+// webhook call webhook in background, Shutdown waits its finish
+func (h *StreamHandler) webhook(webhook *localnotif.Webhook) {
+	h.notifyWg.Add(1)
+	go func() {
+		defer h.notifyWg.Done()
+		webhook.Notify(h.log)
+	}()
+}
+
+// webhookReason call webhook with reason in background, Shutdown waits its finish
+func (h *StreamHandler) webhookReason(webhook *localnotif.Webhook, reason string) {
+	h.notifyWg.Add(1)
+	go func() {
+		defer h.notifyWg.Done()
+		webhook.NotifyReason(h.log, reason)
+	}()
+}
+
+// Shutdown stop all streams without removing them from state file and wait webhooks and notifications
+func (h *StreamHandler) Shutdown(ctx context.Context) int {
+	states := h.ctrl.StopAll(ctx, time.Duration(*h.conf.StopTimeout)*time.Second)
+	for name, state := range states {
+		h.log.Sugar().Warnf("shutdown stream %s: %s", name, state)
+	}
+	if !waitGroupContext(ctx, h.notifyWg) {
+		h.log.Sugar().Errorf("shutdown streams: %s", ctx.Err())
+	}
+	return len(states)
+}
+
+// notifyStop send onstop webhooks, or onerror webhooks if process was not stopped correctly
+func (h *StreamHandler) notifyStop(key string, isFailed bool) {
+	delOnErrorWebhooks, isFindErr := h.items.DelOnErrorWebhooks(key)
+	delOnStopWebhooks, isFindStop := h.items.DelOnStopWebhooks(key)
+	if isFailed {
+		if isFindErr && delOnErrorWebhooks != nil {
+			for _, webhook := range delOnErrorWebhooks {
+				h.webhook(webhook)
+			}
+		}
+	} else {
+		if isFindStop && delOnStopWebhooks != nil {
+			for _, webhook := range delOnStopWebhooks {
+				h.webhook(webhook)
+			}
+		}
 	}
+}
 
-	path := c.Request.URL.Path
-	nameBegin := strings.LastIndex(path, "/start/")
-	name := path[nameBegin+7:]
-	if len(name) == 0 {
-		localproxy.Error(c, "name isn't set in path", http.StatusBadRequest)
+func (h *StreamHandler) start(c *gin.Context) {
+	query := c.Request.URL.Query()
+	name, errName := localconf.StreamName(c.Request.URL.Path, "/stream/start/")
+	// /stream/start/?camera=cam1 берет имя из записи камеры
+	if errName != nil && (len(name) > 0 || len(query.Get("camera")) == 0) {
+		localproxy.Error(c, errName.Error(), http.StatusBadRequest)
 		return
 	}
+	code, mess, probe := h.startFFMPEG(name, query, true)
+	if !h.needProbe(query, true) {
+		localproxy.Error(c, mess, code)
+		return
+	}
+	// с проверкой камеры отвечаем json, чтобы было видно найденные потоки
+	res := localproxy.Response{Errno: localproxy.OK, Error: mess}
+	if probe != nil {
+		res.Data = probe
+	}
+	if code >= http.StatusBadRequest {
+		res.Errno = localproxy.ProbeFailed
+	}
+	c.JSON(code, res)
+}
+
+// needProbe return true if url of stream must be checked by ffprobe before start
+func (h *StreamHandler) needProbe(query url.Values, preflight bool) bool {
+	switch query.Get("probe") {
+	case "only":
+		return true
+	case "skip":
+		return false
+	}
+	return preflight && *h.conf.Probe
+}
+
+// startFFMPEG create stream by name and query parameters, return http code and message for response.
+// preflight check url by ffprobe before start, probe=only in query check url without start
+func (h *StreamHandler) startFFMPEG(name string, request url.Values, preflight bool) (int, string, *Probe) {
+	name, query, errCamera := h.cameras.Inherit(name, request, false)
+	if errCamera != nil {
+		return http.StatusNotFound, errCamera.Error(), nil
+	}
+	urlIn := query.Get("url")
+	if len(urlIn) == 0 {
+		return http.StatusBadRequest, "url isn't set in query", nil
+	}
+	// команда делится на аргументы по пробелам и кавычкам после подстановки url
+	if errArg := localconf.CheckArg(urlIn); errArg != nil {
+		return http.StatusBadRequest, "url " + errArg.Error(), nil
+	}
 
+	if errName := localconf.CheckName(name); errName != nil {
+		return http.StatusBadRequest, errName.Error(), nil
+	}
+
+	// имя любой глубины: org/site/building/cam, последняя часть - файлы потока, остальные - каталоги
 	dirEnd := strings.LastIndex(name, "/")
 	if dirEnd == -1 {
-		localproxy.Error(c, "must bee '/start/path1/path2'", http.StatusBadRequest)
-		return
+		return http.StatusBadRequest, "must bee '/start/path1/path2[/...]'", nil
 	}
 	dir := name[0:dirEnd]
 
 	// создаем каталог
 	workDir, pathError := filepath.Abs(filepath.Join(*h.conf.WorkDir, dir))
 	if pathError != nil {
-		localproxy.Error(c, "Unable build path to file ", http.StatusInternalServerError)
-		return
+		return http.StatusInternalServerError, "Unable build path to file ", nil
 	}
 	dirError := os.MkdirAll(workDir, os.ModePerm)
 	if dirError != nil {
-		localproxy.Error(c, "error create dir", http.StatusBadRequest)
-		return
+		return http.StatusBadRequest, "error create dir", nil
 	}
 
-	// создаем файл sdp
+	// путь для лога ffmpeg
 	sdpPath, pathError := filepath.Abs(filepath.Join(*h.conf.WorkDir, name+".sdp"))
 	if pathError != nil {
-		localproxy.Error(c, "Unable build path to file ", http.StatusInternalServerError)
-		return
-	}
-
-	file, errCreate := os.Create(sdpPath)
-	if errCreate != nil {
-		localproxy.Error(c, "Unable to create file "+sdpPath, http.StatusInternalServerError)
-		return
+		return http.StatusInternalServerError, "Unable build path to file ", nil
 	}
-	defer file.Close()
 
 	// ищем шаблон для команды и аргументы
-	tmplName := StreamFfmpegCmd
-	procArgs := BuildStreamFFMPEG(name, workDir, url, *h.conf.Port, localconf.InitSegmentName, *h.conf.ChankDur*2, c.Request.URL.Query()["notify"], c.Request.URL.Query()["onstart"], c.Request.URL.Query()["onstop"], c.Request.URL.Query()["onerror"])
+	tmplName := query.Get("cmd")
+	if len(tmplName) == 0 {
+		tmplName = *h.conf.StreamCmd
+	}
+	procArgs := BuildStreamFFMPEG(name, workDir, urlIn, *h.conf.Port, localconf.InitSegmentName, *h.conf.ChankDur*2, query["notify"], query["onstart"], query["onstop"], query["onerror"])
 	tmpl, ok := h.conf.GetTmpl(tmplName)
 	if !ok {
-		localproxy.Error(c, "streamffmpeg.cmd not found", http.StatusInternalServerError)
 		os.Remove(workDir)
-		return
+		return http.StatusBadRequest, tmplName + " not found", nil
+	}
+	procArgs.Cmd = tmplName
+	// пользовательские параметры шаблона проверяем до запуска ffmpeg
+	desc, _ := h.conf.GetCmdDesc(tmplName)
+	params, errParams := desc.BuildParams(query["param"])
+	if errParams != nil {
+		os.Remove(workDir)
+		return http.StatusBadRequest, errParams.Error(), nil
+	}
+	procArgs.Params = params
+	// правила манифестов потока заменяют правила шаблона
+	procArgs.Manifest = desc.ManifestRules()
+	if manifest := query.Get("manifest"); len(manifest) > 0 {
+		rules, errRules := localconf.ParseManifestRules([]byte(manifest))
+		if errRules != nil {
+			os.Remove(workDir)
+			return http.StatusBadRequest, "manifest: " + errRules.Error(), nil
+		}
+		procArgs.Manifest = rules
+	}
+	procArgs.Timeshift = *h.conf.Timeshift
+	if timeshift := query.Get("timeshift"); len(timeshift) > 0 {
+		depth, errDepth := strconv.ParseUint(timeshift, 10, 32)
+		if errDepth != nil {
+			os.Remove(workDir)
+			return http.StatusBadRequest, "timeshift must be seconds: " + timeshift, nil
+		}
+		procArgs.Timeshift = uint(depth)
 	}
+	runner, ok := GetRunner(h.conf, desc.Runner)
+	if !ok {
+		os.Remove(workDir)
+		return http.StatusBadRequest, "runner " + desc.Runner + " not found", nil
+	}
+	procArgs.Runner = runner.Name
 	// строим команду запуска
 	buf := bytes.NewBufferString("")
 	errTmpl := tmpl.Execute(buf, *procArgs)
 	if errTmpl != nil {
 		h.log.Error("build command", zap.Error(errTmpl))
-		localproxy.Error(c, "streamffmpeg.cmd not build", http.StatusInternalServerError)
 		os.Remove(workDir)
-		return
+		return http.StatusInternalServerError, tmplName + " not build", nil
 	}
 
-	// сначала ответ
-	localproxy.Error(c, "created", http.StatusCreated)
+	// только проверка камеры без запуска
+	if query.Get("probe") == "only" {
+		os.Remove(workDir)
+		probe, errProbe := RunProbe(h.conf.GetBin("ffprobe", "ffprobe"), urlIn, time.Duration(*h.conf.ProbeTimeout)*time.Second)
+		if errProbe != nil {
+			return http.StatusUnprocessableEntity, errProbe.Error(), probe
+		}
+		return http.StatusOK, "ok", probe
+	}
+
+	proc, errAdd := h.ctrl.Add("/" + name)
+	if errAdd != nil {
+		return http.StatusConflict, errAdd.Error(), nil
+	}
+
+	// опечатка в url иначе видна только в логе ffmpeg через несколько секунд
+	if h.needProbe(query, preflight) {
+		probe, errProbe := RunProbe(h.conf.GetBin("ffprobe", "ffprobe"), urlIn, time.Duration(*h.conf.ProbeTimeout)*time.Second)
+		if errProbe != nil {
+			h.log.Sugar().Errorf("probe %s: %s", name, errProbe.Error())
+			h.ctrl.Del("/"+name, proc)
+			proc.Finish(StateFailed)
+			os.Remove(workDir)
+			return http.StatusUnprocessableEntity, errProbe.Error(), probe
+		}
+		procArgs.Probe = probe
+	}
+
+	// место в лимите процессов, сверх лимита - отказ или очередь
+	ticket, queue, errLimit := h.limiter.Acquire(ClassStream, "/"+name, desc.Weight, StreamPriority+desc.Priority)
+	if errLimit != nil {
+		h.ctrl.Del("/"+name, proc)
+		proc.Finish(StateFailed)
+		return limitStatus(errLimit), errLimit.Error(), procArgs.Probe
+	}
+	if queue > 0 {
+		proc.Queued(true)
+	}
+
+	// запоминаем поток, чтобы поднять его после перезапуска camctl
+	errState := h.state.Set(StateItem{Name: name, Cmd: tmplName, Time: procArgs.TimeStr, Query: request})
+	if errState != nil {
+		h.log.Error("save state", zap.String("name", name), zap.Error(errState))
+	}
 
 	h.items.CancelDelAny("/" + name)
-	go h.runFFMPEG(sdpPath, buf.String(), procArgs)
+	go h.runFFMPEG(proc, ticket, sdpPath, buf.String(), procArgs)
+	if queue > 0 {
+		return http.StatusAccepted, fmt.Sprintf("queued %d", queue), procArgs.Probe
+	}
+	return http.StatusCreated, "created", procArgs.Probe
+}
+
+// Restore start streams stored in state file, return number of started streams
+func (h *StreamHandler) Restore() int {
+	items, errLoad := h.state.Load()
+	if errLoad != nil {
+		h.log.Error("load state", zap.Error(errLoad))
+	}
+	count := 0
+	for _, item := range items {
+		if item.Query == nil {
+			item.Query = make(url.Values)
+		}
+		// шаблон по умолчанию мог поменяться - поднимаем с тем, с которым запускали, шаблон камеры берем из ее записи
+		if len(item.Query.Get("cmd")) == 0 && len(item.Cmd) > 0 && len(item.Query.Get("camera")) == 0 {
+			item.Query.Set("cmd", item.Cmd)
+		}
+		// камера может быть еще недоступна, ее дождется супервизор
+		code, mess, _ := h.startFFMPEG(item.Name, item.Query, false)
+		if code != http.StatusCreated && code != http.StatusAccepted {
+			h.log.Sugar().Errorf("restore stream %s return %d: %s", item.Name, code, mess)
+			continue
+		}
+		h.log.Sugar().Warnf("restore stream %s", item.Name)
+		count++
+	}
+	return count
+}
+
+// Boot start streams of cameras marked to stream at boot, streams restored from state file are skipped.
+// Return number of started streams
+func (h *StreamHandler) Boot() int {
+	count := 0
+	for _, camera := range h.cameras.List("") {
+		if !camera.Stream {
+			continue
+		}
+		code, mess, _ := h.startFFMPEG(camera.Name, url.Values{"camera": []string{camera.ID}}, false)
+		if code == http.StatusConflict {
+			continue
+		}
+		if code != http.StatusCreated && code != http.StatusAccepted {
+			h.log.Sugar().Errorf("boot camera %s return %d: %s", camera.ID, code, mess)
+			continue
+		}
+		h.log.Sugar().Warnf("boot camera %s stream %s", camera.ID, camera.Name)
+		count++
+	}
+	return count
 }
 
 func (h *StreamHandler) stop(c *gin.Context) {
-	path := c.Request.URL.Path
-	nameBegin := strings.LastIndex(path, "/stop/")
-	name := path[nameBegin+6:]
-	if len(name) == 0 {
-		localproxy.Error(c, "name isn't set in path", http.StatusBadRequest)
+	name, errName := localconf.StreamName(c.Request.URL.Path, "/stream/stop/")
+	if errName != nil {
+		localproxy.Error(c, errName.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// создаем файл sdp
-	sdpPath, pathError := filepath.Abs(filepath.Join(*h.conf.WorkDir, name+".sdp"))
-	if pathError != nil {
-		localproxy.Error(c, "Unable build path to file ", http.StatusInternalServerError)
-		return
+	// поток остановлен штатно - после перезапуска camctl его поднимать не нужно
+	if _, errState := h.state.Del(name); errState != nil {
+		h.log.Error("delete state", zap.String("name", name), zap.Error(errState))
 	}
 
-	// удаляем файл
-	os.Remove(sdpPath)
+	// останавливаем ffmpeg и ждем его завершения
+	state, isFind, errStop := h.ctrl.Stop("/"+name, time.Duration(*h.conf.StopTimeout)*time.Second)
+	if !isFind {
+		localproxy.Error(c, "not found", http.StatusNotFound)
+		return
+	}
 
 	// удаляем все связанное с трансляцией
 	h.items.DelAny("/" + name) // после items.timeout, есть время на создание
 
-	localproxy.Error(c, "deleted", http.StatusAccepted)
+	if errStop != nil {
+		h.log.Sugar().Errorf("stop %s: %s", name, errStop.Error())
+		localproxy.Error(c, string(state)+": "+errStop.Error(), http.StatusInternalServerError)
+		return
+	}
+	localproxy.Error(c, string(state), http.StatusOK)
+}
+
+// StreamStats describe ffmpeg progress of stream for response
+type StreamStats struct {
+	Name    string     `json:"name"`
+	Last    *Progress  `json:"last,omitempty"`
+	History []Progress `json:"history"`
+}
+
+// GetStats return ffmpeg progress of stream by key
+func (h *StreamHandler) GetStats(proc string) *StreamStats {
+	find := h.GetProcArgs(proc)
+	if find == nil {
+		return nil
+	}
+	res := StreamStats{Name: find.Name, History: find.Progress.List(ProgressHistorySize)}
+	if last, ok := find.Progress.Last(); ok {
+		res.Last = &last
+	}
+	return &res
+}
+
+func (h *StreamHandler) stats(c *gin.Context) {
+	name, errName := localconf.StreamName(c.Request.URL.Path, "/stream/stats/")
+	if errName != nil {
+		localproxy.Error(c, errName.Error(), http.StatusBadRequest)
+		return
+	}
+	res := h.GetStats("/" + name)
+	if res == nil {
+		c.JSON(http.StatusNotFound, localproxy.Response{Errno: localproxy.NotFound, Error: "stream not found"})
+		return
+	}
+	c.JSON(http.StatusOK, localproxy.Response{Errno: localproxy.OK, Error: "ok", Data: res})
+}
+
+func (h *StreamHandler) probe(c *gin.Context) {
+	name, errName := localconf.StreamName(c.Request.URL.Path, "/stream/probe/")
+	if errName != nil {
+		localproxy.Error(c, errName.Error(), http.StatusBadRequest)
+		return
+	}
+	find := h.GetProcArgs("/" + name)
+	if find == nil {
+		c.JSON(http.StatusNotFound, localproxy.Response{Errno: localproxy.NotFound, Error: "stream not found"})
+		return
+	}
+	if find.Probe == nil {
+		c.JSON(http.StatusNotFound, localproxy.Response{Errno: localproxy.NotFound, Error: "stream wasn't probed"})
+		return
+	}
+	c.JSON(http.StatusOK, localproxy.Response{Errno: localproxy.OK, Error: "ok", Data: find.Probe})
+}
+
+// getManifest return rules for manifests of stream
+func (h *StreamHandler) getManifest(c *gin.Context, name string) {
+	find := h.GetProcArgs(name)
+	if find == nil {
+		c.JSON(http.StatusNotFound, localproxy.Response{Errno: localproxy.NotFound, Error: "stream not found"})
+		return
+	}
+	c.JSON(http.StatusOK, localproxy.Response{Errno: localproxy.OK, Error: "ok", Data: find.GetManifest()})
+}
+
+// setManifest replace rules for manifests of stream by json from body, they are applied from next PUT of manifest
+func (h *StreamHandler) setManifest(c *gin.Context, name string) {
+	find := h.GetProcArgs(name)
+	if find == nil {
+		c.JSON(http.StatusNotFound, localproxy.Response{Errno: localproxy.NotFound, Error: "stream not found"})
+		return
+	}
+	body, errRead := ioutil.ReadAll(c.Request.Body)
+	if errRead != nil {
+		localproxy.Error(c, errRead.Error(), http.StatusBadRequest)
+		return
+	}
+	rules, errRules := localconf.ParseManifestRules(body)
+	if errRules != nil {
+		localproxy.Error(c, "manifest: "+errRules.Error(), http.StatusBadRequest)
+		return
+	}
+	find.SetManifest(rules)
+	h.items.SetManifestRules(name, rules)
+
+	// правила сохраняем в запросе запуска, чтобы они пережили перезапуск camctl
+	items, errLoad := h.state.Load()
+	if errLoad != nil {
+		h.log.Error("load state", zap.String("name", name), zap.Error(errLoad))
+	}
+	for _, item := range items {
+		if "/"+item.Name != name {
+			continue
+		}
+		compact, _ := json.Marshal(rules)
+		if item.Query == nil {
+			item.Query = make(url.Values)
+		}
+		item.Query.Set("manifest", string(compact))
+		if errState := h.state.Set(item); errState != nil {
+			h.log.Error("save state", zap.String("name", name), zap.Error(errState))
+		}
+	}
+	c.JSON(http.StatusOK, localproxy.Response{Errno: localproxy.OK, Error: "ok", Data: rules})
+}
+
+func (h *StreamHandler) manifest(c *gin.Context) {
+	name, errName := localconf.StreamName(c.Request.URL.Path, "/stream/manifest/")
+	if errName != nil {
+		localproxy.Error(c, errName.Error(), http.StatusBadRequest)
+		return
+	}
+	name = "/" + name
+	if c.Request.Method != http.MethodPut {
+		h.getManifest(c, name)
+		return
+	}
+	if !h.conf.IsTrustedIP(c.Request.RemoteAddr) {
+		h.log.Sugar().Errorf("forbidden by remote ip %s", c.Request.RemoteAddr)
+		localproxy.Error(c, "forbidden", http.StatusForbidden)
+		return
+	}
+	h.setManifest(c, name)
 }
 
 func (h *StreamHandler) ServeHTTP(c *gin.Context) {
+	// статистика только на чтение, ее смотрит streamlog.html
+	if strings.HasPrefix(c.Request.URL.Path, "/stream/stats/") {
+		h.stats(c)
+		return
+	}
+	if strings.HasPrefix(c.Request.URL.Path, "/stream/probe/") {
+		h.probe(c)
+		return
+	}
+	// правила манифестов смотрит любой, меняют только доверенные ip
+	if strings.HasPrefix(c.Request.URL.Path, "/stream/manifest/") {
+		h.manifest(c)
+		return
+	}
 	// проверка на ip
 	if !h.conf.IsTrustedIP(c.Request.RemoteAddr) {
 		h.log.Sugar().Errorf("forbidden by remote ip %s", c.Request.RemoteAddr)
 		localproxy.Error(c, "forbidden", http.StatusForbidden)
 		return
 	}
-	if strings.Contains(c.Request.URL.Path, "/start") {
+	// в списке есть url камер вместе с паролями, поэтому он только для доверенных ip
+	if strings.HasPrefix(c.Request.URL.Path, "/stream/list") {
+		h.list(c)
+	} else if strings.HasPrefix(c.Request.URL.Path, "/stream/start/") {
 		h.start(c)
-	} else if strings.Contains(c.Request.URL.Path, "/stop") {
+	} else if strings.HasPrefix(c.Request.URL.Path, "/stream/stop/") {
 		h.stop(c)
 	} else {
 		localproxy.Error(c, "bad path", http.StatusBadRequest)
@@ -0,0 +1,268 @@
+package localffmpeg
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"camctl/local/localconf"
+	"camctl/local/locallog"
+	"camctl/local/localnotif"
+	"camctl/local/localproxy"
+)
+
+// testStreamHandler build handler with cache without segments, segDur is -segDur and stallFactor is -stallFactor
+func testStreamHandler(t *testing.T, segDur float64, stallFactor uint) *StreamHandler {
+	t.Helper()
+	var size, streamSize, dvrSize, upstreamTimeout uint = 0, 0, 64, 1
+	var stopTimeout, restartMin, restartMax uint = 1, 1, 60
+	workDir, dvrDir, upstream := t.TempDir(), t.TempDir(), ""
+	conf := &localconf.Config{WorkDir: &workDir, SegDur: &segDur, StallFactor: &stallFactor, StopTimeout: &stopTimeout, RestartMin: &restartMin, RestartMax: &restartMax,
+		CacheSize: &size, StreamCacheSize: &streamSize, DVRCacheSize: &dvrSize, DVRDir: &dvrDir, Upstream: &upstream, UpstreamTimeout: &upstreamTimeout}
+	items := localproxy.NewItems(new(sync.WaitGroup), zap.NewNop(), conf, time.Minute, time.Minute, 0)
+	t.Cleanup(items.Close)
+	return &StreamHandler{log: zap.NewNop(), conf: conf, items: items, procArgs: make(map[string]*StreamFFMPEG), procArgsMut: new(sync.RWMutex), ctrl: NewController(), notifyWg: new(sync.WaitGroup)}
+}
+
+// testStreamArgs build arguments of stream with template params
+func testStreamArgs(t *testing.T, params map[string]string) *StreamFFMPEG {
+	t.Helper()
+	res := &StreamFFMPEG{FFMPEG: FFMPEG{Name: "user/cam", Runner: RunnerExec, Params: params, Log: locallog.NewBuffLog(zap.NewNop(), 10), exitMut: new(sync.RWMutex)}}
+	t.Cleanup(res.Log.Close)
+	return res
+}
+
+// testWatchdog start script by exec runner and run watchdog of stream /user/cam in background.
+// Result of watchdog is sent to the first channel, exit of script is sent to the second one
+func testWatchdog(t *testing.T, h *StreamHandler, procArgs *StreamFFMPEG, script string) (*Process, <-chan error, <-chan *exec.Cmd) {
+	t.Helper()
+	proc, errAdd := h.ctrl.Add("/user/cam")
+	if errAdd != nil {
+		t.Fatal(errAdd)
+	}
+	runner, _ := GetRunner(h.conf, RunnerExec)
+	cmd, errCmd := runner.Command(proc, []string{"sh", "-c", script}, true, "", "", nil)
+	if errCmd != nil {
+		t.Fatal(errCmd)
+	}
+	if errStart := cmd.Start(); errStart != nil {
+		t.Fatalf("start %s: %v", script, errStart)
+	}
+	proc.Started(cmd, runner.StopSignal)
+
+	done := make(chan error, 1)
+	exited := make(chan *exec.Cmd, 1)
+	go func() {
+		errWait := cmd.Wait()
+		proc.Exited()
+		exited <- cmd
+		done <- errWait
+	}()
+	res := make(chan error, 1)
+	go func() {
+		res <- h.watchdog(proc, "/user/cam", done, procArgs)
+	}()
+	return proc, res, exited
+}
+
+func TestStallTimeout(t *testing.T) {
+	tests := []struct {
+		segDur      float64
+		stallFactor uint
+		params      map[string]string
+		want        time.Duration
+	}{
+		{1, 10, nil, 10 * time.Second},
+		{2, 3, map[string]string{}, 6 * time.Second},
+		{1, 10, map[string]string{"segduration": "4"}, 40 * time.Second},
+		{1, 10, map[string]string{"segduration": "0.5"}, 5 * time.Second},
+		{1, 10, map[string]string{"segduration": "abc"}, 10 * time.Second},
+		{1, 10, map[string]string{"segduration": "-1"}, 10 * time.Second},
+		{1, 0, map[string]string{"segduration": "4"}, 0},
+	}
+	for _, tt := range tests {
+		h := &StreamHandler{conf: &localconf.Config{SegDur: &tt.segDur, StallFactor: &tt.stallFactor}}
+		procArgs := &StreamFFMPEG{FFMPEG: FFMPEG{Params: tt.params}}
+		if got := h.stallTimeout(procArgs); got != tt.want {
+			t.Errorf("segDur %v, stallFactor %d, params %v: stallTimeout = %v, want %v", tt.segDur, tt.stallFactor, tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestWatchdogKill(t *testing.T) {
+	defer func(interval time.Duration) { watchdogInterval = interval }(watchdogInterval)
+	watchdogInterval = 50 * time.Millisecond
+
+	// без параметра шаблона поток остановился бы только через минуту
+	h := testStreamHandler(t, 60, 1)
+	procArgs := testStreamArgs(t, map[string]string{"segduration": "0.5"})
+	// скрипт не реагирует на SIGTERM, его останавливает только SIGKILL
+	begin := time.Now()
+	_, res, exited := testWatchdog(t, h, procArgs, "trap '' TERM; while :; do sleep 0.1; done")
+
+	select {
+	case errRun := <-res:
+		if !errors.Is(errRun, ErrStalled) {
+			t.Errorf("watchdog = %v, want %v", errRun, ErrStalled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream without segments isn't stopped")
+	}
+	elapsed := time.Since(begin)
+	// 0.5s без сегментов и 1s -stopTimeout до SIGKILL
+	if elapsed < 1500*time.Millisecond {
+		t.Errorf("stream is stopped in %v, before stall and stopTimeout", elapsed)
+	}
+	cmd := <-exited
+	status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() || status.Signal() != syscall.SIGKILL {
+		t.Errorf("script exited with %s, want SIGKILL", cmd.ProcessState)
+	}
+}
+
+func TestWatchdogArrival(t *testing.T) {
+	defer func(interval time.Duration) { watchdogInterval = interval }(watchdogInterval)
+	watchdogInterval = 50 * time.Millisecond
+
+	h := testStreamHandler(t, 0.5, 2)
+	procArgs := testStreamArgs(t, nil)
+	_, res, exited := testWatchdog(t, h, procArgs, "exec sleep 30")
+
+	// сегменты приходят чаще 1s: поток не считается зависшим
+	for i := 0; i < 8; i++ {
+		time.Sleep(250 * time.Millisecond)
+		h.items.Add("/user/cam/seg.ts", []byte("segment"), "video/mp2t")
+		select {
+		case errRun := <-res:
+			t.Fatalf("stream with segments is stopped after %d segments: %v", i, errRun)
+		default:
+		}
+	}
+
+	// сегменты перестали приходить: через 1s поток останавливается штатным сигналом
+	last, isFind := h.items.LastArrival("/user/cam")
+	if !isFind {
+		t.Fatal("arrival of segment isn't stored")
+	}
+	select {
+	case errRun := <-res:
+		if !errors.Is(errRun, ErrStalled) {
+			t.Errorf("watchdog = %v, want %v", errRun, ErrStalled)
+		}
+		if elapsed := time.Since(last); elapsed < time.Second {
+			t.Errorf("stream is stopped %v after last segment, before stall", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream without segments isn't stopped")
+	}
+	cmd := <-exited
+	status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() || status.Signal() != syscall.SIGTERM {
+		t.Errorf("script exited with %s, want SIGTERM", cmd.ProcessState)
+	}
+}
+
+// testRunFFMPEG start supervisor of stream /user/cam for template cmd, onerror webhook counts calls into hits
+func testRunFFMPEG(t *testing.T, h *StreamHandler, cmd string, argsStr string, hits *int32) (*Process, *StreamFFMPEG) {
+	t.Helper()
+	cmdDir := t.TempDir()
+	if errWrite := ioutil.WriteFile(filepath.Join(cmdDir, "crash"), []byte("sh -c \"exit 3\""), 0644); errWrite != nil {
+		t.Fatal(errWrite)
+	}
+	if errWrite := ioutil.WriteFile(filepath.Join(cmdDir, "crash"+localconf.CmdDescExt), []byte(`{"runner":"exec"}`), 0644); errWrite != nil {
+		t.Fatal(errWrite)
+	}
+	h.conf.Cmd = &cmdDir
+	if errParse := h.conf.ParseCmd(); errParse != nil {
+		t.Fatal(errParse)
+	}
+
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("reason") == "exit status 3" {
+			atomic.AddInt32(hits, 1)
+		}
+	}))
+	t.Cleanup(webhook.Close)
+
+	procArgs := &StreamFFMPEG{FFMPEG: FFMPEG{Name: "user/cam", Cmd: cmd, Runner: RunnerExec, OnError: []*localnotif.Webhook{{URL: webhook.URL}}, exitMut: new(sync.RWMutex)}}
+	proc, errAdd := h.ctrl.Add("/user/cam")
+	if errAdd != nil {
+		t.Fatal(errAdd)
+	}
+	ticket, _, errLimit := NewLimiter(0, nil, 0).Acquire(ClassStream, "/user/cam", 1, StreamPriority)
+	if errLimit != nil {
+		t.Fatal(errLimit)
+	}
+	if errDir := os.MkdirAll(filepath.Join(*h.conf.WorkDir, "user"), os.ModePerm); errDir != nil {
+		t.Fatal(errDir)
+	}
+	wd, _ := filepath.Abs(*h.conf.WorkDir)
+	go h.runFFMPEG(proc, ticket, filepath.Join(wd, "user", "cam.sdp"), argsStr, procArgs)
+	return proc, procArgs
+}
+
+func TestRunFFMPEGRestart(t *testing.T) {
+	h := testStreamHandler(t, 1, 0)
+	var hits int32
+	proc, procArgs := testRunFFMPEG(t, h, "crash", "sh -c \"exit 3\"", &hits)
+
+	// первый перезапуск через -restartMin 1s, второй ждет 2s: останавливаем во время ожидания
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if restarts, _ := procArgs.Exit(); restarts >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("crashed process isn't restarted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	begin := time.Now()
+	state, errStop := proc.Stop(time.Second)
+	if errStop != nil || state != StateExited || proc.Killed() {
+		t.Errorf("Stop during restart delay = %s, %v, killed %v", state, errStop, proc.Killed())
+	}
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Errorf("Stop waits restart delay %v", elapsed)
+	}
+	if restarts, lastExit := procArgs.Exit(); restarts != 2 || lastExit != "exit status 3" {
+		t.Errorf("Exit() = %d, %q, want 2, %q", restarts, lastExit, "exit status 3")
+	}
+	if h.ctrl.Get("/user/cam") != nil {
+		t.Error("stopped process is still in controller")
+	}
+	h.notifyWg.Wait()
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("onerror is called %d times, want 2", n)
+	}
+}
+
+func TestRunFFMPEGNoRunner(t *testing.T) {
+	h := testStreamHandler(t, 1, 0)
+	var hits int32
+	proc, procArgs := testRunFFMPEG(t, h, "removed", "sh -c \"exit 3\"", &hits)
+
+	// без шаблона процесс завершается сразу, не дожидаясь -restartMin
+	select {
+	case <-proc.Done():
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("process without template is restarted")
+	}
+	if state := proc.State(); state != StateFailed {
+		t.Errorf("process without template is %s, want %s", state, StateFailed)
+	}
+	if restarts, _ := procArgs.Exit(); restarts != 0 {
+		t.Errorf("process without template is restarted %d times", restarts)
+	}
+}
@@ -0,0 +1,65 @@
+package localffmpeg
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// BackoffFactor multiplier of restart delay after each crash
+	BackoffFactor float64 = 2
+	// BackoffJitter part of restart delay which is random
+	BackoffJitter float64 = 0.2
+)
+
+// ErrStalled is reason of restart when ffmpeg is alive but segments don't arrive
+var ErrStalled = errors.New("stalled")
+
+// Backoff describe exponential delay with jitter between ffmpeg restarts
+type Backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	Factor  float64
+	Jitter  float64
+	attempt int
+	rnd     *rand.Rand
+	mut     *sync.Mutex
+}
+
+// NewBackoff build Backoff with default factor and jitter
+func NewBackoff(min time.Duration, max time.Duration) *Backoff {
+	if max < min {
+		max = min
+	}
+	res := Backoff{Min: min, Max: max, Factor: BackoffFactor, Jitter: BackoffJitter, rnd: rand.New(rand.NewSource(time.Now().UnixNano())), mut: new(sync.Mutex)}
+	return &res
+}
+
+// Next return delay before next restart and increase attempt counter
+func (b *Backoff) Next() time.Duration {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	delay := float64(b.Min)
+	for i := 0; i < b.attempt && delay < float64(b.Max); i++ {
+		delay *= b.Factor
+	}
+	if delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	b.attempt++
+	// jitter в обе стороны, чтобы камеры за одним мостом не перезапускались одновременно
+	delay += delay * b.Jitter * (b.rnd.Float64()*2 - 1)
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay)
+}
+
+// Reset drop attempt counter, it is called when process worked long enough
+func (b *Backoff) Reset() {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.attempt = 0
+}
@@ -0,0 +1,42 @@
+package localffmpeg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(time.Second, 8*time.Second)
+	b.Jitter = 0
+	want := []time.Duration{1, 2, 4, 8, 8, 8}
+	for i, w := range want {
+		if delay := b.Next(); delay != w*time.Second {
+			t.Errorf("attempt %d: delay %v, want %v", i, delay, w*time.Second)
+		}
+	}
+	b.Reset()
+	if delay := b.Next(); delay != time.Second {
+		t.Errorf("delay after reset %v, want %v", delay, time.Second)
+	}
+}
+
+func TestBackoffMaxLessMin(t *testing.T) {
+	b := NewBackoff(5*time.Second, time.Second)
+	b.Jitter = 0
+	for i := 0; i < 3; i++ {
+		if delay := b.Next(); delay != 5*time.Second {
+			t.Errorf("attempt %d: delay %v, want %v", i, delay, 5*time.Second)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := NewBackoff(time.Second, time.Minute)
+	for i := 0; i < 100; i++ {
+		b.Reset()
+		delay := b.Next()
+		if delay < 800*time.Millisecond || delay > 1200*time.Millisecond {
+			t.Fatalf("delay %v is out of min +-%v%%", delay, BackoffJitter*100)
+		}
+	}
+}
@@ -34,8 +34,9 @@ func (l *BuffLog) messHandler(mess zapcore.Entry) {
 	}
 }
 
-func handler(l *BuffLog) {
-	for mess := range l.messages {
+// handler read channel passed at start: Close sets l.messages to nil under mutex
+func handler(l *BuffLog, messages <-chan zapcore.Entry) {
+	for mess := range messages {
 		l.messHandler(mess)
 	}
 }
@@ -61,7 +62,7 @@ func NewBuffLog(logger *zap.Logger, capacity int) *BuffLog {
 	res.mut = sync.Mutex{}
 	res.messages = make(chan zapcore.Entry, capacity)
 	res.subscribers = make([]chan<- zapcore.Entry, 0)
-	go handler(res)
+	go handler(res, res.messages)
 	res.Log = logger.WithOptions(zap.Hooks(func(entry zapcore.Entry) error {
 		res.mut.Lock()
 		defer res.mut.Unlock()
@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -22,10 +23,10 @@ type NotificationData struct {
 
 // Notification struct for describe notification server
 type Notification struct {
-	URL     string `json:"url,omitempty"`
-	Key     string `json:"key,omitempty"`
-	Value   string `json:"value,omitempty"`
-	Channel chan *NotificationData
+	URL     string                 `json:"url,omitempty"`
+	Key     string                 `json:"key,omitempty"`
+	Value   string                 `json:"value,omitempty"`
+	Channel chan *NotificationData `json:"-"`
 }
 
 func buildClient() *http.Client {
@@ -134,4 +135,21 @@ func (w *Webhook) Notify(log *zap.Logger) {
 	log.Sugar().Warnf("stop webhook for url %s", w.URL)
 }
 
+// NotifyReason call webhook with reason in query, it is used for onerror webhooks
+func (w *Webhook) NotifyReason(log *zap.Logger, reason string) {
+	addr, errParse := url.Parse(w.URL)
+	if errParse != nil {
+		log.Sugar().Errorf("error webhook for url %s", errParse.Error())
+		return
+	}
+	query := addr.Query()
+	query.Set("reason", reason)
+	addr.RawQuery = query.Encode()
+	log.Sugar().Warnf("start webhook for url %s", addr.String())
+	if _, err := http.Get(addr.String()); err != nil {
+		log.Sugar().Errorf("error webhook for url %s", err.Error())
+	}
+	log.Sugar().Warnf("stop webhook for url %s", addr.String())
+}
+
 type Webhooks []*Webhook
@@ -0,0 +1,254 @@
+package localproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"camctl/local/localconf"
+)
+
+// dvrSegment describe segment of media playlist in timeshift window
+type dvrSegment struct {
+	msn      int64
+	lines    []string // теги сегмента и его uri
+	duration float64
+}
+
+// dvrStream describe timeshift window of stream
+type dvrStream struct {
+	mut       *sync.Mutex
+	depth     time.Duration
+	dir       string                  // каталог для сегментов, вытесненных из памяти
+	playlists map[string][]dvrSegment // окно сегментов по ключу media плейлиста
+}
+
+// DVRStats describe timeshift window of stream
+type DVRStats struct {
+	Depth   float64 `json:"depth"` // секунды
+	Spilled int     `json:"spilled"`
+	Disk    int64   `json:"disk"` // байт на диске
+}
+
+// SetTimeshift keep segments of stream name for depth, zero depth is only live
+func (f *Items) SetTimeshift(name string, depth time.Duration) {
+	if depth <= 0 {
+		f.DelTimeshift(name)
+		return
+	}
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	if find, isFind := f.dvr[name]; isFind {
+		find.mut.Lock()
+		find.depth = depth
+		find.mut.Unlock()
+		return
+	}
+	f.dvr[name] = &dvrStream{mut: new(sync.Mutex), depth: depth, dir: filepath.Join(*f.conf.DVRDir, name), playlists: make(map[string][]dvrSegment)}
+}
+
+// DelTimeshift forget timeshift window of stream name and remove its segments from disk
+func (f *Items) DelTimeshift(name string) {
+	f.fileMut.Lock()
+	find, isFind := f.dvr[name]
+	delete(f.dvr, name)
+	f.fileMut.Unlock()
+	if isFind {
+		os.RemoveAll(find.dir)
+	}
+}
+
+// Timeshift return timeshift depth of stream name, 0 if stream is only live
+func (f *Items) Timeshift(name string) time.Duration {
+	f.fileMut.RLock()
+	defer f.fileMut.RUnlock()
+	return f.timeshift(name)
+}
+
+// timeshift is called under lock
+func (f *Items) timeshift(name string) time.Duration {
+	find, isFind := f.dvr[name]
+	if !isFind {
+		return 0
+	}
+	find.mut.Lock()
+	defer find.mut.Unlock()
+	return find.depth
+}
+
+// DVRStats return state of timeshift window of stream name, false if stream is only live
+func (f *Items) DVRStats(name string) (DVRStats, bool) {
+	f.fileMut.RLock()
+	defer f.fileMut.RUnlock()
+	depth := f.timeshift(name)
+	if depth == 0 {
+		return DVRStats{}, false
+	}
+	res := DVRStats{Depth: depth.Seconds()}
+	f.items.each(func(key string, find *itemCond) {
+		if item := find.item(); item != nil && len(item.file) > 0 && filepath.Dir(key) == name {
+			res.Spilled++
+			res.Disk += item.fileSize
+		}
+	})
+	return res, true
+}
+
+// isDVRSegment return true for media segment of stream with timeshift, ffmpeg DELETE of such segment is ignored
+func (f *Items) isDVRSegment(key string) bool {
+	if !strings.Contains(key, ".") || strings.Contains(key, localconf.InitSegmentName) || strings.HasSuffix(key, ".mpd") || strings.HasSuffix(key, ".m3u8") {
+		return false
+	}
+	return f.Timeshift(filepath.Dir(key)) > 0
+}
+
+// dvrRule return rule for MPD with depth of timeshift
+func dvrRule(depth time.Duration) localconf.ManifestRule {
+	return localconf.ManifestRule{Op: localconf.RuleSetAttr, Path: "//MPD", Name: "timeShiftBufferDepth", Value: fmt.Sprintf("PT%dS", int(depth.Seconds()))}
+}
+
+// dvrPlaylist add segments of media playlist from ffmpeg to timeshift window and return playlist with whole window
+func (f *Items) dvrPlaylist(key string, data []byte) []byte {
+	f.fileMut.RLock()
+	dvr, isFind := f.dvr[filepath.Dir(key)]
+	f.fileMut.RUnlock()
+	if !isFind {
+		return data
+	}
+	lines := splitLines(data)
+	bounds := hlsSegments(lines)
+	if len(bounds) == 0 {
+		return data
+	}
+	playlist := parseHLS(data)
+
+	dvr.mut.Lock()
+	defer dvr.mut.Unlock()
+	window := dvr.playlists[key]
+	last := int64(-1)
+	if len(window) > 0 {
+		last = window[len(window)-1].msn
+	}
+	if playlist.mediaSequence+int64(len(bounds))-1 < last {
+		// номера пошли заново - ffmpeg перезапущен и переписывает сегменты с теми же именами
+		window = nil
+		last = -1
+	}
+	for i, b := range bounds {
+		msn := playlist.mediaSequence + int64(i)
+		if msn <= last {
+			continue
+		}
+		segment := dvrSegment{msn: msn, lines: append([]string(nil), lines[b.begin:b.end+1]...), duration: b.duration}
+		window = append(window, segment)
+	}
+	total := 0.0
+	for _, s := range window {
+		total += s.duration
+	}
+	for len(window) > 1 && total-window[0].duration >= dvr.depth.Seconds() {
+		total -= window[0].duration
+		window = window[1:]
+	}
+	dvr.playlists[key] = window
+
+	res := make([]string, 0, len(lines)+len(window)*3)
+	for _, line := range lines[:bounds[0].begin] {
+		if strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:") {
+			line = fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d", window[0].msn)
+		}
+		res = append(res, line)
+	}
+	for _, s := range window {
+		res = append(res, s.lines...)
+	}
+	res = append(res, lines[bounds[len(bounds)-1].end+1:]...)
+	return joinLines(res)
+}
+
+// spill move oldest segments of stream with timeshift from memory to disk while stream is over -dvrCacheSize
+func (f *Items) spill(name string) {
+	type candidate struct {
+		key  string
+		item *Item
+	}
+	f.fileMut.RLock()
+	dvr, isFind := f.dvr[name]
+	over := f.streamBytes[name] - f.dvrMaxBytes
+	if !isFind || f.dvrMaxBytes <= 0 || over <= 0 {
+		f.fileMut.RUnlock()
+		return
+	}
+	// после перезапуска ffmpeg имена сегментов повторяются, а файлы прежнего запуска еще в окне
+	generation := uint64(0)
+	if g, isFind := f.generations[name]; isFind {
+		generation = g.current
+	}
+	candidates := make([]candidate, 0)
+	f.items.each(func(key string, find *itemCond) {
+		item := find.item()
+		if item == nil || item.pinned || item.partial != nil || len(item.file) > 0 || filepath.Dir(key) != name {
+			return
+		}
+		candidates = append(candidates, candidate{key, item})
+	})
+	f.fileMut.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].item.created.Before(candidates[j].item.created) })
+
+	if errDir := os.MkdirAll(dvr.dir, os.ModePerm); errDir != nil {
+		f.log.Sugar().Errorf("timeshift dir %s: %s", dvr.dir, errDir.Error())
+		return
+	}
+	for _, c := range candidates {
+		if over <= 0 {
+			break
+		}
+		// пишем без блокировки, сегмент в кеше не меняется - при перезаписи новый Item со своим файлом
+		path := filepath.Join(dvr.dir, fmt.Sprintf("%d-%x-%s", generation, c.item.created.UnixNano(), filepath.Base(c.key)))
+		if errWrite := ioutil.WriteFile(path, c.item.data, 0644); errWrite != nil {
+			f.log.Sugar().Errorf("timeshift spill %s: %s", c.key, errWrite.Error())
+			return
+		}
+		spilled := *c.item
+		spilled.data = nil
+		spilled.file = path
+		spilled.fileSize = int64(len(c.item.data))
+
+		f.fileMut.Lock()
+		find, isFind := f.items.load(c.key)
+		if isFind && find.item() == c.item {
+			find.swap(&spilled)
+			f.account(c.key, c.item, &spilled)
+			over -= spilled.fileSize
+		} else {
+			os.Remove(path)
+		}
+		f.fileMut.Unlock()
+	}
+}
+
+// serveFile serve segment of timeshift from disk
+func (f *Items) serveFile(c *gin.Context, key string, item *Item) {
+	file, errOpen := os.Open(item.file)
+	if errOpen != nil {
+		f.log.Sugar().Errorf("timeshift open %s: %s", item.file, errOpen.Error())
+		Error(c, "no content", http.StatusNoContent)
+		return
+	}
+	defer file.Close()
+	header := c.Writer.Header()
+	header.Set("Date", item.created.UTC().Format(http.TimeFormat))
+	header.Set("ETag", item.ETag())
+	if len(item.contentType) > 0 {
+		header.Set("Content-Type", item.contentType)
+	}
+	http.ServeContent(c.Writer, c.Request, filepath.Base(key), item.created, file)
+}
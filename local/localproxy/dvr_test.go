@@ -0,0 +1,64 @@
+package localproxy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// checkSpilled compare files of timeshift dir with spilled items of cache
+func checkSpilled(t *testing.T, f *Items, name string) int {
+	t.Helper()
+	files := make(map[string]bool)
+	f.fileMut.RLock()
+	f.items.each(func(key string, find *itemCond) {
+		if item := find.item(); item != nil && len(item.file) > 0 {
+			files[item.file] = true
+		}
+	})
+	dir := f.dvr[name].dir
+	f.fileMut.RUnlock()
+	infos, _ := ioutil.ReadDir(dir)
+	for _, info := range infos {
+		if path := filepath.Join(dir, info.Name()); !files[path] {
+			t.Errorf("file %s isn't used by cache", path)
+		}
+		delete(files, filepath.Join(dir, info.Name()))
+	}
+	for path := range files {
+		t.Errorf("file %s of cache isn't found", path)
+	}
+	return len(infos)
+}
+
+func TestDVRSpillRestart(t *testing.T) {
+	f := newTestItems(t, time.Millisecond)
+	f.dvrMaxBytes = 100
+	f.SetTimeshift("/user/cam", time.Hour)
+	f.Add("/user/cam/chunk-stream0-00001.m4s", make([]byte, 80), "video/mp4")
+	f.Add("/user/cam/chunk-stream0-00002.m4s", make([]byte, 80), "video/mp4")
+	f.Add("/user/cam/chunk-stream0-00003.m4s", make([]byte, 80), "video/mp4")
+	if n := checkSpilled(t, f, "/user/cam"); n != 2 {
+		t.Fatalf("%d segments are spilled, want 2", n)
+	}
+	old := f.peek("/user/cam/chunk-stream0-00001.m4s").file
+
+	// перезапуск ffmpeg: номера сегментов пошли заново
+	f.NewGeneration("/user/cam")
+	f.Add("/user/cam/chunk-stream0-00001.m4s", make([]byte, 80), "video/mp4")
+	f.Add("/user/cam/media_0.m3u8", []byte("#EXTM3U\n"), "application/vnd.apple.mpegurl")
+	checkSpilled(t, f, "/user/cam")
+	f.Add("/user/cam/chunk-stream0-00002.m4s", make([]byte, 80), "video/mp4")
+	f.Add("/user/cam/chunk-stream0-00003.m4s", make([]byte, 80), "video/mp4")
+	if n := checkSpilled(t, f, "/user/cam"); n != 2 {
+		t.Errorf("%d segments of new run are spilled, want 2", n)
+	}
+	if item := f.peek("/user/cam/chunk-stream0-00001.m4s"); item == nil || item.file == old {
+		t.Errorf("segment of new run is spilled to file of previous run %s", old)
+	}
+
+	// замена сегмента тем же ключом убирает его файл
+	f.Add("/user/cam/chunk-stream0-00001.m4s", make([]byte, 10), "video/mp4")
+	checkSpilled(t, f, "/user/cam")
+}
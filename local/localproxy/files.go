@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -21,6 +23,7 @@ type Files struct {
 	conf    *localconf.Config
 	timeout time.Duration // общий
 	worked  *int32
+	closed  chan struct{}
 }
 
 func cleanFS(dir string, timeout time.Duration) (int, error) {
@@ -61,20 +64,25 @@ func (f *Files) clean() {
 		if err != nil {
 			f.log.Sugar().Errorf("Files.Clean error %s\n", err.Error())
 		}
-		time.Sleep(f.timeout / 10)
+		select {
+		case <-time.After(f.timeout / 10):
+		case <-f.closed:
+		}
 	}
 }
 
 // NewItems create Items
 func NewFiles(wg *sync.WaitGroup, logger *zap.Logger, config *localconf.Config, timeout time.Duration) *Files {
-	res := &Files{wg, logger, config, timeout, new(int32)}
+	res := &Files{wg, logger, config, timeout, new(int32), make(chan struct{})}
 	atomic.StoreInt32(res.worked, 1)
 	go res.clean() // тут удаляются старые файлы
 	return res
 }
 
 func (f *Files) Close() {
-	atomic.StoreInt32(f.worked, 0)
+	if atomic.SwapInt32(f.worked, 0) != 0 {
+		close(f.closed)
+	}
 }
 
 func KeyFS(dir string, base string) []Key {
@@ -102,7 +110,7 @@ func KeyFS(dir string, base string) []Key {
 			}
 		} else {
 			path := dir + "/" + f.Name()
-			res = append(res, Key{strings.Replace(path, base, "", 1), f.ModTime()})
+			res = append(res, Key{Key: strings.Replace(path, base, "", 1), Created: f.ModTime(), Size: f.Size()})
 		}
 	}
 	return res
@@ -130,10 +138,22 @@ func infoFS(dir string, base string) []string {
 
 func (h *Files) ServeHTTP(c *gin.Context) {
 	if strings.HasPrefix(c.Request.URL.Path, "/allhistory") {
-		key := c.Request.URL.Path[11:]
+		key := strings.TrimSuffix(c.Request.URL.Path[11:], "/")
+		if errName := localconf.CheckName(key); len(key) > 0 && errName != nil {
+			c.JSON(http.StatusBadRequest, Response{Errno: BadName, Error: errName.Error()})
+			return
+		}
 		res := infoFS(*h.conf.StoreDir+key, *h.conf.StoreDir)
+		depth, _ := strconv.Atoi(c.Query("depth"))
 		if res == nil {
 			c.JSON(http.StatusNotFound, Response{Errno: NotFound, Error: "directory not found"})
+		} else if depth > 0 {
+			// число файлов по первым depth частям имени записи
+			groups := make(map[string]int)
+			for _, file := range res {
+				groups[localconf.GroupName(filepath.Dir(file), depth)]++
+			}
+			c.JSON(http.StatusOK, Response{Errno: OK, Error: "ok", Data: groups})
 		} else {
 			c.JSON(http.StatusOK, Response{Errno: OK, Error: "ok", Data: res})
 		}
@@ -0,0 +1,154 @@
+package localproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// generation describe runs of ffmpeg for stream: segments of new run are hidden until its first manifest
+type generation struct {
+	current uint64           // run, которую отдает /get
+	pending uint64           // новый запуск без манифеста, 0 - нет
+	staged  map[string]*Item // init и сегменты нового запуска до его первого манифеста
+}
+
+// GenerationStats describe generations of stream for response
+type GenerationStats struct {
+	Current uint64 `json:"current"`
+	Pending uint64 `json:"pending,omitempty"`
+	Staged  int    `json:"staged,omitempty"`
+}
+
+// NewGeneration start new run of ffmpeg for stream name and return its id. Until the run publishes
+// first manifest, /get serves previous run, then segments of previous run are dropped at once
+func (f *Items) NewGeneration(name string) uint64 {
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	f.generationID++
+	g, isFind := f.generations[name]
+	if !isFind {
+		g = &generation{}
+		f.generations[name] = g
+	}
+	// запуск без манифеста так и не стал текущим, его сегменты никто не видел
+	f.purge(g)
+	g.pending = f.generationID
+	g.staged = make(map[string]*Item)
+	f.log.Sugar().Infof("stream %s generation %d", name, g.pending)
+	return g.pending
+}
+
+// DelGeneration forget generations of stream name if id is its last run, new run of stream isn't touched
+func (f *Items) DelGeneration(name string, id uint64) {
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	g, isFind := f.generations[name]
+	if isFind && (g.pending == id || g.pending == 0 && g.current == id) {
+		f.purge(g)
+		delete(f.generations, name)
+	}
+}
+
+// purge drop staged segments of pending run, it is called under fileMut
+func (f *Items) purge(g *generation) {
+	for key, item := range g.staged {
+		f.account(key, item, nil)
+	}
+	g.staged = nil
+}
+
+// unstage delete staged segment by key, it is called under fileMut
+func (f *Items) unstage(key string) (*Item, bool) {
+	g := f.staging(filepath.Dir(key))
+	if g == nil {
+		return nil, false
+	}
+	item, isStaged := g.staged[key]
+	if isStaged {
+		delete(g.staged, key)
+		f.account(key, item, nil)
+	}
+	return item, isStaged
+}
+
+// cleanStaged delete staged segments older than their timeout: run which doesn't publish manifest
+// must not hold memory, it is called under fileMut
+func (f *Items) cleanStaged(now time.Time) int {
+	res := 0
+	for _, g := range f.generations {
+		for key, item := range g.staged {
+			if now.Sub(item.created) > item.timeout {
+				delete(g.staged, key)
+				f.account(key, item, nil)
+				f.log.Sugar().Warnf("Items.Clean staged key %s", key)
+				res++
+			}
+		}
+	}
+	return res
+}
+
+// Generation return generations of stream name, false if stream has no runs
+func (f *Items) Generation(name string) (GenerationStats, bool) {
+	f.fileMut.RLock()
+	defer f.fileMut.RUnlock()
+	g, isFind := f.generations[name]
+	if !isFind {
+		return GenerationStats{}, false
+	}
+	return GenerationStats{Current: g.current, Pending: g.pending, Staged: len(g.staged)}, true
+}
+
+// staging return pending generation of stream dir, it is called under fileMut
+func (f *Items) staging(dir string) *generation {
+	g, isFind := f.generations[dir]
+	if !isFind || g.pending == 0 {
+		return nil
+	}
+	return g
+}
+
+// isStaging return true if segments of stream dir are hidden until first manifest
+func (f *Items) isStaging(dir string) bool {
+	f.fileMut.RLock()
+	defer f.fileMut.RUnlock()
+	return f.staging(dir) != nil
+}
+
+// stage read whole segment of new run and keep it until first manifest, it replaces Upload while run is pending
+func (f *Items) stage(key string, body io.Reader, contentType string) ([]byte, *Item, error) {
+	data, errRead := ioutil.ReadAll(body)
+	if errRead != nil {
+		return nil, nil, errRead
+	}
+	return data, f.Add(key, data, contentType), nil
+}
+
+// publish make pending generation of stream dir current: keys of previous run are dropped
+// and staged segments appear on /get under one lock, it is called under fileMut
+func (f *Items) publish(dir string, g *generation) {
+	drop := make([]string, 0)
+	f.items.each(func(key string, find *itemCond) {
+		if filepath.Dir(key) != dir || find.item() == nil {
+			// ключи без данных - это клиенты, которые ждут сегменты нового запуска
+			return
+		}
+		if _, isFind := g.staged[key]; !isFind {
+			drop = append(drop, key)
+		}
+	})
+	for _, key := range drop {
+		f.remove(key)
+	}
+	for key, item := range g.staged {
+		// размер staged сегмента уже учтен, уходит только прежний
+		old := f.replace(key, item)
+		f.account(key, old, nil)
+	}
+	f.log.Sugar().Infof("stream %s generation %d is published, %d keys of generation %d dropped, %d staged", dir, g.pending, len(drop), g.current, len(g.staged))
+	g.current = g.pending
+	g.pending = 0
+	g.staged = nil
+}
@@ -0,0 +1,104 @@
+package localproxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerationPublish(t *testing.T) {
+	f := newTestItems(t, time.Millisecond)
+	f.Add("/user/cam/init-stream0.m4s", []byte("old init"), "video/mp4")
+	f.Add("/user/cam/chunk-stream0-00001.m4s", make([]byte, 100), "video/mp4")
+
+	id := f.NewGeneration("/user/cam")
+	f.Add("/user/cam/init-stream0.m4s", []byte("new init"), "video/mp4")
+	f.Add("/user/cam/chunk-stream0-00001.m4s", make([]byte, 10), "video/mp4")
+	if item := f.peek("/user/cam/init-stream0.m4s"); item == nil || string(item.data) != "old init" {
+		t.Fatal("staged init is served before manifest")
+	}
+	if stats := f.Stats("/user/cam"); stats.Bytes != 8+100+8+10 {
+		t.Errorf("bytes with staged %d, want %d", stats.Bytes, 8+100+8+10)
+	}
+
+	f.Add("/user/cam/media_0.m3u8", []byte("#EXTM3U\n"), "application/vnd.apple.mpegurl")
+	if item := f.peek("/user/cam/init-stream0.m4s"); item == nil || string(item.data) != "new init" {
+		t.Fatal("staged init isn't published by manifest")
+	}
+	if stats := f.Stats("/user/cam"); stats.Bytes != 8+10+8 || stats.Bytes != f.bytes {
+		t.Errorf("bytes after publish %d, cache %d, want %d", stats.Bytes, f.bytes, 8+10+8)
+	}
+	if g, _ := f.Generation("/user/cam"); g.Current != id || g.Pending != 0 || g.Staged != 0 {
+		t.Errorf("generation after publish %+v", g)
+	}
+}
+
+func TestGenerationPurge(t *testing.T) {
+	f := newTestItems(t, time.Millisecond)
+	f.Add("/user/cam/chunk-stream0-00001.m4s", make([]byte, 100), "video/mp4")
+
+	f.NewGeneration("/user/cam")
+	f.Add("/user/cam/chunk-stream0-00001.m4s", make([]byte, 10), "video/mp4")
+	f.Add("/user/cam/chunk-stream0-00002.m4s", make([]byte, 10), "video/mp4")
+	// перезапуск без манифеста: его сегменты никто не видел
+	id := f.NewGeneration("/user/cam")
+	if f.bytes != 100 {
+		t.Errorf("bytes after new run %d, want 100", f.bytes)
+	}
+	f.Add("/user/cam/chunk-stream0-00001.m4s", make([]byte, 10), "video/mp4")
+	f.DelGeneration("/user/cam", id)
+	if f.bytes != 100 {
+		t.Errorf("bytes after stop %d, want 100", f.bytes)
+	}
+	if _, isFind := f.Generation("/user/cam"); isFind {
+		t.Error("generation isn't deleted")
+	}
+}
+
+func TestGenerationEvictStaged(t *testing.T) {
+	f := newTestItems(t, time.Millisecond)
+	f.maxStreamBytes = 100
+	f.NewGeneration("/user/cam")
+	for _, key := range []string{"/user/cam/chunk-stream0-00001.m4s", "/user/cam/chunk-stream0-00002.m4s", "/user/cam/chunk-stream0-00003.m4s"} {
+		f.Add(key, make([]byte, 40), "video/mp4")
+		time.Sleep(time.Millisecond)
+	}
+	g, _ := f.Generation("/user/cam")
+	if g.Staged != 2 || f.bytes != 80 {
+		t.Errorf("staged %d, bytes %d, want 2 and 80", g.Staged, f.bytes)
+	}
+
+	// run без манифеста не держит память дольше таймаута сегмента
+	f.fileMut.Lock()
+	n := f.cleanStaged(time.Now().Add(2 * f.timeout))
+	f.fileMut.Unlock()
+	if n != 2 || f.bytes != 0 {
+		t.Errorf("cleaned %d, bytes %d, want 2 and 0", n, f.bytes)
+	}
+}
+
+func TestGenerationMasterUpdate(t *testing.T) {
+	f := newTestItems(t, time.Millisecond)
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nmedia_0.m3u8\n"
+	f.Add("/user/cam/init-stream0.m4s", testInit(), "video/mp4")
+	f.Add("/user/cam/master.m3u8", []byte(master), "application/vnd.apple.mpegurl")
+	f.Add("/user/cam/media_0.m3u8", []byte(testPlaylist), "application/vnd.apple.mpegurl")
+	f.Add("/user/cam/chunk-stream0-00010.m4s", testSegment(4, 6), "video/mp4")
+	if item := f.peek("/user/cam/master.m3u8"); item == nil || !strings.Contains(string(item.data), "FRAME-RATE=25") {
+		t.Fatalf("master isn't updated by segment: %v", item)
+	}
+
+	// перезапуск ffmpeg: битрейт нового запуска вырос больше чем на 20%
+	f.NewGeneration("/user/cam")
+	f.Add("/user/cam/init-stream0.m4s", testInit(), "video/mp4")
+	f.Add("/user/cam/chunk-stream0-00001.m4s", testSegment(4, 1), "video/mp4")
+	if f.peek("/user/cam/media_0.m3u8") == nil || f.peek("/user/cam/chunk-stream0-00010.m4s") == nil {
+		t.Error("previous run is dropped before manifest of new run")
+	}
+	if f.peek("/user/cam/chunk-stream0-00001.m4s") != nil {
+		t.Error("segment of new run is served before its manifest")
+	}
+	if g, _ := f.Generation("/user/cam"); g.Pending == 0 || g.Staged != 2 {
+		t.Errorf("generation after staged segments %+v", g)
+	}
+}
@@ -0,0 +1,444 @@
+package localproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"camctl/local/localconf"
+)
+
+const (
+	// PartSegments - number of last segments of media playlist with EXT-X-PART, parts of older segments are dropped
+	PartSegments int = 3
+)
+
+// hlsPlaylist describe state of media playlist for LL-HLS delivery directives
+type hlsPlaylist struct {
+	mediaSequence int64
+	segments      int64   // полных сегментов в плейлисте
+	parts         int64   // частей следующего сегмента после последнего полного
+	target        float64 // EXT-X-TARGETDURATION
+	canSkipUntil  float64 // CAN-SKIP-UNTIL из EXT-X-SERVER-CONTROL, 0 - skip не поддерживается
+}
+
+// lastMsn return media sequence number of the last full segment
+func (p *hlsPlaylist) lastMsn() int64 {
+	return p.mediaSequence + p.segments - 1
+}
+
+// has return true if playlist contains segment msn or part of segment msn
+func (p *hlsPlaylist) has(msn int64, part int64) bool {
+	if msn <= p.lastMsn() {
+		return true
+	}
+	return msn == p.lastMsn()+1 && part >= 0 && part < p.parts
+}
+
+func isMediaPlaylist(key string) bool {
+	return strings.HasSuffix(key, ".m3u8") && !strings.HasSuffix(key, "master.m3u8")
+}
+
+func splitLines(data []byte) []string {
+	scaner := bufio.NewScanner(bytes.NewReader(data))
+	res := make([]string, 0)
+	for scaner.Scan() {
+		res = append(res, scaner.Text())
+	}
+	return res
+}
+
+func joinLines(lines []string) []byte {
+	var res bytes.Buffer
+	for _, line := range lines {
+		res.WriteString(line)
+		res.WriteString("\n")
+	}
+	return res.Bytes()
+}
+
+// parseDuration parse "#EXTINF:1.000," or "#EXT-X-TARGETDURATION:1"
+func parseDuration(line string) float64 {
+	str := line[strings.Index(line, ":")+1:]
+	if end := strings.Index(str, ","); end != -1 {
+		str = str[:end]
+	}
+	res, _ := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	return res
+}
+
+func parseHLS(data []byte) hlsPlaylist {
+	res := hlsPlaylist{}
+	for _, line := range splitLines(data) {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			res.mediaSequence, _ = strconv.ParseInt(strings.TrimSpace(line[22:]), 10, 64)
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			res.target = parseDuration(line)
+		case strings.HasPrefix(line, "#EXT-X-SERVER-CONTROL:"):
+			res.canSkipUntil, _ = strconv.ParseFloat(fingKeyGetVal(strings.Split(line[22:], ","), "CAN-SKIP-UNTIL"), 64)
+		case strings.HasPrefix(line, "#EXTINF:"):
+			// части перед EXTINF относятся к уже полному сегменту
+			res.segments++
+			res.parts = 0
+		case strings.HasPrefix(line, "#EXT-X-PART:"):
+			res.parts++
+		}
+	}
+	return res
+}
+
+/*
+ffmpeg с -lhls 1 пишет только #EXT-X-PREFETCH. Для LL-HLS добавляем EXT-X-SERVER-CONTROL с блокирующей перезагрузкой,
+а части сегментов расставляет llhlsParts при отдаче плейлиста - они меняются чаще, чем ffmpeg переписывает плейлист
+*/
+func llhlsProcessing(data []byte) []byte {
+	lines := splitLines(data)
+	hasControl := false
+	target := 0.0
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-SERVER-CONTROL:"):
+			hasControl = true
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			target = parseDuration(line)
+		}
+	}
+	if target == 0 {
+		// это не media плейлист
+		return data
+	}
+
+	res := make([]string, 0, len(lines)+1)
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-VERSION:"):
+			// EXT-X-SKIP требует версию 9
+			if version, _ := strconv.Atoi(strings.TrimSpace(line[15:])); version < 9 {
+				line = "#EXT-X-VERSION:9"
+			}
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			res = append(res, line)
+			if !hasControl {
+				res = append(res, fmt.Sprintf("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=%.1f", 6*target))
+			}
+			continue
+		}
+		res = append(res, line)
+	}
+	return joinLines(res)
+}
+
+// segmentParts return complete parts of media segment key and part target of its track, no parts if track isn't known yet
+func (f *Items) segmentParts(key string, data []byte) ([]mp4Part, float64) {
+	channel := parseNumberAfter(key, localconf.ChunkSegmentName)
+	f.fileMut.RLock()
+	track, isFind := f.tracks[filepath.Dir(key)][channel]
+	if !isFind {
+		f.fileMut.RUnlock()
+		return nil, 0
+	}
+	timescale, duration, partTarget := track.timescale, track.duration, track.partTarget
+	f.fileMut.RUnlock()
+	return parseParts(data, timescale, duration), partTarget
+}
+
+// uploaded return data of segment which can be still uploaded, it is done and channel which is closed on next change
+func (i *Item) uploaded() ([]byte, bool, <-chan struct{}) {
+	if i.partial == nil {
+		return i.data, true, nil
+	}
+	data, done, _, changed := i.partial.from(0)
+	return data, done, changed
+}
+
+func partLine(uri string, n int, part mp4Part) string {
+	res := fmt.Sprintf("#EXT-X-PART:DURATION=%.3f,URI=\"%s?part=%d\"", part.duration, uri, n)
+	if part.independent {
+		res += ",INDEPENDENT=YES"
+	}
+	return res
+}
+
+/*
+llhlsParts add EXT-X-PART of last PartSegments segments and of segment which ffmpeg uploads now (its EXT-X-PREFETCH),
+part is CMAF chunk of segment (-frag_duration ffmpeg) and it is served by /get of segment with ?part=N.
+Parts aren't added if chunks aren't shorter than half of segment - such LL-HLS is as slow as HLS.
+Return playlist and channel which is closed when uploaded segment gets new data
+*/
+func (f *Items) llhlsParts(key string, data []byte) ([]byte, <-chan struct{}) {
+	if bytes.Contains(data, []byte("#EXT-X-PART-INF:")) {
+		// части уже расставил upstream
+		return data, nil
+	}
+	lines := splitLines(data)
+	segments := hlsSegments(lines)
+	dir := filepath.Dir(key)
+	partTarget := 0.0
+	target := 0.0
+	parts := make([][]mp4Part, len(segments))
+	for i := len(segments) - PartSegments; i < len(segments); i++ {
+		if i < 0 {
+			continue
+		}
+		item := f.peek(filepath.Join(dir, lines[segments[i].end]))
+		if item == nil {
+			continue
+		}
+		segment, _, _ := item.uploaded()
+		var segmentTarget float64
+		parts[i], segmentTarget = f.segmentParts(filepath.Join(dir, lines[segments[i].end]), segment)
+		partTarget = math.Max(partTarget, segmentTarget)
+	}
+
+	prefetch := ""
+	var prefetchParts []mp4Part
+	var changed <-chan struct{}
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			target = parseDuration(line)
+		case strings.HasPrefix(line, "#EXT-X-PREFETCH:"):
+			prefetch = strings.TrimSpace(line[16:])
+		}
+	}
+	if len(prefetch) > 0 {
+		if item := f.peek(filepath.Join(dir, prefetch)); item != nil {
+			segment, _, itemChanged := item.uploaded()
+			var segmentTarget float64
+			prefetchParts, segmentTarget = f.segmentParts(filepath.Join(dir, prefetch), segment)
+			partTarget = math.Max(partTarget, segmentTarget)
+			changed = itemChanged
+		}
+	}
+	for _, list := range append(parts, prefetchParts) {
+		for _, part := range list {
+			partTarget = math.Max(partTarget, part.duration)
+		}
+	}
+	if partTarget == 0 || 2*partTarget > target {
+		return data, nil
+	}
+
+	res := make([]string, 0, len(lines)*2)
+	segment := 0
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			res = append(res, line, fmt.Sprintf("#EXT-X-PART-INF:PART-TARGET=%.3f", partTarget))
+			continue
+		case strings.HasPrefix(line, "#EXT-X-SERVER-CONTROL:") && !strings.Contains(line, "PART-HOLD-BACK="):
+			line += fmt.Sprintf(",PART-HOLD-BACK=%.3f", 3*partTarget)
+		case strings.HasPrefix(line, "#EXTINF:") && segment < len(segments):
+			// части сегмента идут перед его EXTINF
+			for n, part := range parts[segment] {
+				res = append(res, partLine(lines[segments[segment].end], n, part))
+			}
+			segment++
+		case strings.HasPrefix(line, "#EXT-X-PREFETCH:"):
+			for n, part := range prefetchParts {
+				res = append(res, partLine(prefetch, n, part))
+			}
+			line = fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s?part=%d\"", prefetch, len(prefetchParts))
+		}
+		res = append(res, line)
+	}
+	return joinLines(res), changed
+}
+
+// hlsSegment describe lines of one segment in media playlist
+type hlsSegment struct {
+	begin    int // первая строка тегов сегмента
+	end      int // строка с uri
+	duration float64
+}
+
+// hlsSegments find full segments of media playlist, tags after last uri aren't segment
+func hlsSegments(lines []string) []hlsSegment {
+	res := make([]hlsSegment, 0)
+	begin := -1
+	var duration float64
+	for i, line := range lines {
+		if strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:") || strings.HasPrefix(line, "#EXT-X-TARGETDURATION:") {
+			// заголовок плейлиста
+			begin = -1
+			continue
+		}
+		if begin == -1 && (strings.HasPrefix(line, "#EXTINF:") || strings.HasPrefix(line, "#EXT-X-PART:") || strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:")) {
+			begin = i
+		}
+		if strings.HasPrefix(line, "#EXTINF:") {
+			duration = parseDuration(line)
+		}
+		if begin != -1 && len(line) > 0 && !strings.HasPrefix(line, "#") {
+			res = append(res, hlsSegment{begin, i, duration})
+			begin = -1
+		}
+	}
+	return res
+}
+
+// hlsSkip build delta update of playlist: segments older than CAN-SKIP-UNTIL are replaced by EXT-X-SKIP
+func hlsSkip(data []byte, canSkipUntil float64) []byte {
+	lines := splitLines(data)
+	segments := hlsSegments(lines)
+
+	skip := 0
+	fromEnd := 0.0
+	for _, s := range segments {
+		fromEnd += s.duration
+	}
+	for _, s := range segments {
+		if fromEnd <= canSkipUntil {
+			break
+		}
+		fromEnd -= s.duration
+		skip++
+	}
+	if skip == 0 {
+		return data
+	}
+	res := make([]string, 0, len(lines))
+	res = append(res, lines[:segments[0].begin]...)
+	res = append(res, fmt.Sprintf("#EXT-X-SKIP:SKIPPED-SEGMENTS=%d", skip))
+	res = append(res, lines[segments[skip-1].end+1:]...)
+	return joinLines(res)
+}
+
+// Wait return item by key when ready return true for it, false if timeout is over or ctx is done before.
+// Besides change of item ready can return channel which is closed on other change it depends on
+func (f *Items) Wait(ctx context.Context, key string, ready func(item *Item) (bool, <-chan struct{}), timeout time.Duration) (*Item, bool) {
+	if f.Get(key) == nil {
+		return nil, false
+	}
+	find, isFind := f.items.load(key)
+	if !isFind {
+		return nil, false
+	}
+
+	// та же схема, что в Get: Add и Del закрывают канал ключа, а таймаут - дедлайн контекста
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		item, changed := find.load()
+		if item == nil {
+			return nil, false
+		}
+		isReady, other := ready(item)
+		if isReady {
+			return item, true
+		}
+		select {
+		case <-changed:
+		case <-other:
+		case <-ctx.Done():
+			return item, false
+		}
+	}
+}
+
+// servePlaylist serve media playlist with parts and LL-HLS delivery directives _HLS_msn, _HLS_part and _HLS_skip
+func (f *Items) servePlaylist(c *gin.Context, key string) {
+	item := f.getCounted(c.Request.Context(), key)
+	if item == nil {
+		Error(c, "no content", http.StatusNoContent)
+		return
+	}
+	f.touch(key)
+	data, _ := f.llhlsParts(key, item.data)
+	playlist := parseHLS(data)
+
+	if msnStr := c.Query("_HLS_msn"); len(msnStr) > 0 {
+		msn, errMsn := strconv.ParseInt(msnStr, 10, 64)
+		part := int64(-1)
+		if partStr := c.Query("_HLS_part"); len(partStr) > 0 {
+			var errPart error
+			if part, errPart = strconv.ParseInt(partStr, 10, 64); errPart != nil || part < 0 {
+				Error(c, "bad _HLS_part", http.StatusBadRequest)
+				return
+			}
+		}
+		if errMsn != nil || msn < 0 {
+			Error(c, "bad _HLS_msn", http.StatusBadRequest)
+			return
+		}
+		// так требует спецификация: больше чем на 2 сегмента вперед не ждем
+		if msn > playlist.lastMsn()+2 {
+			Error(c, "_HLS_msn is too far", http.StatusBadRequest)
+			return
+		}
+		timeout := time.Duration(3 * playlist.target * float64(time.Second))
+		var ok bool
+		// части загружаемого сегмента появляются без перезаписи плейлиста, поэтому ждем и загрузку сегмента
+		item, ok = f.Wait(c.Request.Context(), key, func(curr *Item) (bool, <-chan struct{}) {
+			var changed <-chan struct{}
+			data, changed = f.llhlsParts(key, curr.data)
+			updated := parseHLS(data)
+			return updated.has(msn, part), changed
+		}, timeout)
+		if item == nil || !ok {
+			Error(c, "playlist isn't updated", http.StatusServiceUnavailable)
+			return
+		}
+		playlist = parseHLS(data)
+	}
+
+	skip := c.Query("_HLS_skip")
+	if (skip == "YES" || skip == "v2") && playlist.canSkipUntil > 0 {
+		data = hlsSkip(data, playlist.canSkipUntil)
+	}
+	contentType := item.contentType
+	if len(contentType) == 0 {
+		contentType = "application/vnd.apple.mpegurl"
+	}
+	// части дописываются в плейлист без его перезаписи, поэтому ETag зависит и от отданного текста
+	header := c.Writer.Header()
+	header.Set("Cache-Control", "no-cache")
+	header.Set("ETag", fmt.Sprintf("\"%x-%x\"", item.created.UnixNano(), crc32.ChecksumIEEE(data)))
+	header.Set("Content-Type", contentType)
+	if len(c.Query("_HLS_msn")) == 0 && len(skip) == 0 {
+		// как остальные ответы /get: 304 по If-None-Match/If-Modified-Since, 206 по Range и без тела на HEAD
+		http.ServeContent(c.Writer, c.Request, filepath.Base(key), item.created, bytes.NewReader(data))
+		return
+	}
+	header.Set("Last-Modified", item.created.UTC().Format(http.TimeFormat))
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// servePart serve part n of media segment key, it waits while the part is uploaded
+func (f *Items) servePart(c *gin.Context, key string, n int) {
+	var parts []mp4Part
+	var data []byte
+	item, ok := f.Wait(c.Request.Context(), key, func(curr *Item) (bool, <-chan struct{}) {
+		var done bool
+		var changed <-chan struct{}
+		data, done, changed = curr.uploaded()
+		parts, _ = f.segmentParts(key, data)
+		return n < len(parts) || done, changed
+	}, f.wait())
+	if item == nil {
+		Error(c, "no content", http.StatusNoContent)
+		return
+	}
+	if !ok {
+		Error(c, "part isn't uploaded", http.StatusServiceUnavailable)
+		return
+	}
+	if n >= len(parts) {
+		Error(c, "part isn't found", http.StatusNotFound)
+		return
+	}
+	f.touch(key)
+	part := parts[n]
+	c.Data(http.StatusOK, item.contentType, data[part.offset:part.offset+part.size])
+}
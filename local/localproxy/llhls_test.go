@@ -0,0 +1,258 @@
+package localproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPlaylist = `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:10
+#EXTINF:0.960,
+chunk-stream0-00010.m4s
+#EXTINF:0.960,
+chunk-stream0-00011.m4s
+#EXTINF:0.960,
+chunk-stream0-00012.m4s
+#EXTINF:0.960,
+chunk-stream0-00013.m4s
+#EXT-X-PREFETCH:chunk-stream0-00014.m4s
+`
+
+func testBox(typ string, data []byte) []byte {
+	res := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(res, uint32(8+len(data)))
+	copy(res[4:], typ)
+	return append(res, data...)
+}
+
+func testFullBox(typ string, flags uint32, fields ...uint32) []byte {
+	data := make([]byte, 4*(len(fields)+1))
+	binary.BigEndian.PutUint32(data, flags)
+	for i, field := range fields {
+		binary.BigEndian.PutUint32(data[4*(i+1):], field)
+	}
+	return testBox(typ, data)
+}
+
+// testInit build init segment of video track with timescale 1000 and sample duration 40
+func testInit() []byte {
+	hdlr := testBox("hdlr", append(append(make([]byte, 8), "vide"...), make([]byte, 14)...))
+	mdhd := testFullBox("mdhd", 0, 0, 0, 1000, 0, 0)
+	entry := make([]byte, 78)
+	binary.BigEndian.PutUint16(entry[24:], 640)
+	binary.BigEndian.PutUint16(entry[26:], 360)
+	stsd := testFullBox("stsd", 0, 1)
+	stsd = append(stsd, testBox("avc1", entry)...)
+	binary.BigEndian.PutUint32(stsd, uint32(len(stsd)))
+	trak := testBox("trak", testBox("mdia", append(append(mdhd, hdlr...), testBox("minf", testBox("stbl", stsd))...)))
+	trex := testFullBox("trex", 0, 1, 1, 40, 0, 0)
+	return append(testBox("ftyp", []byte("iso6")), testBox("moov", append(trak, testBox("mvex", trex)...))...)
+}
+
+// testSegment build media segment of parts chunks, every chunk has samples of 40 ms, first one starts with key frame
+func testSegment(parts int, samples uint32) []byte {
+	res := testBox("styp", []byte("msdh"))
+	for i := 0; i < parts; i++ {
+		first := uint32(0x01010000)
+		if i == 0 {
+			first = 0x02000000
+		}
+		tfhd := testFullBox("tfhd", 0x020028, 1, 40, 0x01010000)
+		trun := testFullBox("trun", 0x04, samples, first)
+		res = append(res, testBox("moof", testBox("traf", append(tfhd, trun...)))...)
+		res = append(res, testBox("mdat", make([]byte, 100))...)
+	}
+	return res
+}
+
+func TestParseHLS(t *testing.T) {
+	p := parseHLS([]byte(testPlaylist))
+	if p.mediaSequence != 10 || p.segments != 4 || p.parts != 0 || p.target != 1 || p.lastMsn() != 13 {
+		t.Fatalf("parseHLS = %+v", p)
+	}
+	withParts := strings.Replace(testPlaylist, "#EXT-X-PREFETCH:chunk-stream0-00014.m4s\n", "#EXT-X-PART:DURATION=0.240,URI=\"chunk-stream0-00014.m4s?part=0\"\n#EXT-X-PART:DURATION=0.240,URI=\"chunk-stream0-00014.m4s?part=1\"\n", 1)
+	p = parseHLS([]byte(withParts))
+	tests := []struct {
+		msn  int64
+		part int64
+		res  bool
+	}{
+		{13, -1, true},
+		{12, 5, true},
+		{14, -1, false},
+		{14, 0, true},
+		{14, 1, true},
+		{14, 2, false},
+		{15, 0, false},
+	}
+	for _, test := range tests {
+		if res := p.has(test.msn, test.part); res != test.res {
+			t.Errorf("has(%d, %d) = %v, want %v", test.msn, test.part, res, test.res)
+		}
+	}
+}
+
+func TestLLHLSProcessing(t *testing.T) {
+	res := string(llhlsProcessing([]byte(testPlaylist)))
+	for _, line := range []string{"#EXT-X-VERSION:9", "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=6.0", "#EXT-X-PREFETCH:chunk-stream0-00014.m4s"} {
+		if !strings.Contains(res, line+"\n") {
+			t.Errorf("%s isn't found in:\n%s", line, res)
+		}
+	}
+	if strings.Contains(res, "#EXT-X-PART") {
+		t.Errorf("parts without CMAF chunks:\n%s", res)
+	}
+	if again := string(llhlsProcessing([]byte(res))); again != res {
+		t.Errorf("second processing changed playlist:\n%s", again)
+	}
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nmedia_0.m3u8\n"
+	if res := string(llhlsProcessing([]byte(master))); res != master {
+		t.Errorf("master playlist is changed:\n%s", res)
+	}
+}
+
+func TestHLSSkip(t *testing.T) {
+	res := string(hlsSkip([]byte(testPlaylist), 2))
+	if !strings.Contains(res, "#EXT-X-SKIP:SKIPPED-SEGMENTS=2\n") {
+		t.Fatalf("no EXT-X-SKIP:\n%s", res)
+	}
+	if strings.Contains(res, "chunk-stream0-00011.m4s") || !strings.Contains(res, "chunk-stream0-00012.m4s") {
+		t.Errorf("wrong segments are skipped:\n%s", res)
+	}
+	if res := string(hlsSkip([]byte(testPlaylist), 10)); res != testPlaylist {
+		t.Errorf("playlist shorter than CAN-SKIP-UNTIL is changed:\n%s", res)
+	}
+}
+
+func TestParseParts(t *testing.T) {
+	data := testSegment(4, 6)
+	parts := parseParts(data, 1000, 40)
+	if len(parts) != 4 {
+		t.Fatalf("%d parts, want 4", len(parts))
+	}
+	end := 0
+	for i, part := range parts {
+		if part.offset != end {
+			t.Errorf("part %d offset %d, want %d", i, part.offset, end)
+		}
+		end = part.offset + part.size
+		if part.duration != 0.24 {
+			t.Errorf("part %d duration %v, want 0.24", i, part.duration)
+		}
+		if part.independent != (i == 0) {
+			t.Errorf("part %d independent %v", i, part.independent)
+		}
+	}
+	if end != len(data) {
+		t.Errorf("parts end at %d, segment size %d", end, len(data))
+	}
+	// хвост, который еще загружается, частью не считается
+	if parts := parseParts(data[:len(data)-10], 1000, 40); len(parts) != 3 {
+		t.Errorf("%d parts of uploaded segment, want 3", len(parts))
+	}
+}
+
+func TestLLHLSParts(t *testing.T) {
+	f := newTestItems(t, time.Millisecond)
+	f.Add("/user/cam/init-stream0.m4s", testInit(), "video/mp4")
+	for i := 10; i <= 13; i++ {
+		f.Add(fmt.Sprintf("/user/cam/chunk-stream0-%05d.m4s", i), testSegment(4, 6), "video/mp4")
+	}
+	// сегмент 14 ffmpeg еще загружает: пришли 2 чанка
+	uploaded := testSegment(4, 6)
+	cut := len(testSegment(2, 6)) + 1
+	p := newPartial()
+	p.write(uploaded[:cut])
+	f.items.create("/user/cam/chunk-stream0-00014.m4s").swap(&Item{partial: p, created: time.Now(), timeout: time.Minute})
+
+	key := "/user/cam/media_0.m3u8"
+	data, changed := f.llhlsParts(key, llhlsProcessing([]byte(testPlaylist)))
+	if changed == nil {
+		t.Error("no channel of uploaded segment")
+	}
+	res := string(data)
+	for _, line := range []string{
+		"#EXT-X-PART-INF:PART-TARGET=0.240",
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=6.0,PART-HOLD-BACK=0.720",
+		"#EXT-X-PART:DURATION=0.240,URI=\"chunk-stream0-00011.m4s?part=0\",INDEPENDENT=YES",
+		"#EXT-X-PART:DURATION=0.240,URI=\"chunk-stream0-00013.m4s?part=3\"",
+		"#EXT-X-PART:DURATION=0.240,URI=\"chunk-stream0-00014.m4s?part=1\"",
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"chunk-stream0-00014.m4s?part=2\"",
+	} {
+		if !strings.Contains(res, line+"\n") {
+			t.Errorf("%s isn't found in:\n%s", line, res)
+		}
+	}
+	// части есть только у PartSegments последних сегментов
+	if strings.Contains(res, "chunk-stream0-00010.m4s?part") {
+		t.Errorf("parts of old segment aren't dropped:\n%s", res)
+	}
+	playlist := parseHLS(data)
+	if !playlist.has(14, 1) || playlist.has(14, 2) {
+		t.Errorf("parts of uploaded segment: %+v", playlist)
+	}
+	if res := string(hlsSkip(data, 2)); strings.Contains(res, "chunk-stream0-00011.m4s") {
+		t.Errorf("parts of skipped segment are left:\n%s", res)
+	}
+
+	p.write(uploaded[cut:])
+	select {
+	case <-changed:
+	default:
+		t.Error("channel isn't closed by upload")
+	}
+	data, _ = f.llhlsParts(key, llhlsProcessing([]byte(testPlaylist)))
+	if !strings.Contains(string(data), "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"chunk-stream0-00014.m4s?part=4\"") {
+		t.Errorf("preload hint isn't moved:\n%s", data)
+	}
+}
+
+func TestLLHLSPartsLongChunks(t *testing.T) {
+	f := newTestItems(t, time.Millisecond)
+	f.Add("/user/cam/init-stream0.m4s", testInit(), "video/mp4")
+	// -frag_duration равен сегменту: LL-HLS не дает выигрыша, части не заявляются
+	for i := 10; i <= 13; i++ {
+		f.Add(fmt.Sprintf("/user/cam/chunk-stream0-%05d.m4s", i), testSegment(1, 24), "video/mp4")
+	}
+	playlist := string(llhlsProcessing([]byte(testPlaylist)))
+	data, _ := f.llhlsParts("/user/cam/media_0.m3u8", []byte(playlist))
+	if string(data) != playlist {
+		t.Errorf("parts of whole segments:\n%s", data)
+	}
+}
+
+func TestPlaylistConditional(t *testing.T) {
+	items := newTestItems(t, 10*time.Millisecond)
+	key := "/user/cam/media_0.m3u8"
+	items.Add(key, []byte(testPlaylist), "application/vnd.apple.mpegurl")
+
+	res := testServe(items, "GET", "/get"+key)
+	etag := res.Header().Get("ETag")
+	if res.Code != http.StatusOK || len(etag) == 0 || len(res.Header().Get("Last-Modified")) == 0 {
+		t.Fatalf("GET = %d, ETag %q, Last-Modified %q", res.Code, etag, res.Header().Get("Last-Modified"))
+	}
+	if res := testServe(items, "GET", "/get"+key, "If-None-Match", etag); res.Code != http.StatusNotModified || res.Body.Len() != 0 {
+		t.Errorf("GET with If-None-Match = %d, body %d bytes, want 304", res.Code, res.Body.Len())
+	}
+	if res := testServe(items, "HEAD", "/get"+key); res.Code != http.StatusOK || res.Body.Len() != 0 {
+		t.Errorf("HEAD = %d, body %d bytes", res.Code, res.Body.Len())
+	}
+
+	// новый текст плейлиста - новый ETag
+	items.Add(key, []byte(strings.Replace(testPlaylist, "#EXT-X-PREFETCH:chunk-stream0-00014.m4s\n", "#EXTINF:0.960,\nchunk-stream0-00014.m4s\n", 1)), "application/vnd.apple.mpegurl")
+	if res := testServe(items, "GET", "/get"+key, "If-None-Match", etag); res.Code != http.StatusOK || res.Header().Get("ETag") == etag {
+		t.Errorf("GET of changed playlist = %d, ETag %q", res.Code, res.Header().Get("ETag"))
+	}
+
+	// блокирующий запрос отдает плейлист целиком, но тоже с ETag
+	res = testServe(items, "GET", "/get"+key+"?_HLS_msn=14")
+	if res.Code != http.StatusOK || len(res.Header().Get("ETag")) == 0 || !strings.Contains(res.Body.String(), "chunk-stream0-00014.m4s") {
+		t.Errorf("blocking GET = %d, ETag %q:\n%s", res.Code, res.Header().Get("ETag"), res.Body.String())
+	}
+}
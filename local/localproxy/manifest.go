@@ -0,0 +1,177 @@
+package localproxy
+
+import (
+	"encoding/xml"
+	"strings"
+
+	"github.com/antchfx/xmlquery"
+
+	"camctl/local/localconf"
+)
+
+// SetManifestRules bind rules for manifests with stream name, they are applied by Add
+func (f *Items) SetManifestRules(name string, rules localconf.ManifestRules) {
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	f.manifestRules[name] = rules
+}
+
+// GetManifestRules return rules for manifests of stream name, DefaultManifestRules if stream has no own rules
+func (f *Items) GetManifestRules(name string) (localconf.ManifestRules, bool) {
+	f.fileMut.RLock()
+	defer f.fileMut.RUnlock()
+	res, isFind := f.manifestRules[name]
+	if !isFind {
+		return localconf.DefaultManifestRules(), false
+	}
+	return res, true
+}
+
+// DelManifestRules remove rules for manifests of stream name
+func (f *Items) DelManifestRules(name string) {
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	delete(f.manifestRules, name)
+}
+
+func hasAttr(node *xmlquery.Node, name string) bool {
+	for _, curr := range node.Attr {
+		if curr.Name.Local == name {
+			return true
+		}
+	}
+	return false
+}
+
+func setXMLAttr(node *xmlquery.Node, name string, value string, missing bool) {
+	if missing && hasAttr(node, name) {
+		return
+	}
+	addAttr(node, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+// applyXMLRule change MPD document by one rule
+func applyXMLRule(doc *xmlquery.Node, rule *localconf.ManifestRule) {
+	nodes, errQuery := xmlquery.QueryAll(doc, rule.Path)
+	if errQuery != nil {
+		return
+	}
+	for _, node := range nodes {
+		switch rule.Op {
+		case localconf.RuleSetAttr:
+			setXMLAttr(node, rule.Name, rule.Value, rule.Missing)
+		case localconf.RuleAddElement:
+			elem := node.SelectElement(rule.Name)
+			if elem == nil {
+				elem = &xmlquery.Node{Type: xmlquery.ElementNode, Data: rule.Name}
+				xmlquery.AddChild(node, elem)
+			}
+			for _, name := range rule.AttrNames() {
+				setXMLAttr(elem, name, rule.Attrs[name], rule.Missing)
+			}
+		case localconf.RuleDelElement:
+			xmlquery.RemoveFromTree(node)
+		}
+	}
+}
+
+// splitHLSAttrs split attribute list of HLS tag, commas inside quotes don't split: CODECS="avc1,mp4a"
+func splitHLSAttrs(str string) []string {
+	res := make([]string, 0)
+	quoted := false
+	begin := 0
+	for i, r := range str {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			res = append(res, str[begin:i])
+			begin = i + 1
+		}
+	}
+	if begin < len(str) {
+		res = append(res, str[begin:])
+	}
+	return res
+}
+
+// setHLSAttrs set attributes of rule in attribute list of tag
+func setHLSAttrs(list string, rule *localconf.ManifestRule) string {
+	attrs := splitHLSAttrs(list)
+	for _, name := range rule.AttrNames() {
+		attr := name + "=" + rule.Attrs[name]
+		index := -1
+		for i, curr := range attrs {
+			if strings.HasPrefix(curr, name+"=") {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			attrs = append(attrs, attr)
+		} else if !rule.Missing {
+			attrs[index] = attr
+		}
+	}
+	return strings.Join(attrs, ",")
+}
+
+func hlsTag(prefix string, value string) string {
+	if len(value) == 0 {
+		return prefix
+	}
+	return prefix + ":" + value
+}
+
+// applyHLSRule change HLS playlist by one rule
+func applyHLSRule(lines []string, rule *localconf.ManifestRule) []string {
+	prefix := "#" + rule.Name
+	isFind := false
+	for i, line := range lines {
+		if line != prefix && !strings.HasPrefix(line, prefix+":") {
+			continue
+		}
+		isFind = true
+		value := strings.TrimPrefix(strings.TrimPrefix(line, prefix), ":")
+		if len(rule.Attrs) > 0 {
+			value = setHLSAttrs(value, rule)
+		} else if !rule.Missing || len(value) == 0 {
+			value = rule.Value
+		}
+		lines[i] = hlsTag(prefix, value)
+	}
+	// теги с uri в следующей строке без uri не добавить
+	if isFind || rule.Name == "EXT-X-STREAM-INF" || rule.Name == "EXTINF" || len(lines) == 0 {
+		return lines
+	}
+	value := rule.Value
+	if len(rule.Attrs) > 0 {
+		value = setHLSAttrs("", rule)
+	}
+	// новый тег ставим в заголовок: после #EXTM3U и #EXT-X-VERSION
+	pos := 1
+	if len(lines) > 1 && strings.HasPrefix(lines[1], "#EXT-X-VERSION:") {
+		pos = 2
+	}
+	res := make([]string, 0, len(lines)+1)
+	res = append(res, lines[:pos]...)
+	res = append(res, hlsTag(prefix, value))
+	return append(res, lines[pos:]...)
+}
+
+// hlsRules apply HLS rules to playlist key
+func hlsRules(data []byte, key string, rules localconf.ManifestRules) []byte {
+	lines := splitLines(data)
+	changed := false
+	for i := range rules {
+		rule := &rules[i]
+		if rule.IsHLS() && rule.Match(key) {
+			lines = applyHLSRule(lines, rule)
+			changed = true
+		}
+	}
+	if !changed {
+		return data
+	}
+	return joinLines(lines)
+}
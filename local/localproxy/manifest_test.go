@@ -0,0 +1,104 @@
+package localproxy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"camctl/local/localconf"
+)
+
+func TestSplitHLSAttrs(t *testing.T) {
+	tests := []struct {
+		list string
+		res  []string
+	}{
+		{`BANDWIDTH=1000,CODECS="avc1.64001e,mp4a.40.2",RESOLUTION=640x360`, []string{"BANDWIDTH=1000", `CODECS="avc1.64001e,mp4a.40.2"`, "RESOLUTION=640x360"}},
+		{"BANDWIDTH=1000", []string{"BANDWIDTH=1000"}},
+		{"", []string{}},
+	}
+	for _, test := range tests {
+		if res := splitHLSAttrs(test.list); !reflect.DeepEqual(res, test.res) {
+			t.Errorf("splitHLSAttrs(%q) = %q, want %q", test.list, res, test.res)
+		}
+	}
+}
+
+func TestHLSRules(t *testing.T) {
+	master := "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-STREAM-INF:BANDWIDTH=500,CODECS=\"avc1.64001e\"\nmedia_0.m3u8\n"
+	tests := []struct {
+		name  string
+		key   string
+		rule  localconf.ManifestRule
+		lines []string
+		not   []string
+	}{
+		{
+			name:  "attrs replace",
+			key:   "/user/cam/master.m3u8",
+			rule:  localconf.ManifestRule{Op: localconf.RuleSetTag, Name: "EXT-X-STREAM-INF", Attrs: map[string]string{"BANDWIDTH": "900"}},
+			lines: []string{"#EXT-X-STREAM-INF:BANDWIDTH=900,CODECS=\"avc1.64001e\""},
+		},
+		{
+			name:  "missing keeps",
+			key:   "/user/cam/master.m3u8",
+			rule:  localconf.ManifestRule{Op: localconf.RuleSetTag, Name: "EXT-X-STREAM-INF", Attrs: map[string]string{"BANDWIDTH": "900", "RESOLUTION": "640x360"}, Missing: true},
+			lines: []string{"#EXT-X-STREAM-INF:BANDWIDTH=500,CODECS=\"avc1.64001e\",RESOLUTION=640x360"},
+		},
+		{
+			name:  "new tag in header",
+			key:   "/user/cam/master.m3u8",
+			rule:  localconf.ManifestRule{Op: localconf.RuleSetTag, Name: "EXT-X-INDEPENDENT-SEGMENTS"},
+			lines: []string{"#EXT-X-VERSION:7\n#EXT-X-INDEPENDENT-SEGMENTS"},
+		},
+		{
+			name: "other file",
+			key:  "/user/cam/master.m3u8",
+			rule: localconf.ManifestRule{Op: localconf.RuleSetTag, File: "media_*.m3u8", Name: "EXT-X-INDEPENDENT-SEGMENTS"},
+			not:  []string{"EXT-X-INDEPENDENT-SEGMENTS"},
+		},
+		{
+			name: "mpd rule",
+			key:  "/user/cam/master.m3u8",
+			rule: localconf.ManifestRule{Op: localconf.RuleSetAttr, Path: "//MPD", Name: "minimumUpdatePeriod", Value: "PT30S"},
+			not:  []string{"minimumUpdatePeriod"},
+		},
+	}
+	for _, test := range tests {
+		res := string(hlsRules([]byte(master), test.key, localconf.ManifestRules{test.rule}))
+		for _, line := range test.lines {
+			if !strings.Contains(res, line+"\n") {
+				t.Errorf("%s: %q isn't found in:\n%s", test.name, line, res)
+			}
+		}
+		for _, str := range test.not {
+			if strings.Contains(res, str) {
+				t.Errorf("%s: %q is found in:\n%s", test.name, str, res)
+			}
+		}
+	}
+}
+
+func TestXMLProcessing(t *testing.T) {
+	mpd := `<?xml version="1.0" encoding="utf-8"?><MPD minimumUpdatePeriod="PT0.5S"><UTCTiming schemeIdUri="urn:mpeg:dash:utc:http-xsdate:2014"/><Period id="0"></Period></MPD>`
+	rules := localconf.ManifestRules{
+		{Op: localconf.RuleSetAttr, Path: "//MPD", Name: "minimumUpdatePeriod", Value: "PT30S"},
+		{Op: localconf.RuleAddElement, Path: "//MPD", Name: "ServiceDescription", Attrs: map[string]string{"id": "0"}},
+		{Op: localconf.RuleDelElement, Path: "//MPD/UTCTiming"},
+		{Op: localconf.RuleSetAttr, File: "other.mpd", Path: "//MPD", Name: "type", Value: "static"},
+	}
+	res := string(xmlProcessing([]byte(mpd), "/user/cam/master.mpd", nil, rules))
+	for _, str := range []string{`minimumUpdatePeriod="PT30S"`, `<ServiceDescription id="0">`} {
+		if !strings.Contains(res, str) {
+			t.Errorf("%s isn't found in %s", str, res)
+		}
+	}
+	for _, str := range []string{"UTCTiming", "PT0.5S", `type="static"`} {
+		if strings.Contains(res, str) {
+			t.Errorf("%s is found in %s", str, res)
+		}
+	}
+	if res := string(xmlProcessing([]byte("not xml <"), "/user/cam/master.mpd", nil, rules)); res != "not xml <" {
+		t.Errorf("broken manifest is changed: %s", res)
+	}
+}
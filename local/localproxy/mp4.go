@@ -0,0 +1,426 @@
+package localproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// mp4Box is box of ISO BMFF file
+type mp4Box struct {
+	typ  string
+	data []byte // содержимое без заголовка
+	size int    // размер вместе с заголовком
+}
+
+// readBoxes split data into boxes, broken tail is ignored
+func readBoxes(data []byte) []mp4Box {
+	res := make([]mp4Box, 0)
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		typ := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			// до конца файла
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return res
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return res
+		}
+		res = append(res, mp4Box{typ: typ, data: data[header:size], size: int(size)})
+		data = data[size:]
+	}
+	return res
+}
+
+// findBox return first box by path of types: "moov", "trak", "mdia"
+func findBox(data []byte, path ...string) (mp4Box, bool) {
+	for _, b := range readBoxes(data) {
+		if b.typ != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return b, true
+		}
+		return findBox(b.data, path[1:]...)
+	}
+	return mp4Box{}, false
+}
+
+// mp4Track describe track found in init segment
+type mp4Track struct {
+	handler         string // vide, soun
+	codec           string // RFC 6381
+	width           int
+	height          int
+	sampleRate      int
+	channels        int
+	timescale       uint32
+	defaultDuration uint32 // из trex
+}
+
+// parseInit parse first track of fMP4 init segment, ffmpeg dash writes one track per representation
+func parseInit(data []byte) (*mp4Track, error) {
+	moov, ok := findBox(data, "moov")
+	if !ok {
+		return nil, fmt.Errorf("no moov")
+	}
+	trak, ok := findBox(moov.data, "trak")
+	if !ok {
+		return nil, fmt.Errorf("no trak")
+	}
+	res := mp4Track{}
+	if hdlr, ok := findBox(trak.data, "mdia", "hdlr"); ok && len(hdlr.data) >= 12 {
+		res.handler = string(hdlr.data[8:12])
+	}
+	if mdhd, ok := findBox(trak.data, "mdia", "mdhd"); ok && len(mdhd.data) >= 24 {
+		if mdhd.data[0] == 1 {
+			res.timescale = binary.BigEndian.Uint32(mdhd.data[20:24])
+		} else {
+			res.timescale = binary.BigEndian.Uint32(mdhd.data[12:16])
+		}
+	}
+	if trex, ok := findBox(moov.data, "mvex", "trex"); ok && len(trex.data) >= 16 {
+		res.defaultDuration = binary.BigEndian.Uint32(trex.data[12:16])
+	}
+	stsd, ok := findBox(trak.data, "mdia", "minf", "stbl", "stsd")
+	if !ok || len(stsd.data) < 8 {
+		return nil, fmt.Errorf("no stsd")
+	}
+	entries := readBoxes(stsd.data[8:])
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no sample entry")
+	}
+	entry := entries[0]
+	res.codec = entry.typ
+	switch entry.typ {
+	case "avc1", "avc3", "hvc1", "hev1":
+		// VisualSampleEntry: 78 байт полей до вложенных box
+		if len(entry.data) < 78 {
+			return nil, fmt.Errorf("short %s", entry.typ)
+		}
+		res.width = int(binary.BigEndian.Uint16(entry.data[24:26]))
+		res.height = int(binary.BigEndian.Uint16(entry.data[26:28]))
+		for _, b := range readBoxes(entry.data[78:]) {
+			switch b.typ {
+			case "avcC":
+				res.codec = avcCodec(entry.typ, b.data)
+			case "hvcC":
+				res.codec = hevcCodec(entry.typ, b.data)
+			}
+		}
+	case "mp4a":
+		// AudioSampleEntry: 28 байт полей до вложенных box
+		if len(entry.data) < 28 {
+			return nil, fmt.Errorf("short %s", entry.typ)
+		}
+		res.channels = int(binary.BigEndian.Uint16(entry.data[16:18]))
+		res.sampleRate = int(binary.BigEndian.Uint16(entry.data[24:26]))
+		if esds, ok := findBox(entry.data[28:], "esds"); ok {
+			res.codec = esdsCodec(esds.data)
+		}
+	case "Opus":
+		res.codec = "opus"
+	}
+	return &res, nil
+}
+
+// avcCodec build codec string from AVCDecoderConfigurationRecord: avc1.64001f
+func avcCodec(typ string, data []byte) string {
+	if len(data) < 4 {
+		return typ
+	}
+	return fmt.Sprintf("%s.%02x%02x%02x", typ, data[1], data[2], data[3])
+}
+
+// hevcCodec build codec string from HEVCDecoderConfigurationRecord by ISO/IEC 14496-15 annex E: hvc1.1.6.L93.B0
+func hevcCodec(typ string, data []byte) string {
+	if len(data) < 13 {
+		return typ
+	}
+	space := []string{"", "A", "B", "C"}[data[1]>>6]
+	tier := "L"
+	if data[1]&0x20 != 0 {
+		tier = "H"
+	}
+	profile := data[1] & 0x1f
+	// флаги совместимости пишутся в обратном порядке бит
+	compat := binary.BigEndian.Uint32(data[2:6])
+	reversed := uint32(0)
+	for i := 0; i < 32; i++ {
+		reversed = reversed<<1 | compat&1
+		compat >>= 1
+	}
+	res := fmt.Sprintf("%s.%s%d.%X.%s%d", typ, space, profile, reversed, tier, data[12])
+	// нулевые байты ограничений в конце опускаются
+	constraints := data[6:12]
+	last := len(constraints)
+	for last > 0 && constraints[last-1] == 0 {
+		last--
+	}
+	for _, c := range constraints[:last] {
+		res += fmt.Sprintf(".%X", c)
+	}
+	return res
+}
+
+// readDescriptor read tag and body of MPEG-4 descriptor, return rest of data
+func readDescriptor(data []byte) (byte, []byte, []byte, bool) {
+	if len(data) < 2 {
+		return 0, nil, nil, false
+	}
+	tag := data[0]
+	size := 0
+	i := 1
+	// длина по 7 бит, старший бит - продолжение
+	for ; i < len(data) && i <= 4; i++ {
+		size = size<<7 | int(data[i]&0x7f)
+		if data[i]&0x80 == 0 {
+			break
+		}
+	}
+	i++
+	if i+size > len(data) {
+		return 0, nil, nil, false
+	}
+	return tag, data[i : i+size], data[i+size:], true
+}
+
+// esdsCodec build codec string from esds box: mp4a.40.2
+func esdsCodec(data []byte) string {
+	if len(data) < 4 {
+		return "mp4a"
+	}
+	tag, es, _, ok := readDescriptor(data[4:])
+	if !ok || tag != 0x03 || len(es) < 3 {
+		return "mp4a"
+	}
+	flags := es[2]
+	es = es[3:]
+	if flags&0x80 != 0 {
+		es = es[min(2, len(es)):]
+	}
+	if flags&0x40 != 0 && len(es) > 0 {
+		es = es[min(1+int(es[0]), len(es)):]
+	}
+	if flags&0x20 != 0 {
+		es = es[min(2, len(es)):]
+	}
+	tag, config, _, ok := readDescriptor(es)
+	if !ok || tag != 0x04 || len(config) < 13 {
+		return "mp4a"
+	}
+	res := fmt.Sprintf("mp4a.%x", config[0])
+	tag, info, _, ok := readDescriptor(config[13:])
+	if !ok || tag != 0x05 || len(info) == 0 {
+		return res
+	}
+	objectType := int(info[0] >> 3)
+	if objectType == 31 && len(info) > 1 {
+		objectType = 32 + int(info[0]&0x07)<<3 | int(info[1]>>5)
+	}
+	return fmt.Sprintf("%s.%d", res, objectType)
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// parseFragments return number of samples and their summary duration in timescale units in media segment
+func parseFragments(data []byte, defaultDuration uint32) (int, uint64) {
+	count := 0
+	duration := uint64(0)
+	for _, moof := range readBoxes(data) {
+		if moof.typ != "moof" {
+			continue
+		}
+		for _, traf := range readBoxes(moof.data) {
+			if traf.typ != "traf" {
+				continue
+			}
+			trackDuration := defaultDuration
+			for _, b := range readBoxes(traf.data) {
+				switch b.typ {
+				case "tfhd":
+					if d, ok := tfhdDuration(b.data); ok {
+						trackDuration = d
+					}
+				case "trun":
+					n, d := trunDuration(b.data, trackDuration)
+					count += n
+					duration += d
+				}
+			}
+		}
+	}
+	return count, duration
+}
+
+// tfhdDuration return default-sample-duration of tfhd if it is set
+func tfhdDuration(data []byte) (uint32, bool) {
+	if len(data) < 8 {
+		return 0, false
+	}
+	flags := binary.BigEndian.Uint32(data[0:4]) & 0xffffff
+	offset := 8
+	if flags&0x01 != 0 {
+		offset += 8
+	}
+	if flags&0x02 != 0 {
+		offset += 4
+	}
+	if flags&0x08 == 0 || len(data) < offset+4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(data[offset : offset+4]), true
+}
+
+// trunDuration return number of samples of trun and their duration
+func trunDuration(data []byte, defaultDuration uint32) (int, uint64) {
+	if len(data) < 8 {
+		return 0, 0
+	}
+	flags := binary.BigEndian.Uint32(data[0:4]) & 0xffffff
+	count := int(binary.BigEndian.Uint32(data[4:8]))
+	offset := 8
+	if flags&0x01 != 0 {
+		offset += 4
+	}
+	if flags&0x04 != 0 {
+		offset += 4
+	}
+	if flags&0x100 == 0 {
+		return count, uint64(count) * uint64(defaultDuration)
+	}
+	sampleSize := 0
+	for _, bit := range []uint32{0x100, 0x200, 0x400, 0x800} {
+		if flags&bit != 0 {
+			sampleSize += 4
+		}
+	}
+	duration := uint64(0)
+	for i := 0; i < count && offset+4 <= len(data); i++ {
+		duration += uint64(binary.BigEndian.Uint32(data[offset : offset+4]))
+		offset += sampleSize
+	}
+	return count, duration
+}
+
+// mp4Part is CMAF chunk of media segment: moof with its mdat and boxes before them
+type mp4Part struct {
+	offset      int
+	size        int
+	duration    float64 // секунды
+	independent bool    // первый кадр ключевой, часть декодируется без предыдущих
+}
+
+// parseParts split media segment into complete chunks, tail which is still uploaded is ignored
+func parseParts(data []byte, timescale uint32, defaultDuration uint32) []mp4Part {
+	res := make([]mp4Part, 0)
+	if timescale == 0 {
+		return res
+	}
+	begin := 0
+	end := 0
+	var moof []byte
+	for _, b := range readBoxes(data) {
+		end += b.size
+		switch b.typ {
+		case "moof":
+			moof = b.data
+		case "mdat":
+			if moof == nil {
+				continue
+			}
+			_, duration := parseFragments(data[begin:end], defaultDuration)
+			res = append(res, mp4Part{offset: begin, size: end - begin, duration: float64(duration) / float64(timescale), independent: moofIndependent(moof)})
+			begin = end
+			moof = nil
+		}
+	}
+	return res
+}
+
+// moofIndependent return true if first sample of fragment is sync sample
+func moofIndependent(moof []byte) bool {
+	traf, ok := findBox(moof, "traf")
+	if !ok {
+		return false
+	}
+	flags := uint32(0)
+	hasFlags := false
+	for _, b := range readBoxes(traf.data) {
+		switch b.typ {
+		case "tfhd":
+			flags, hasFlags = tfhdFlags(b.data)
+		case "trun":
+			if first, ok := trunFirstFlags(b.data); ok {
+				flags, hasFlags = first, true
+			}
+			// sample_is_non_sync_sample
+			return hasFlags && flags&0x00010000 == 0
+		}
+	}
+	return false
+}
+
+// tfhdFlags return default-sample-flags of tfhd if it is set
+func tfhdFlags(data []byte) (uint32, bool) {
+	if len(data) < 8 {
+		return 0, false
+	}
+	flags := binary.BigEndian.Uint32(data[0:4]) & 0xffffff
+	offset := 8
+	if flags&0x01 != 0 {
+		offset += 8
+	}
+	for _, bit := range []uint32{0x02, 0x08, 0x10} {
+		if flags&bit != 0 {
+			offset += 4
+		}
+	}
+	if flags&0x20 == 0 || len(data) < offset+4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(data[offset : offset+4]), true
+}
+
+// trunFirstFlags return flags of first sample of trun: first-sample-flags or flags of sample table
+func trunFirstFlags(data []byte) (uint32, bool) {
+	if len(data) < 8 {
+		return 0, false
+	}
+	flags := binary.BigEndian.Uint32(data[0:4]) & 0xffffff
+	count := binary.BigEndian.Uint32(data[4:8])
+	offset := 8
+	if flags&0x01 != 0 {
+		offset += 4
+	}
+	if flags&0x04 != 0 {
+		if len(data) < offset+4 {
+			return 0, false
+		}
+		return binary.BigEndian.Uint32(data[offset : offset+4]), true
+	}
+	if flags&0x400 == 0 || count == 0 {
+		return 0, false
+	}
+	for _, bit := range []uint32{0x100, 0x200} {
+		if flags&bit != 0 {
+			offset += 4
+		}
+	}
+	if len(data) < offset+4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(data[offset : offset+4]), true
+}
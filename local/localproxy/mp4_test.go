@@ -0,0 +1,142 @@
+package localproxy
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// testTrackInit build init segment of one track with handler, mdhd and sample entry
+func testTrackInit(handler string, mdhd []byte, entry []byte) []byte {
+	hdlr := testBox("hdlr", append(append(make([]byte, 8), handler...), make([]byte, 14)...))
+	stsd := testFullBox("stsd", 0, 1)
+	stsd = append(stsd, entry...)
+	binary.BigEndian.PutUint32(stsd, uint32(len(stsd)))
+	trak := testBox("trak", testBox("mdia", append(append(mdhd, hdlr...), testBox("minf", testBox("stbl", stsd))...)))
+	return append(testBox("ftyp", []byte("iso6")), testBox("moov", trak)...)
+}
+
+// testVisualEntry build VisualSampleEntry typ with size and configuration boxes
+func testVisualEntry(typ string, width uint16, height uint16, boxes ...[]byte) []byte {
+	data := make([]byte, 78)
+	binary.BigEndian.PutUint16(data[24:], width)
+	binary.BigEndian.PutUint16(data[26:], height)
+	for _, b := range boxes {
+		data = append(data, b...)
+	}
+	return testBox(typ, data)
+}
+
+// testAudioEntry build mp4a AudioSampleEntry with esds
+func testAudioEntry(channels uint16, sampleRate uint16, esds []byte) []byte {
+	data := make([]byte, 28)
+	binary.BigEndian.PutUint16(data[16:], channels)
+	binary.BigEndian.PutUint16(data[24:], sampleRate)
+	return testBox("mp4a", append(data, esds...))
+}
+
+// testDescriptor build MPEG-4 descriptor with one byte length
+func testDescriptor(tag byte, data ...byte) []byte {
+	return append([]byte{tag, byte(len(data))}, data...)
+}
+
+// testESDS build esds of AAC with AudioSpecificConfig asc
+func testESDS(asc ...byte) []byte {
+	config := append([]byte{0x40, 0x15}, make([]byte, 11)...)
+	config = append(config, testDescriptor(0x05, asc...)...)
+	es := append([]byte{0, 1, 0}, testDescriptor(0x04, config...)...)
+	return testBox("esds", append(make([]byte, 4), testDescriptor(0x03, es...)...))
+}
+
+var (
+	testMdhd   = testFullBox("mdhd", 0, 0, 0, 1000, 0, 0)
+	testMdhdV1 = testFullBox("mdhd", 0x01000000, 0, 0, 0, 0, 90000, 0, 0)
+	testAvcC   = testBox("avcC", []byte{1, 0x64, 0x00, 0x1f, 0xff})
+	// Main профиль, уровень 3.1, флаги совместимости 1 и 2, progressive_source_flag
+	testHvcC = testBox("hvcC", append([]byte{1, 0x01, 0x60, 0, 0, 0, 0xb0, 0, 0, 0, 0, 0, 93}, make([]byte, 10)...))
+)
+
+func TestParseInit(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want mp4Track
+	}{
+		{"avc1", testTrackInit("vide", testMdhd, testVisualEntry("avc1", 1920, 1080, testAvcC)),
+			mp4Track{handler: "vide", codec: "avc1.64001f", width: 1920, height: 1080, timescale: 1000}},
+		{"avc1 without avcC", testTrackInit("vide", testMdhd, testVisualEntry("avc1", 640, 360)),
+			mp4Track{handler: "vide", codec: "avc1", width: 640, height: 360, timescale: 1000}},
+		{"hvc1 mdhd v1", testTrackInit("vide", testMdhdV1, testVisualEntry("hvc1", 1280, 720, testHvcC)),
+			mp4Track{handler: "vide", codec: "hvc1.1.6.L93.B0", width: 1280, height: 720, timescale: 90000}},
+		{"hev1 short hvcC", testTrackInit("vide", testMdhd, testVisualEntry("hev1", 1280, 720, testBox("hvcC", []byte{1, 2, 3}))),
+			mp4Track{handler: "vide", codec: "hev1", width: 1280, height: 720, timescale: 1000}},
+		{"mp4a AAC LC", testTrackInit("soun", testMdhd, testAudioEntry(2, 48000, testESDS(0x11, 0x90))),
+			mp4Track{handler: "soun", codec: "mp4a.40.2", sampleRate: 48000, channels: 2, timescale: 1000}},
+		{"mp4a HE-AAC escape", testTrackInit("soun", testMdhd, testAudioEntry(1, 44100, testESDS(0xf8, 0x40))),
+			mp4Track{handler: "soun", codec: "mp4a.40.34", sampleRate: 44100, channels: 1, timescale: 1000}},
+		{"mp4a broken esds", testTrackInit("soun", testMdhd, testAudioEntry(2, 48000, testBox("esds", []byte{0, 0, 0, 0, 0x03, 0x7f, 0}))),
+			mp4Track{handler: "soun", codec: "mp4a", sampleRate: 48000, channels: 2, timescale: 1000}},
+		{"Opus", testTrackInit("soun", testMdhd, testBox("Opus", make([]byte, 28))),
+			mp4Track{handler: "soun", codec: "opus", timescale: 1000}},
+		{"trex", testInit(),
+			mp4Track{handler: "vide", codec: "avc1", width: 640, height: 360, timescale: 1000, defaultDuration: 40}},
+	}
+	for _, test := range tests {
+		res, errParse := parseInit(test.data)
+		if errParse != nil {
+			t.Errorf("%s: parseInit error %v", test.name, errParse)
+			continue
+		}
+		if *res != test.want {
+			t.Errorf("%s: parseInit = %+v, want %+v", test.name, *res, test.want)
+		}
+	}
+}
+
+func TestParseInitBroken(t *testing.T) {
+	valid := testTrackInit("vide", testMdhd, testVisualEntry("avc1", 1920, 1080, testAvcC))
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"no moov", testBox("ftyp", []byte("iso6"))},
+		{"no trak", testBox("moov", testBox("mvex", nil))},
+		{"no stsd", testBox("moov", testBox("trak", testBox("mdia", testMdhd)))},
+		{"empty stsd", testTrackInit("vide", testMdhd, nil)},
+		{"short avc1", testTrackInit("vide", testMdhd, testBox("avc1", make([]byte, 40)))},
+		{"short mp4a", testTrackInit("soun", testMdhd, testBox("mp4a", make([]byte, 20)))},
+		{"box is longer than data", valid[:len(valid)-1]},
+		{"box is shorter than header", append([]byte{0, 0, 0, 4}, "moov"...)},
+		{"large size without 64 bits", append([]byte{0, 0, 0, 1}, "moov"...)},
+	}
+	for _, test := range tests {
+		if res, errParse := parseInit(test.data); errParse == nil {
+			t.Errorf("%s: parseInit = %+v without error", test.name, *res)
+		}
+	}
+
+	// обрезанные init сегменты приходят при обрыве загрузки: никакой длины не должна ронять разбор
+	for _, data := range [][]byte{valid, testTrackInit("vide", testMdhdV1, testVisualEntry("hvc1", 1280, 720, testHvcC)), testTrackInit("soun", testMdhd, testAudioEntry(2, 48000, testESDS(0x11, 0x90)))} {
+		for n := 0; n < len(data); n++ {
+			parseInit(data[:n])
+		}
+		// и порча любого байта тоже
+		for i := range data {
+			broken := append([]byte(nil), data...)
+			broken[i] = 0xff
+			parseInit(broken)
+		}
+	}
+}
+
+func TestParseFragments(t *testing.T) {
+	count, duration := parseFragments(testSegment(4, 6), 0)
+	if count != 24 || duration != 24*40 {
+		t.Errorf("parseFragments = %d samples %d, want 24 samples %d", count, duration, 24*40)
+	}
+	segment := testSegment(2, 6)
+	for n := 0; n < len(segment); n++ {
+		parseFragments(segment[:n], 40)
+		parseParts(segment[:n], 1000, 40)
+	}
+}
@@ -0,0 +1,222 @@
+package localproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"camctl/local/localconf"
+)
+
+const (
+	// UploadChunkSize - size of reading of PUT body, readers of segment get data by such parts
+	UploadChunkSize int = 32 * 1024
+)
+
+// partial describe segment which ffmpeg is still uploading
+type partial struct {
+	mut     *sync.Mutex
+	buf     []byte
+	done    bool
+	failed  bool
+	changed chan struct{} // закрывается при каждом изменении
+}
+
+func newPartial() *partial {
+	res := partial{mut: new(sync.Mutex), changed: make(chan struct{})}
+	return &res
+}
+
+func (p *partial) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *partial) write(data []byte) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.buf = append(p.buf, data...)
+	p.notify()
+}
+
+func (p *partial) close(failed bool) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.done = true
+	p.failed = failed
+	p.notify()
+}
+
+// from return data after offset, state of upload and channel which is closed on next change
+func (p *partial) from(offset int) ([]byte, bool, bool, <-chan struct{}) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	// дописывается только хвост, поэтому отданный срез уже не меняется
+	return p.buf[offset:], p.done, p.failed, p.changed
+}
+
+func (p *partial) bytes() []byte {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return p.buf
+}
+
+// isProgressive return true if data of key can be served before upload is finished:
+// manifests are processed as a whole and init segments are small
+func isProgressive(key string) bool {
+	return !strings.Contains(key, localconf.InitSegmentName) && !strings.HasSuffix(key, ".mpd") && !strings.HasSuffix(key, ".m3u8")
+}
+
+// Upload store segment in cache while it is read from body, Get return it before upload is finished.
+// Return whole data and previous item by key
+func (f *Items) Upload(key string, body io.Reader, contentType string) ([]byte, *Item, error) {
+	if f.isStaging(filepath.Dir(key)) {
+		// сегмент нового запуска никому не отдается до его манифеста
+		return f.stage(key, body, contentType)
+	}
+	p := newPartial()
+	item := &Item{contentType: contentType, created: time.Now(), timeout: f.timeout, partial: p}
+
+	// блокировка мапы
+	f.fileMut.Lock()
+	var res *Item = nil
+	// ожидающие сегмент получат его сразу, не дожидаясь конца загрузки
+	res = f.replace(key, item)
+	f.account(key, res, item)
+	f.fileMut.Unlock()
+
+	chunk := make([]byte, UploadChunkSize)
+	for {
+		n, errRead := body.Read(chunk)
+		if n > 0 {
+			p.write(chunk[:n])
+		}
+		if errRead == io.EOF {
+			break
+		}
+		if errRead != nil {
+			p.close(true)
+			f.delIf(key, item)
+			return nil, res, errRead
+		}
+	}
+
+	data := p.bytes()
+	// целый сегмент заменяет загружаемый: размер, время прихода, onstart - как у обычного PUT
+	f.Add(key, data, contentType)
+	p.close(false)
+	return data, res, nil
+}
+
+// delIf delete item by key if it isn't replaced yet, staged segment with the same key isn't touched
+func (f *Items) delIf(key string, item *Item) bool {
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	if find, isFind := f.items.load(key); isFind && find.item() == item {
+		f.remove(key)
+		return true
+	}
+	return false
+}
+
+var (
+	errUploadFailed  = errors.New("upload is failed")
+	errUploadStalled = errors.New("upload is stalled")
+)
+
+// follow pass data of uploading segment to write as it arrives, write may be nil.
+// Return nil when upload is finished, error if it is failed, stalled for waitData or ctx is done
+func (f *Items) follow(ctx context.Context, p *partial, write func(data []byte) error) error {
+	offset := 0
+	// один таймер на весь запрос, перезапускается при каждой порции данных
+	stall := time.NewTimer(f.waitData)
+	defer stall.Stop()
+	for {
+		data, done, failed, changed := p.from(offset)
+		if len(data) > 0 && write != nil {
+			if errWrite := write(data); errWrite != nil {
+				return errWrite
+			}
+		}
+		offset += len(data)
+		if failed {
+			return errUploadFailed
+		}
+		if done {
+			return nil
+		}
+		select {
+		case <-changed:
+			if !stall.Stop() {
+				select {
+				case <-stall.C:
+				default:
+				}
+			}
+			stall.Reset(f.waitData)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stall.C:
+			return errUploadStalled
+		}
+	}
+}
+
+// isConditional return true if request needs whole entity: validators, ranges and HEAD
+func isConditional(r *http.Request) bool {
+	if r.Method == http.MethodHead {
+		return true
+	}
+	for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if len(r.Header.Get(name)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// serveUpload send segment by chunked transfer while it is uploaded. Conditional, range and HEAD requests
+// and requests after end of upload get whole segment with ETag like other answers of /get
+func (f *Items) serveUpload(c *gin.Context, key string, item *Item) {
+	if _, done, _, _ := item.partial.from(0); done || isConditional(c.Request) {
+		if errFollow := f.follow(c.Request.Context(), item.partial, nil); errFollow != nil {
+			Error(c, "segment isn't uploaded", http.StatusServiceUnavailable)
+			return
+		}
+		// Upload кладет целый сегмент в кеш до закрытия partial
+		whole := f.peek(key)
+		if whole == nil || whole.partial != nil {
+			whole = &Item{data: item.partial.bytes(), contentType: item.contentType, created: item.created}
+		}
+		f.serveData(c, key, whole)
+		return
+	}
+
+	header := c.Writer.Header()
+	header.Set("Date", item.created.UTC().Format(http.TimeFormat))
+	if len(item.contentType) > 0 {
+		header.Set("Content-Type", item.contentType)
+	}
+	c.Status(http.StatusOK)
+	errFollow := f.follow(c.Request.Context(), item.partial, func(data []byte) error {
+		if _, errWrite := c.Writer.Write(data); errWrite != nil {
+			return errWrite
+		}
+		c.Writer.Flush()
+		return nil
+	})
+	if errFollow == errUploadStalled {
+		f.log.Sugar().Warnf("upload of %s is stalled", c.Request.URL.Path)
+	}
+	if errFollow == errUploadFailed || errFollow == errUploadStalled {
+		// обрываем соединение, чтобы плеер не принял обрезанный сегмент за целый
+		panic(http.ErrAbortHandler)
+	}
+}
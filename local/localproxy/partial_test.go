@@ -0,0 +1,141 @@
+package localproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testUpload start PUT of key through pipe, returned writer is the body of ffmpeg upload
+func testUpload(t *testing.T, items *Items, key string) (*io.PipeWriter, <-chan error) {
+	t.Helper()
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := items.Upload(key, reader, "video/mp4")
+		done <- err
+	}()
+	for items.peek(key) == nil {
+		time.Sleep(time.Millisecond)
+	}
+	return writer, done
+}
+
+// testServer serve /get of items by real http server, so aborted handler breaks connection
+func testServer(t *testing.T, items *Items) *httptest.Server {
+	engine := gin.New()
+	engine.Any("/get/*path", items.ServeHTTP)
+	res := httptest.NewServer(engine)
+	t.Cleanup(res.Close)
+	return res
+}
+
+func TestUploadProgressive(t *testing.T) {
+	items := newTestItems(t, time.Second)
+	server := testServer(t, items)
+	key := "/user/cam/chunk-stream0-00001.m4s"
+	writer, done := testUpload(t, items, key)
+	writer.Write([]byte("01234"))
+
+	// зритель пришел посреди загрузки: получает уже загруженное, не дожидаясь конца
+	resp, errGet := http.Get(server.URL + "/get" + key)
+	if errGet != nil {
+		t.Fatal(errGet)
+	}
+	defer resp.Body.Close()
+	head := make([]byte, 5)
+	if _, errRead := io.ReadFull(resp.Body, head); errRead != nil || string(head) != "01234" {
+		t.Fatalf("read during upload %q, %v", head, errRead)
+	}
+	writer.Write([]byte("56789"))
+	writer.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("Upload = %v", err)
+	}
+	tail, errRead := ioutil.ReadAll(resp.Body)
+	if errRead != nil || string(tail) != "56789" {
+		t.Errorf("read after upload %q, %v", tail, errRead)
+	}
+
+	// после загрузки сегмент отдается целиком из кеша
+	if item := items.peek(key); item == nil || item.partial != nil || string(item.data) != "0123456789" {
+		t.Errorf("item after upload %+v", item)
+	}
+}
+
+func TestUploadAbort(t *testing.T) {
+	items := newTestItems(t, 50*time.Millisecond)
+	server := testServer(t, items)
+	tests := []struct {
+		name string
+		end  func(writer *io.PipeWriter)
+	}{
+		{"stalled", func(writer *io.PipeWriter) {}},
+		{"failed", func(writer *io.PipeWriter) { writer.CloseWithError(errors.New("ffmpeg is gone")) }},
+	}
+	for i, test := range tests {
+		key := fmt.Sprintf("/user/cam/chunk-stream0-%05d.m4s", i+1)
+		writer, done := testUpload(t, items, key)
+		writer.Write([]byte("01234"))
+		resp, errGet := http.Get(server.URL + "/get" + key)
+		if errGet != nil {
+			t.Fatal(errGet)
+		}
+		test.end(writer)
+		// обрезанный сегмент не должен выглядеть целым: соединение рвется
+		data, errRead := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if errRead == nil {
+			t.Errorf("%s: read %q without error", test.name, data)
+		}
+		writer.CloseWithError(errors.New("stop"))
+		if err := <-done; err == nil {
+			t.Errorf("%s: Upload of broken body return nil", test.name)
+		}
+		if item := items.peek(key); item != nil {
+			t.Errorf("%s: broken segment is left in cache", test.name)
+		}
+	}
+}
+
+func TestUploadConditional(t *testing.T) {
+	items := newTestItems(t, time.Second)
+	key := "/user/cam/chunk-stream0-00001.m4s"
+	writer, done := testUpload(t, items, key)
+	writer.Write([]byte("01234"))
+
+	// HEAD и Range ждут конца загрузки и получают целый сегмент
+	heads := make(chan *httptest.ResponseRecorder)
+	go func() {
+		heads <- testServe(items, "HEAD", "/get"+key)
+	}()
+	ranges := make(chan *httptest.ResponseRecorder)
+	go func() {
+		ranges <- testServe(items, "GET", "/get"+key, "Range", "bytes=3-6")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	writer.Write([]byte("56789"))
+	writer.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("Upload = %v", err)
+	}
+
+	head := <-heads
+	etag := head.Header().Get("ETag")
+	if head.Code != http.StatusOK || head.Body.Len() != 0 || head.Header().Get("Content-Length") != "10" || len(etag) == 0 {
+		t.Errorf("HEAD = %d, body %d bytes, Content-Length %q, ETag %q", head.Code, head.Body.Len(), head.Header().Get("Content-Length"), etag)
+	}
+	if res := <-ranges; res.Code != http.StatusPartialContent || res.Body.String() != "3456" {
+		t.Errorf("Range = %d %q", res.Code, res.Body.String())
+	}
+	if res := testServe(items, "GET", "/get"+key, "If-None-Match", etag); res.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match after upload = %d, want 304", res.Code)
+	}
+}
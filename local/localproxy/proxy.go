@@ -3,13 +3,16 @@ package localproxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -30,11 +33,23 @@ type Item struct {
 	contentType string
 	created     time.Time
 	timeout     time.Duration
+	pinned      bool     // init сегменты и манифесты нужны живому потоку, по размеру кеша не вытесняются
+	partial     *partial // не nil пока ffmpeg загружает сегмент
+	file        string   // сегмент timeshift вытеснен из памяти в файл
+	fileSize    int64
 }
 
-type itemCond struct {
-	data *Item
-	cond *sync.Cond
+// Size return size of item data in memory or in file
+func (i *Item) Size() int64 {
+	if len(i.file) > 0 {
+		return i.fileSize
+	}
+	return int64(len(i.data))
+}
+
+// ETag return strong entity tag of item: ffmpeg rewrites manifests by the same key, so time is part of tag
+func (i *Item) ETag() string {
+	return fmt.Sprintf("\"%x-%x\"", i.created.UnixNano(), i.Size())
 }
 
 type delItem struct {
@@ -47,17 +62,49 @@ type Items struct {
 	wg              *sync.WaitGroup
 	log             *zap.Logger
 	conf            *localconf.Config
-	items           map[string]*itemCond                  // тут хранятся данные: чанки и мета описатели - ключ / файл
+	items           itemMap                               // тут хранятся данные: чанки и мета описатели - ключ / файл
 	notifications   map[string][]*localnotif.Notification // тут хранятся нотификации
 	onStartWebhooks map[string][]*localnotif.Webhook      // тут хранятся webhooks
 	onStopWebhooks  map[string][]*localnotif.Webhook      // тут хранятся webhooks
 	onErrorWebhooks map[string][]*localnotif.Webhook      // тут хранятся webhooks
+	arrivals        map[string]time.Time                  // время прихода последнего сегмента по потоку
 	delPrefix       []delItem
-	fileMut         *sync.RWMutex
+	fileMut         *sync.RWMutex // данные ключей меняются только под ним, Get его не берет - см. Add
 	timeout         time.Duration // общий
 	maxTimeout      time.Duration // для init сегментов, *.m3u8, *.mpd - они обязательны для mpeg-dash
 	waitData        time.Duration // ожидание из кеша
 	worked          *int32
+	closed          chan struct{}
+	maxBytes        int64            // бюджет всего кеша, 0 - без ограничения
+	maxStreamBytes  int64            // бюджет одного потока, 0 - без ограничения
+	bytes           int64            // размер данных в кеше
+	streamBytes     map[string]int64 // размер данных по потокам
+	evicted         map[string]int64 // вытеснено по размеру по потокам
+	evictedAll      int64
+	dvrMaxBytes     int64                              // память под timeshift одного потока, остальное на диске
+	manifestRules   map[string]localconf.ManifestRules // правила для манифестов по потокам
+	tracks          map[string]map[int]*TrackInfo      // дорожки потоков по init сегментам
+	dvr             map[string]*dvrStream              // окна timeshift по потокам
+	fetching        map[string]bool                    // ключи, которые сейчас грузятся с upstream
+	client          *http.Client
+	counters        map[string]*streamStats // счетчики запросов по потокам
+	total           *streamStats
+	generations     map[string]*generation // запуски ffmpeg по потокам
+	generationID    uint64
+}
+
+// CacheStats describe size and requests of cache or of one stream in cache
+type CacheStats struct {
+	Items      int                   `json:"items"`
+	Bytes      int64                 `json:"bytes"`
+	MaxBytes   int64                 `json:"maxbytes,omitempty"`
+	Evicted    int64                 `json:"evicted"`
+	Puts       int64                 `json:"puts"`
+	Hits       int64                 `json:"hits"`
+	Waits      int64                 `json:"waits"`
+	Timeouts   int64                 `json:"timeouts"`
+	SegmentAge float64               `json:"segmentage,omitempty"` // секунды с прихода последнего сегмента
+	Streams    map[string]CacheStats `json:"streams,omitempty"`
 }
 
 // AddNotifications store notification servers into storage and bind it with name
@@ -97,6 +144,13 @@ func (f *Items) DelNotifications(name string) (localnotif.Notifications, bool) {
 	return res, isFind
 }
 
+// SetOnStartWebhooks bind OnStartWebhooks with name again, it is used after restart of process
+func (f *Items) SetOnStartWebhooks(name string, onStartWebhooks localnotif.Webhooks) {
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	f.onStartWebhooks[name] = onStartWebhooks
+}
+
 // DelNotifications remove notification servers by bind name, return it if it finded
 func (f *Items) DelOnStartWebhooks(name string) (localnotif.Webhooks, bool) {
 	f.fileMut.Lock()
@@ -130,26 +184,76 @@ func (f *Items) DelOnErrorWebhooks(name string) (localnotif.Webhooks, bool) {
 	return res, isFind
 }
 
+// LastArrival return time of last segment PUT for stream name, false if no segment arrived
+func (f *Items) LastArrival(name string) (time.Time, bool) {
+	f.fileMut.RLock()
+	defer f.fileMut.RUnlock()
+	res, isFind := f.arrivals[name]
+	return res, isFind
+}
+
+// DelArrival forget time of last segment for stream name
+func (f *Items) DelArrival(name string) {
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	delete(f.arrivals, name)
+}
+
 func (f *Items) clean() {
 	f.wg.Add(1)
 	defer f.wg.Done()
 	for atomic.LoadInt32(f.worked) != 0 {
 		count := f.Clean()
 		f.log.Sugar().Warnf("Items.Clean %d goroutines %d", count, runtime.NumGoroutine())
-		time.Sleep(f.timeout / 10)
+		select {
+		case <-time.After(f.timeout / 10):
+		case <-f.closed:
+		}
 	}
 }
 
 // NewItems create Items
 func NewItems(wg *sync.WaitGroup, logger *zap.Logger, config *localconf.Config, timeout time.Duration, maxtimeout time.Duration, waitdata time.Duration) *Items {
-	res := &Items{wg, logger, config, make(map[string]*itemCond), make(map[string][]*localnotif.Notification), make(map[string][]*localnotif.Webhook), make(map[string][]*localnotif.Webhook), make(map[string][]*localnotif.Webhook), make([]delItem, 0, 1), new(sync.RWMutex), timeout, maxtimeout, waitdata, new(int32)}
+	res := &Items{
+		wg:              wg,
+		log:             logger,
+		conf:            config,
+		items:           newItemMap(),
+		notifications:   make(map[string][]*localnotif.Notification),
+		onStartWebhooks: make(map[string][]*localnotif.Webhook),
+		onStopWebhooks:  make(map[string][]*localnotif.Webhook),
+		onErrorWebhooks: make(map[string][]*localnotif.Webhook),
+		arrivals:        make(map[string]time.Time),
+		delPrefix:       make([]delItem, 0, 1),
+		fileMut:         new(sync.RWMutex),
+		timeout:         timeout,
+		maxTimeout:      maxtimeout,
+		waitData:        waitdata,
+		worked:          new(int32),
+		closed:          make(chan struct{}),
+		maxBytes:        int64(*config.CacheSize) << 20,
+		maxStreamBytes:  int64(*config.StreamCacheSize) << 20,
+		streamBytes:     make(map[string]int64),
+		evicted:         make(map[string]int64),
+		dvrMaxBytes:     int64(*config.DVRCacheSize) << 20,
+		manifestRules:   make(map[string]localconf.ManifestRules),
+		tracks:          make(map[string]map[int]*TrackInfo),
+		dvr:             make(map[string]*dvrStream),
+		fetching:        make(map[string]bool),
+		client:          &http.Client{Timeout: time.Duration(*config.UpstreamTimeout) * time.Second},
+		counters:        make(map[string]*streamStats),
+		total:           &streamStats{},
+		generations:     make(map[string]*generation),
+	}
 	atomic.StoreInt32(res.worked, 1)
 	go res.clean() // тут удаляются в том числе init-stream0.m4s и init-stream1.m4s без них js плеер падает. Ffmpeg сам удаляет старое вызывает DELETE
 	return res
 }
 
 func (f *Items) Close() {
-	atomic.StoreInt32(f.worked, 0)
+	if atomic.SwapInt32(f.worked, 0) != 0 {
+		close(f.closed)
+	}
 }
 
 func copyXML(source *xmlquery.Node, dest *xmlquery.Node) {
@@ -197,46 +301,18 @@ func addAttr(node *xmlquery.Node, attr xml.Attr) {
 }
 
 /*
-add attributes to xml
+change xml by tracks and rules of stream
 */
-func xmlProcessing(data []byte) []byte {
+func xmlProcessing(data []byte, key string, tracks []TrackInfo, rules localconf.ManifestRules) []byte {
 	doc, err := xmlquery.Parse(bytes.NewReader(data))
 	if err != nil {
 		return data
 	}
-	mpd, errMpd := xmlquery.Query(doc, "//MPD")
-	if errMpd == nil && mpd != nil {
-		addAttr(mpd, xml.Attr{Name: xml.Name{Local: "minimumUpdatePeriod"}, Value: "PT30S"})
-	}
-	sd, errLatency := xmlquery.Query(doc, "//MPD/ServiceDescription")
-	if errLatency == nil && sd != nil {
-		// scope, errScope := xmlquery.Query(sd, "//Scope")
-		// if errScope == nil {
-		// 	if scope != nil {
-		// 		scope.Attr = append(scope.Attr, xml.Attr{Name: xml.Name{Local: "schemeIdUri"}, Value: "urn:dvb:dash:lowlatency:scope:2019"})
-		// 	} else {
-		// 		sd.
-		// 	}
-		// }
-		latency, errLatency := xmlquery.Query(sd, "//Latency")
-		if errLatency == nil {
-			if latency == nil {
-				latency = new(xmlquery.Node)
-				latency.Data = "Latency"
-				latency.Type = xmlquery.ElementNode
-				if sd.FirstChild == nil {
-					sd.FirstChild = latency
-					sd.LastChild = latency
-				} else {
-					latency.PrevSibling = sd.LastChild
-					sd.LastChild.NextSibling = latency
-					sd.LastChild = latency
-				}
-				latency.Parent = sd
-			}
-			addAttr(latency, xml.Attr{Name: xml.Name{Local: "target"}, Value: "2000"})
-			addAttr(latency, xml.Attr{Name: xml.Name{Local: "min"}, Value: "1500"})
-			addAttr(latency, xml.Attr{Name: xml.Name{Local: "max"}, Value: "3000"})
+	xmlTracks(doc, tracks)
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.IsHLS() && rule.Match(key) {
+			applyXMLRule(doc, rule)
 		}
 	}
 	return []byte(doc.OutputXML(false))
@@ -265,7 +341,8 @@ func trimString(str string, preffix string, suffix string) string {
 }
 
 /*
-добавляем атрибуты которые не генерит ffmpeg - просто audio не проигрывается в hls.js
+добавляем EXT-X-STREAM-INF который не генерит ffmpeg - просто audio не проигрывается в hls.js,
+BANDWIDTH и CODECS для него берутся из init сегментов (hlsTracks), пока их нет - из правил манифеста
 */
 func hlsProcessing(data []byte) []byte {
 	scaner := bufio.NewScanner(bytes.NewReader(data))
@@ -282,16 +359,16 @@ func hlsProcessing(data []byte) []byte {
 			extXStreamInf = str
 		}
 	}
-	if len(extXStreamInf) > 0 {
+	if len(extXStreamInf) > 0 || len(extXMedia) == 0 {
 		return data
 	}
-	array := strings.Split(extXMedia[13:], ",")
+	array := splitHLSAttrs(extXMedia[13:])
 	if fingKeyGetVal(array, "TYPE") != "AUDIO" {
 		return data
 	}
 	groupID := trimString(fingKeyGetVal(array, "GROUP-ID"), "\"", "\"")
 	uri := trimString(fingKeyGetVal(array, "URI"), "\"", "\"")
-	res.WriteString("#EXT-X-STREAM-INF:BANDWIDTH=132056,CODECS=\"avc1.64001e\",AUDIO=\"")
+	res.WriteString("#EXT-X-STREAM-INF:AUDIO=\"")
 	res.WriteString(groupID)
 	res.WriteString("\"\n")
 	res.WriteString(uri)
@@ -363,9 +440,14 @@ Default is "init-stream$RepresentationID$.$ext$".
 "$ext$" is replaced with the file name extension specific for the segment format.
 */
 func parseChannel(key string) int {
-	index := strings.Index(key, localconf.InitSegmentName)
+	return parseNumberAfter(key, localconf.InitSegmentName)
+}
+
+// parseNumberAfter return number which follows prefix in key, -1 if there is no number
+func parseNumberAfter(key string, prefix string) int {
+	index := strings.Index(key, prefix)
 	if index != -1 {
-		str := key[index+len(localconf.InitSegmentName):]
+		str := key[index+len(prefix):]
 		arr := []rune(str)
 		begin := -1
 		for i, r := range arr {
@@ -408,43 +490,83 @@ func channelName(number int) string {
 func (f *Items) Add(key string, data []byte, contentType string) *Item {
 	timeout := f.timeout
 	channel := -1
+	isSegment := true
+	pinned := false
+	updateMaster := false
 	if strings.Index(key, localconf.InitSegmentName) != -1 {
 		channel = parseChannel(key)
 		timeout = f.maxTimeout
+		pinned = true
+		f.addInit(key, data, channel)
 	} else if strings.HasSuffix(key, ".mpd") {
 		timeout = f.maxTimeout
-		data = xmlProcessing(data)
+		isSegment = false
+		pinned = true
+		rules, _ := f.GetManifestRules(filepath.Dir(key))
+		if depth := f.Timeshift(filepath.Dir(key)); depth > 0 {
+			// правила потока могут переопределить глубину
+			rules = append(localconf.ManifestRules{dvrRule(depth)}, rules...)
+		}
+		data = xmlProcessing(data, key, f.Tracks(filepath.Dir(key)), rules)
 	} else if strings.HasSuffix(key, ".m3u8") {
 		timeout = f.maxTimeout
+		isSegment = false
+		pinned = true
 		if strings.HasSuffix(key, "master.m3u8") {
-			data = hlsProcessing(data)
+			data = f.masterProcessing(key, data)
+		} else {
+			data = llhlsProcessing(data)
+			data = f.dvrPlaylist(key, data)
+			rules, _ := f.GetManifestRules(filepath.Dir(key))
+			data = hlsRules(data, key, rules)
 		}
+	} else if strings.Contains(key, localconf.ChunkSegmentName) {
+		// master.m3u8 ffmpeg пишет один раз, до первых сегментов - дописываем fps и битрейт, когда они известны
+		updateMaster = f.addSegment(key, data)
+	}
+	if depth := f.Timeshift(filepath.Dir(key)); depth > 0 && isSegment && channel == -1 {
+		// сегменты timeshift живут всю глубину окна
+		timeout = depth + f.timeout
 	}
 
-	item := &Item{data: data, contentType: contentType, created: time.Now(), timeout: timeout}
+	item := &Item{data: data, contentType: contentType, created: time.Now(), timeout: timeout, pinned: pinned}
 
 	var res *Item = nil
 
-	// блокировка мапы
+	// блокировка мапы. Она общая, а не шарда ключа: publish генерации меняет сразу все ключи потока,
+	// account и evict ведут общий размер кеша и LRU по всем шардам - зрителей она не тормозит,
+	// попадания и ожидания в Get берут только блокировку шарда
 	f.fileMut.Lock()
-	find, isFind := f.items[key]
-	if !isFind { // новый элемент
-		// меняем содержимое мапы
-		f.items[key] = &itemCond{data: item, cond: sync.NewCond(&sync.Mutex{})}
-		// разблокируем мапу
-		f.fileMut.Unlock()
-	} else { // существующий элемент
-		// разблокируем мапу
-		f.fileMut.Unlock()
-		// берем блокировку на содержимое
-		find.cond.L.Lock()
-		// меняем содержимое, запомним старое значение
-		res = find.data
-		find.data = item
-		// нотификация возможных ожидающих
-		find.cond.Broadcast()
-		// отпускаем блокировку на содержимое
-		find.cond.L.Unlock()
+	if isSegment {
+		// манифесты ffmpeg может переписывать и без новых кадров, поэтому считаем только сегменты
+		f.arrivals[filepath.Dir(key)] = item.created
+	}
+	staged := false
+	if g := f.staging(filepath.Dir(key)); g != nil && isSegment {
+		// сегменты нового запуска ffmpeg не смешиваются с прежними, пока он не выпустил манифест
+		res = g.staged[key]
+		g.staged[key] = item
+		staged = true
+		// staged сегменты занимают память так же, как отдаваемые
+		f.account(key, res, item)
+		f.evict(filepath.Dir(key))
+	} else {
+		if g != nil {
+			f.publish(filepath.Dir(key), g)
+		}
+		// меняем содержимое, запомним старое значение - ожидающие данные просыпаются, мапу держим - по ней считается размер кеша
+		res = f.replace(key, item)
+		f.account(key, res, item)
+		f.evict(filepath.Dir(key))
+	}
+	// разблокируем мапу
+	f.fileMut.Unlock()
+
+	if updateMaster {
+		f.updateMaster(filepath.Dir(key))
+	}
+	if isSegment && channel == -1 && !staged {
+		f.spill(filepath.Dir(key))
 	}
 
 	if channel != -1 {
@@ -467,84 +589,212 @@ func (f *Items) Del(key string) *Item {
 	f.fileMut.Lock()
 	defer f.fileMut.Unlock()
 
-	var res *Item = nil
-	find, isFind := f.items[key]
+	return f.del(key)
+}
+
+// del delete data in cache, staged segment of new run is deleted first, it is called under fileMut
+func (f *Items) del(key string) *Item {
+	if item, isStaged := f.unstage(key); isStaged {
+		return item
+	}
+	return f.remove(key)
+}
+
+// remove delete data which /get serves, it is called under fileMut
+func (f *Items) remove(key string) *Item {
+	res, isFind := f.items.remove(key)
 	if isFind {
-		// существующий элемент
-		find.cond.L.Lock()
-		res = find.data
-		find.data = nil
-		delete(f.items, key)
-		find.cond.Broadcast()
-		find.cond.L.Unlock()
+		// ожидающие проснулись без данных
+		f.account(key, res, nil)
+		if res != nil && len(res.file) > 0 {
+			os.Remove(res.file)
+		}
+	}
+	return res
+}
+
+// replace put item by key instead of previous one, file of previous timeshift segment is removed, it is called under fileMut
+func (f *Items) replace(key string, item *Item) *Item {
+	res := f.items.create(key).swap(item)
+	if res != nil && len(res.file) > 0 {
+		os.Remove(res.file)
 	}
 	return res
 }
 
+func itemSize(item *Item) int64 {
+	if item == nil {
+		return 0
+	}
+	return int64(len(item.data))
+}
+
+// account change size of cache after replace of old item by new one, it is called under fileMut
+func (f *Items) account(key string, old *Item, new *Item) {
+	delta := itemSize(new) - itemSize(old)
+	if delta == 0 {
+		return
+	}
+	dir := filepath.Dir(key)
+	f.bytes += delta
+	f.streamBytes[dir] += delta
+	if f.streamBytes[dir] <= 0 {
+		// поток бывает пуст и на ходу: смена генерации, DELETE последнего сегмента до PUT нового.
+		// Счетчики запросов и вытеснений забывает dropStats после остановки потока
+		delete(f.streamBytes, dir)
+	}
+}
+
+type lruItem struct {
+	key    string
+	used   time.Time
+	staged bool
+}
+
+// evictBy delete the least recently used segments with prefix while over return true, it is called under fileMut
+func (f *Items) evictBy(prefix string, dir string, over func() bool) int {
+	candidates := make([]lruItem, 0)
+	f.items.each(func(key string, find *itemCond) {
+		item := find.item()
+		if item == nil || item.pinned || len(item.file) > 0 || !strings.HasPrefix(key, prefix) {
+			return
+		}
+		if len(dir) > 0 && filepath.Dir(key) != dir {
+			return
+		}
+		if _, isFind := f.dvr[filepath.Dir(key)]; isFind {
+			// сегменты timeshift нужны до конца окна, их память ограничивает spill в dvrDir, а не вытеснение
+			return
+		}
+		candidates = append(candidates, lruItem{key, find.lastUsed(), false})
+	})
+	for dirGeneration, g := range f.generations {
+		if len(dir) > 0 && dirGeneration != dir {
+			continue
+		}
+		for key, item := range g.staged {
+			if !item.pinned && strings.HasPrefix(key, prefix) {
+				// staged сегмент еще никто не смотрел
+				candidates = append(candidates, lruItem{key, item.created, true})
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].used.Before(candidates[j].used) })
+
+	res := 0
+	for _, candidate := range candidates {
+		if !over() {
+			break
+		}
+		var evicted *Item
+		if candidate.staged {
+			evicted, _ = f.unstage(candidate.key)
+		} else {
+			evicted = f.remove(candidate.key)
+		}
+		f.evicted[filepath.Dir(candidate.key)]++
+		f.evictedAll++
+		f.log.Sugar().Warnf("Items.Evict key %s size %d cache %d", candidate.key, itemSize(evicted), f.bytes)
+		res++
+	}
+	return res
+}
+
+// evict delete segments while stream dir or whole cache is over its budget, it is called under fileMut
+func (f *Items) evict(dir string) int {
+	res := 0
+	if f.maxStreamBytes > 0 && f.streamBytes[dir] > f.maxStreamBytes {
+		res += f.evictBy(dir+"/", dir, func() bool { return f.streamBytes[dir] > f.maxStreamBytes })
+	}
+	if f.maxBytes > 0 && f.bytes > f.maxBytes {
+		res += f.evictBy("", "", func() bool { return f.bytes > f.maxBytes })
+	}
+	return res
+}
+
+// touch mark item as used now for LRU
+func (f *Items) touch(key string) {
+	if find, isFind := f.items.load(key); isFind {
+		find.touch()
+	}
+}
+
+// Stats return size and requests of stream dir in cache, empty dir return whole cache with all streams
+func (f *Items) Stats(dir string) CacheStats {
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	if len(dir) == 0 {
+		res := CacheStats{Items: f.items.count(), Bytes: f.bytes, MaxBytes: f.maxBytes, Evicted: f.evictedAll, Streams: f.streamsStats()}
+		f.total.load(&res)
+		return res
+	}
+	res := CacheStats{Bytes: f.streamBytes[dir], MaxBytes: f.maxStreamBytes, Evicted: f.evicted[dir]}
+	f.items.each(func(key string, find *itemCond) {
+		if filepath.Dir(key) == dir {
+			res.Items++
+		}
+	})
+	f.fill(&res, dir)
+	return res
+}
+
 // Get Сложная функция если данные есть она их отдает если данных нет то она их ждет с таймаутом
 // WaitDataInCache. Важно: время ожидания должно быть ОДИНАКОВЫМ для доступа из любых мест,
 // иначе возможно получение пустых данных без гарантированного таймаута
 func (f *Items) Get(key string) *Item {
-	var res *Item = nil
+	res, _ := f.get(context.Background(), key)
+	return res
+}
 
-	// блокировка мапы
-	f.fileMut.Lock()
-	find, isFind := f.items[key]
-	if isFind { // элемент существует
-		// разблокируем мапу
-		f.fileMut.Unlock()
-		// берем блокировку на содержимое
-		find.cond.L.Lock()
-		if find.data != nil { // данные есть
-			res = find.data
-		} else { // данных нет: такое будет если какой то поток тоже ожидает данные
-			// сначала себя обезопасим если совсем никто писать в мапу не будет
-			go func() {
-				time.Sleep(f.waitData)
-				f.wg.Add(1)
-				defer f.wg.Done()
-				find.cond.L.Lock()
-				find.cond.Broadcast()
-				find.cond.L.Unlock()
-			}()
-			// теперь ждем
-			find.cond.Wait()
-			// теперь читаем
-			res = find.data
-		}
-		// отпускаем блокировку на содержимое
-		find.cond.L.Unlock()
-	} else { // элемента нет - создаем его ждем записи
-		// меняем содержимое мапы
-		item := &itemCond{data: nil, cond: sync.NewCond(&sync.Mutex{})}
-		f.items[key] = item
-		// разблокируем мапу
-		f.fileMut.Unlock()
-		// берем блокировку на содержимое
-		item.cond.L.Lock()
-		// сначала себя обезопасим если совсем никто писать в мапу не будет
-		go func() {
-			time.Sleep(f.waitData)
-			f.wg.Add(1)
-			defer f.wg.Done()
-			item.cond.L.Lock()
-			item.cond.Broadcast()
-			item.cond.L.Unlock()
-		}()
-		// теперь ждем
-		item.cond.Wait()
-		// теперь читаем
-		res = item.data
-		// отпускаем блокировку на содержимое
-		item.cond.L.Unlock()
-		// если данных так и не появилось - убираем из мапины структуры мозданные функцией и связанные с ожиданием данных
-		if res == nil {
-			f.Del(key)
-		}
+// getCounted is Get for client request, it counts hit, wait or timeout in stats of stream.
+// Waiting is over when client is gone
+func (f *Items) getCounted(ctx context.Context, key string) *Item {
+	res, waited := f.get(ctx, key)
+	if res == nil && ctx.Err() != nil {
+		// клиент ушел, не дождавшись данных, - это не таймаут кеша
+		return res
 	}
+	f.countGet(key, res, waited)
 	return res
 }
 
+// get return item by key and true if it was waited. Waiting is a channel of key which Add and Del close
+// and a deadline of context, so blocked request has no own goroutine
+func (f *Items) get(ctx context.Context, key string) (*Item, bool) {
+	find, res, changed, isNew := f.items.wait(key)
+	if res != nil { // данные есть
+		return res, false
+	}
+	if isNew {
+		// ключ создал этот запрос, он же уберет его, если данные не придут - поэтому ждет весь таймаут, даже если клиент ушел
+		ctx = context.Background()
+		// на edge данные никто не PUT-ит, грузим их с upstream - остальные запросы ключа ждут эту загрузку
+		f.startFetch(key)
+	}
+	// данных нет: ждем первой записи или удаления ключа
+	ctx, cancel := context.WithTimeout(ctx, f.wait())
+	defer cancel()
+	select {
+	case <-changed:
+	case <-ctx.Done():
+	}
+	res = find.item()
+	if res == nil && isNew {
+		// если данных так и не появилось - убираем ключ, связанный с ожиданием данных
+		f.delEmpty(key)
+	}
+	return res, true
+}
+
+// peek return item by key without waiting, nil if key has no data
+func (f *Items) peek(key string) *Item {
+	find, isFind := f.items.load(key)
+	if !isFind {
+		return nil
+	}
+	return find.item()
+}
+
 // Clean clean old data from cache
 func (f *Items) Clean() int {
 
@@ -555,26 +805,32 @@ func (f *Items) Clean() int {
 	res := 0
 	keys := f.Keys()
 	now := time.Now()
+	// DelAny и CancelDelAny меняют delPrefix под fileMut, работаем с копией
+	f.fileMut.Lock()
+	delPrefix := append([]delItem(nil), f.delPrefix...)
 	pass := make([]delItem, 0, 1)
 	for _, prefix := range f.delPrefix {
 		if now.Sub(prefix.created) <= f.timeout {
 			pass = append(pass, prefix)
 		}
 	}
+	f.delPrefix = pass
+	f.fileMut.Unlock()
 	for _, key := range keys {
-		item := f.Get(key)
+		// Clean не ждет данных: ключи без данных убирает Get, который их создал
+		item := f.peek(key)
 		if item == nil {
-			// элемен удален вызовом Get
 			continue
 		} else if now.Sub(item.created) > item.timeout {
-			f.Del(key)
-			f.log.Sugar().Warnf("Items.Clean key %s", key)
-			res++
+			// удаляем именно просроченный item: его могли заменить, а staged сегмент с тем же ключом - новый запуск
+			if f.delIf(key, item) {
+				f.log.Sugar().Warnf("Items.Clean key %s", key)
+				res++
+			}
 		} else {
-			for _, prefix := range f.delPrefix {
+			for _, prefix := range delPrefix {
 				if now.Sub(prefix.created) > f.timeout {
-					if strings.HasPrefix(key, prefix.key) {
-						f.Del(key)
+					if isStreamKey(key, prefix.key) && f.delIf(key, item) {
 						f.log.Sugar().Warnf("Items.Clean key %s", key)
 						res++
 					}
@@ -582,43 +838,71 @@ func (f *Items) Clean() int {
 			}
 		}
 	}
-	f.delPrefix = pass
+	// счетчики остановленных потоков и промахов /get по несуществующему потоку
+	f.fileMut.Lock()
+	res += f.cleanStaged(now)
+	f.dropStats(now)
+	f.fileMut.Unlock()
 	return res
 }
 
 // Keys return keys stored in cache
 func (f *Items) Keys() []string {
-	f.fileMut.Lock()
-	defer f.fileMut.Unlock()
-
-	keys := make([]string, 0, len(f.items))
-	for k := range f.items {
+	keys := make([]string, 0, f.items.count())
+	f.items.each(func(k string, find *itemCond) {
 		keys = append(keys, k)
-	}
+	})
 
 	return keys
 }
 
+// Count return number of items of stream name, keys of child streams aren't counted
+func (f *Items) Count(name string) int {
+	res := 0
+	f.items.each(func(k string, find *itemCond) {
+		if isStreamKey(k, name) {
+			res++
+		}
+	})
+
+	return res
+}
+
 // Key struct for response
 type Key struct {
-	Key     string    `json:"key,omitempty"`
-	Created time.Time `json:"created,omitempty"`
+	Key         string    `json:"key,omitempty"`
+	Created     time.Time `json:"created,omitempty"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"type,omitempty"`
 }
 
 // KeysCreated build keys from cache
 func (f *Items) KeysCreated() []Key {
-	f.fileMut.Lock()
-	defer f.fileMut.Unlock()
-
-	keys := make([]Key, 0, len(f.items))
-	for k, v := range f.items {
-		keys = append(keys, Key{Key: k, Created: v.data.created})
-	}
+	keys := make([]Key, 0, f.items.count())
+	f.items.each(func(k string, find *itemCond) {
+		item := find.item()
+		if item == nil {
+			// ключ ждет данных в Get
+			return
+		}
+		keys = append(keys, Key{Key: k, Created: item.created, Size: item.Size(), ContentType: item.contentType})
+	})
 
 	return keys
 }
 
-// DelAny - delete all keys start with key in next iteration
+// streamDir return name of stream without trailing slash: "/org/site/" -> "/org/site"
+func streamDir(name string) string {
+	return strings.TrimSuffix(name, "/")
+}
+
+// isStreamKey return true if key is file of stream name itself: keys of /org/site2 and of child stream /org/site/cam
+// aren't keys of /org/site
+func isStreamKey(key string, name string) bool {
+	return filepath.Dir(key) == streamDir(name)
+}
+
+// DelAny - delete all keys of stream key in next iteration
 func (f *Items) DelAny(key string) {
 	f.fileMut.Lock()
 	defer f.fileMut.Unlock()
@@ -629,7 +913,7 @@ func (f *Items) DelAny(key string) {
 	}
 }
 
-// CancelDelAny cancel delete all keys start with key in next iteration
+// CancelDelAny cancel delete all keys of stream key in next iteration, deletes of parent and child streams stay
 func (f *Items) CancelDelAny(key string) int {
 	f.fileMut.Lock()
 	defer f.fileMut.Unlock()
@@ -642,7 +926,7 @@ func (f *Items) CancelDelAny(key string) int {
 	deleted := 0
 	for i := range f.delPrefix {
 		j := i - deleted
-		if strings.HasPrefix(key, f.delPrefix[j].key) {
+		if streamDir(key) == streamDir(f.delPrefix[j].key) {
 			f.delPrefix = f.delPrefix[:j+copy(f.delPrefix[j:], f.delPrefix[j+1:])]
 			deleted++
 		}
@@ -653,32 +937,33 @@ func (f *Items) CancelDelAny(key string) int {
 
 // GetTranslations return translations from cache
 func (f *Items) GetTranslations() map[string]int {
-	keys := f.Keys()
+	return f.Translations("", 0)
+}
+
+// Translations return number of keys by translations inside prefix of any depth,
+// depth > 0 sums translations by first depth parts of name: 1 - /org, 2 - /org/site
+func (f *Items) Translations(prefix string, depth int) map[string]int {
 	res := make(map[string]int)
-	for _, key := range keys {
-		paths := strings.Split(key, "/")
-		path := ""
-		for i := 0; i < len(paths)-1; i++ {
-			path += paths[i]
-			if i < len(paths)-2 {
-				path += "/"
-			}
+	for _, key := range f.Keys() {
+		// последняя часть ключа - файл, все до нее - имя трансляции любой глубины
+		path := filepath.Dir(key)
+		if localconf.HasPathPrefix(path, prefix) {
+			res[localconf.GroupName(path, depth)]++
 		}
-		numbers, _ := res[path]
-		res[path] = numbers + 1
 	}
 	return res
 }
 
-// GetFiles return files for translation
+// GetFiles return files for translation or for all translations inside path sorted by key
 func (f *Items) GetFiles(path string) []Key {
 	keys := f.KeysCreated()
 	res := make([]Key, 0)
 	for _, key := range keys {
-		if strings.HasPrefix(key.Key, path) {
+		if localconf.HasPathPrefix(key.Key, path) {
 			res = append(res, key)
 		}
 	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
 	return res
 }
 
@@ -687,6 +972,17 @@ func Error(c *gin.Context, mess string, code int) {
 	c.Data(code, "text/plain; charset=utf-8", []byte(mess))
 }
 
+// serveData send item from memory, ServeContent answers 304 by If-None-Match/If-Modified-Since, 206 by Range and HEAD without body
+func (f *Items) serveData(c *gin.Context, key string, item *Item) {
+	header := c.Writer.Header()
+	header.Set("Date", item.created.UTC().Format(http.TimeFormat))
+	header.Set("ETag", item.ETag())
+	if len(item.contentType) > 0 {
+		header.Set("Content-Type", item.contentType)
+	}
+	http.ServeContent(c.Writer, c.Request, filepath.Base(key), item.created, bytes.NewReader(item.data))
+}
+
 // func (f *Items) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (f *Items) ServeHTTP(c *gin.Context) {
 	now := time.Now()
@@ -703,13 +999,21 @@ func (f *Items) ServeHTTP(c *gin.Context) {
 
 		if c.Request.Method == "PUT" {
 			key := c.Request.URL.Path[4:]
-			body, err := ioutil.ReadAll(c.Request.Body)
+			f.countPut(key)
+			var body []byte
+			var res *Item
+			var err error
+			if isProgressive(key) {
+				// сегмент доступен на /get уже во время загрузки, это нужно для low latency dash
+				body, res, err = f.Upload(key, c.Request.Body, c.Request.Header.Get("Content-Type"))
+			} else if body, err = ioutil.ReadAll(c.Request.Body); err == nil {
+				res = f.Add(key, body, c.Request.Header.Get("Content-Type"))
+			}
 			if err != nil {
 				f.log.Sugar().Warnf("Error reading body: %v, key %s", err, key)
 				Error(c, "can't read body", http.StatusNoContent)
 			} else {
 				c.Request.Body.Close()
-				res := f.Add(key, body, c.Request.Header.Get("Content-Type"))
 				if res == nil {
 					f.log.Sugar().Infof("Create by key: %v, len(body): %d", key, len(body))
 					Error(c, "created", http.StatusCreated)
@@ -728,6 +1032,11 @@ func (f *Items) ServeHTTP(c *gin.Context) {
 				f.DelAny(key)
 				f.log.Sugar().Infof(fmt.Sprintf("Delete by key: %v is accepted", key))
 				Error(c, "accepted", http.StatusAccepted)
+			} else if f.isDVRSegment(key) {
+				// ffmpeg удаляет сегменты за своим окном, а timeshift держит их до таймаута в Clean
+				f.log.Sugar().Infof("Delete by key: %v is ignored for timeshift", key)
+				Error(c, "update", http.StatusOK)
+				return
 			} else {
 				res := f.Del(key)
 				if res == nil {
@@ -745,17 +1054,58 @@ func (f *Items) ServeHTTP(c *gin.Context) {
 		}
 	} else if strings.HasPrefix(c.Request.URL.Path, "/get") {
 		key := c.Request.URL.Path[4:]
-		res := f.Get(key)
+		// неверные _HLS_msn и _HLS_part отвергнет servePlaylist, upstream их не получает
+		msn, errMsn := strconv.ParseInt(c.Query("_HLS_msn"), 10, 64)
+		if errMsn != nil || msn < 0 {
+			msn = -1
+		}
+		part, errPart := strconv.ParseInt(c.Query("_HLS_part"), 10, 64)
+		if errPart != nil || part < 0 {
+			part = -1
+		}
+		f.refresh(c.Request.Context(), key, msn, part)
+		if isMediaPlaylist(key) {
+			f.servePlaylist(c, key)
+			return
+		}
+		if partStr := c.Query("part"); len(partStr) > 0 && isProgressive(key) {
+			part, errPart := strconv.Atoi(partStr)
+			if errPart != nil || part < 0 {
+				Error(c, "bad part", http.StatusBadRequest)
+				return
+			}
+			f.servePart(c, key, part)
+			return
+		}
+		res := f.getCounted(c.Request.Context(), key)
 		if res == nil {
 			Error(c, "no content", http.StatusNoContent)
+		} else if res.partial != nil {
+			f.touch(key)
+			f.serveUpload(c, key, res)
+		} else if len(res.file) > 0 {
+			f.touch(key)
+			f.serveFile(c, key, res)
 		} else {
-			headers := make(map[string]string)
-			headers["Date"] = res.created.UTC().Format(http.TimeFormat)
-			c.DataFromReader(http.StatusOK, int64(len(res.data)), "", bytes.NewReader(res.data), headers)
+			f.touch(key)
+			f.serveData(c, key, res)
 		}
+	} else if strings.HasPrefix(c.Request.URL.Path, "/cache") {
+		dir := strings.TrimSuffix(c.Request.URL.Path[6:], "/")
+		if depth, _ := strconv.Atoi(c.Query("depth")); depth > 0 {
+			c.JSON(http.StatusOK, Response{Errno: OK, Error: "ok", Data: f.GroupStats(dir, depth)})
+			return
+		}
+		c.JSON(http.StatusOK, Response{Errno: OK, Error: "ok", Data: f.Stats(dir)})
 	} else if strings.HasPrefix(c.Request.URL.Path, "/info") {
-		key := c.Request.URL.Path[5:]
-		if len(key) == 0 {
+		// на edge список потоков у upstream, свой кеш знает только то, что уже смотрели
+		if f.conf.IsEdge() && f.relay(c) {
+			return
+		}
+		key := strings.TrimSuffix(c.Request.URL.Path[5:], "/")
+		if depth, _ := strconv.Atoi(c.Query("depth")); depth > 0 {
+			c.JSON(http.StatusOK, Response{Errno: OK, Error: "ok", Data: f.Translations(key, depth)})
+		} else if len(key) == 0 {
 			res := f.GetTranslations()
 			c.JSON(http.StatusOK, Response{Errno: OK, Error: "ok", Data: res})
 		} else {
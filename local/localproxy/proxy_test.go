@@ -0,0 +1,392 @@
+package localproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"camctl/local/localconf"
+)
+
+// newTestItems create Items with unlimited cache and no upstream
+func newTestItems(tb testing.TB, waitData time.Duration) *Items {
+	var size, streamSize, dvrSize, upstreamTimeout uint = 0, 0, 64, 1
+	upstream := ""
+	workDir := tb.TempDir()
+	conf := &localconf.Config{CacheSize: &size, StreamCacheSize: &streamSize, DVRCacheSize: &dvrSize, DVRDir: &workDir, Upstream: &upstream, UpstreamTimeout: &upstreamTimeout}
+	res := NewItems(new(sync.WaitGroup), zap.NewNop(), conf, time.Minute, time.Minute, waitData)
+	tb.Cleanup(res.Close)
+	return res
+}
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testServe pass request to ServeHTTP as gin does, header is pairs of names and values
+func testServe(items *Items, method string, target string, header ...string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		c.Request.Header.Set(header[i], header[i+1])
+	}
+	items.ServeHTTP(c)
+	// gin пишет статус без тела после обработчиков, так приходят 304 и ответы на HEAD
+	c.Writer.WriteHeaderNow()
+	return w
+}
+
+func TestGetWaitsAdd(t *testing.T) {
+	items := newTestItems(t, time.Second)
+	key := "/user/cam/chunk-stream0-00001.m4s"
+	res := make(chan *Item)
+	go func() {
+		res <- items.Get(key)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	items.Add(key, []byte("data"), "video/mp4")
+	select {
+	case item := <-res:
+		if item == nil || string(item.data) != "data" {
+			t.Errorf("Get return %v", item)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get isn't woken up by Add")
+	}
+}
+
+func TestGetTimeout(t *testing.T) {
+	items := newTestItems(t, 10*time.Millisecond)
+	key := "/user/cam/chunk-stream0-00001.m4s"
+	if item := items.Get(key); item != nil {
+		t.Errorf("Get of missing key return %v", item)
+	}
+	// ключ ожидания убирает тот Get, который его создал
+	if _, isFind := items.items.load(key); isFind {
+		t.Error("key of waiting is left after timeout")
+	}
+}
+
+func TestGetWakesOnDel(t *testing.T) {
+	items := newTestItems(t, time.Minute)
+	key := "/user/cam/chunk-stream0-00001.m4s"
+	res := make(chan *Item)
+	go func() {
+		res <- items.Get(key)
+	}()
+	for {
+		if _, isFind := items.items.load(key); isFind {
+			break
+		}
+		runtime.Gosched()
+	}
+	items.Del(key)
+	select {
+	case item := <-res:
+		if item != nil {
+			t.Errorf("Get return %v after Del", item)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get isn't woken up by Del")
+	}
+}
+
+func TestDelAnyNames(t *testing.T) {
+	items := newTestItems(t, time.Millisecond)
+	keys := []string{"/org/site/chunk-stream0-00001.m4s", "/org/site2/chunk-stream0-00001.m4s", "/org/site/cam/chunk-stream0-00001.m4s"}
+	for _, key := range keys {
+		items.Add(key, []byte("data"), "video/mp4")
+	}
+	if n := items.Count("/org/site"); n != 1 {
+		t.Errorf("Count of /org/site %d, want 1", n)
+	}
+	// старт дочернего потока не отменяет удаление родителя
+	items.DelAny("/org/site")
+	if n := items.CancelDelAny("/org/site/cam"); n != 0 {
+		t.Errorf("start of /org/site/cam cancel %d deletes of /org/site", n)
+	}
+	items.timeout = 0
+	items.Clean()
+	for i, key := range keys {
+		if isFind := items.peek(key) != nil; isFind != (i > 0) {
+			t.Errorf("key %s is left %v after stop of /org/site", key, isFind)
+		}
+	}
+
+	items.DelAny("/org/site2/")
+	if n := items.CancelDelAny("/org/site2"); n != 1 {
+		t.Errorf("start of /org/site2 cancel %d deletes, want 1", n)
+	}
+}
+
+func TestGetConditional(t *testing.T) {
+	items := newTestItems(t, 10*time.Millisecond)
+	key := "/user/cam/chunk-stream0-00001.m4s"
+	items.Add(key, []byte("0123456789"), "video/mp4")
+	target := "/get" + key
+
+	res := testServe(items, "GET", target)
+	etag := res.Header().Get("ETag")
+	if res.Code != http.StatusOK || res.Body.String() != "0123456789" || len(etag) == 0 {
+		t.Fatalf("GET = %d %q, ETag %q", res.Code, res.Body.String(), etag)
+	}
+	tests := []struct {
+		method string
+		header []string
+		code   int
+		body   string
+	}{
+		{"GET", []string{"If-None-Match", etag}, http.StatusNotModified, ""},
+		{"GET", []string{"If-None-Match", `"other"`}, http.StatusOK, "0123456789"},
+		{"GET", []string{"Range", "bytes=2-5"}, http.StatusPartialContent, "2345"},
+		{"GET", []string{"Range", "bytes=20-"}, http.StatusRequestedRangeNotSatisfiable, ""},
+		{"HEAD", nil, http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		res := testServe(items, test.method, target, test.header...)
+		body := res.Body.String()
+		if test.code == http.StatusRequestedRangeNotSatisfiable {
+			body = ""
+		}
+		if res.Code != test.code || body != test.body {
+			t.Errorf("%s %v = %d %q, want %d %q", test.method, test.header, res.Code, body, test.code, test.body)
+		}
+	}
+	if res := testServe(items, "HEAD", target); res.Header().Get("Content-Length") != "10" || res.Header().Get("ETag") != etag {
+		t.Errorf("HEAD Content-Length %q, ETag %q", res.Header().Get("Content-Length"), res.Header().Get("ETag"))
+	}
+}
+
+func TestEvict(t *testing.T) {
+	var size, streamSize, dvrSize, upstreamTimeout uint = 2, 1, 64, 1
+	upstream := ""
+	workDir := t.TempDir()
+	conf := &localconf.Config{CacheSize: &size, StreamCacheSize: &streamSize, DVRCacheSize: &dvrSize, DVRDir: &workDir, Upstream: &upstream, UpstreamTimeout: &upstreamTimeout}
+	items := NewItems(new(sync.WaitGroup), zap.NewNop(), conf, time.Minute, time.Minute, time.Millisecond)
+	defer items.Close()
+
+	const kb = 1024
+	add := func(key string, size int) {
+		items.Add(key, make([]byte, size), "video/mp4")
+		time.Sleep(time.Millisecond)
+	}
+	add("/user/cam0/init-stream0.m4s", 100*kb)
+	for i := 1; i <= 3; i++ {
+		add(fmt.Sprintf("/user/cam0/chunk-stream0-%05d.m4s", i), 300*kb)
+	}
+	// первый сегмент смотрят, поэтому по LRU первым уходит второй
+	items.touch("/user/cam0/chunk-stream0-00001.m4s")
+	add("/user/cam0/chunk-stream0-00004.m4s", 300*kb)
+	for i := 1; i <= 4; i++ {
+		add(fmt.Sprintf("/user/cam1/chunk-stream0-%05d.m4s", i), 300*kb)
+	}
+	// бюджет потоков соблюден, а весь кеш превышен: уходит самый давний сегмент любого потока
+	add("/user/cam2/chunk-stream0-00001.m4s", 300*kb)
+
+	tests := []struct {
+		key  string
+		left bool
+	}{
+		{"/user/cam0/init-stream0.m4s", true},
+		{"/user/cam0/chunk-stream0-00001.m4s", true},
+		{"/user/cam0/chunk-stream0-00002.m4s", false},
+		{"/user/cam0/chunk-stream0-00003.m4s", false},
+		{"/user/cam0/chunk-stream0-00004.m4s", true},
+		{"/user/cam1/chunk-stream0-00001.m4s", false},
+		{"/user/cam1/chunk-stream0-00002.m4s", true},
+		{"/user/cam1/chunk-stream0-00004.m4s", true},
+		{"/user/cam2/chunk-stream0-00001.m4s", true},
+	}
+	for _, test := range tests {
+		if left := items.peek(test.key) != nil; left != test.left {
+			t.Errorf("key %s is left %v, want %v", test.key, left, test.left)
+		}
+	}
+	if res := items.Stats(""); res.Bytes > 2<<20 || res.Evicted != 3 {
+		t.Errorf("cache %d bytes, evicted %d, want not over %d and 3", res.Bytes, res.Evicted, 2<<20)
+	}
+	if res := items.Stats("/user/cam1"); res.Bytes > 1<<20 || res.Evicted != 1 {
+		t.Errorf("cam1 %d bytes, evicted %d, want not over %d and 1", res.Bytes, res.Evicted, 1<<20)
+	}
+
+	// манифест и init не вытесняются, даже если поток из них одних не влезает в бюджет
+	add("/user/cam3/init-stream0.m4s", 600*kb)
+	items.Add("/user/cam3/manifest.mpd", []byte(strings.Repeat(" ", 600*kb)), "application/dash+xml")
+	if items.peek("/user/cam3/init-stream0.m4s") == nil || items.peek("/user/cam3/manifest.mpd") == nil {
+		t.Error("pinned items are evicted")
+	}
+}
+
+// TestItemsRace run Get, Wait, Add, Del and Clean of the same keys together, it is for go test -race
+func TestItemsRace(t *testing.T) {
+	items := newTestItems(t, 5*time.Millisecond)
+	items.maxBytes = 4 * 1024
+	keys := make([]string, 8)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("/user/cam%d/chunk-stream0-%05d.m4s", i%2, i)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	run := func(fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				fn(i)
+			}
+		}()
+	}
+	for j := 0; j < 4; j++ {
+		run(func(i int) {
+			items.Add(keys[i%len(keys)], make([]byte, 512), "video/mp4")
+		})
+		run(func(i int) {
+			if item := items.Get(keys[i%len(keys)]); item != nil && len(item.data) != 512 {
+				t.Errorf("Get return %d bytes", len(item.data))
+			}
+		})
+		run(func(i int) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			items.Wait(ctx, keys[i%len(keys)], func(item *Item) (bool, <-chan struct{}) { return false, nil }, time.Millisecond)
+			cancel()
+		})
+	}
+	run(func(i int) {
+		items.Del(keys[i%len(keys)])
+	})
+	run(func(i int) {
+		items.DelAny("/user/cam1/")
+		items.CancelDelAny("/user/cam1/")
+	})
+	run(func(i int) {
+		items.Clean()
+		items.Stats("")
+		items.KeysCreated()
+	})
+	run(func(i int) {
+		if i%100 == 0 {
+			id := items.NewGeneration("/user/cam0")
+			items.Add("/user/cam0/media_0.m3u8", []byte("#EXTM3U\n"), "application/vnd.apple.mpegurl")
+			items.DelGeneration("/user/cam0", id)
+		}
+	})
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	items.fileMut.Lock()
+	defer items.fileMut.Unlock()
+	if items.maxBytes > 0 && items.bytes > items.maxBytes {
+		t.Errorf("cache %d is over budget %d", items.bytes, items.maxBytes)
+	}
+	size := int64(0)
+	items.items.each(func(key string, find *itemCond) {
+		size += itemSize(find.item())
+	})
+	for _, g := range items.generations {
+		for _, item := range g.staged {
+			size += itemSize(item)
+		}
+	}
+	if size != items.bytes {
+		t.Errorf("size of items %d, accounted %d", size, items.bytes)
+	}
+}
+
+// BenchmarkGetWaiters1k measure wake up of 1000 Get waiting for one key, waiters must not start own goroutines
+func BenchmarkGetWaiters1k(b *testing.B) {
+	const waiters = 1000
+	items := newTestItems(b, time.Minute)
+	data := make([]byte, 1024)
+	extra := 0
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		key := fmt.Sprintf("/bench/cam/chunk-stream0-%05d.m4s", i)
+		base := runtime.NumGoroutine()
+		var done sync.WaitGroup
+		var got int32
+		done.Add(waiters)
+		for j := 0; j < waiters; j++ {
+			go func() {
+				defer done.Done()
+				if items.Get(key) != nil {
+					atomic.AddInt32(&got, 1)
+				}
+			}()
+		}
+		// ждем, пока все ожидающие заблокируются на канале ключа
+		for {
+			if _, isFind := items.items.load(key); isFind && runtime.NumGoroutine()-base >= waiters {
+				break
+			}
+			runtime.Gosched()
+		}
+		time.Sleep(time.Millisecond)
+		if n := runtime.NumGoroutine() - base - waiters; n > extra {
+			extra = n
+		}
+		b.StartTimer()
+
+		items.Add(key, data, "video/mp4")
+		done.Wait()
+
+		if got != waiters {
+			b.Fatalf("%d of %d waiters got data", got, waiters)
+		}
+	}
+	b.ReportMetric(float64(extra), "extra-goroutines")
+}
+
+// BenchmarkGetHitParallel measure Get of cached keys from many goroutines, hit takes only lock of shard
+func BenchmarkGetHitParallel(b *testing.B) {
+	items := newTestItems(b, time.Second)
+	data := make([]byte, 1024)
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("/bench/cam%d/chunk-stream0-00001.m4s", i)
+		items.Add(keys[i], data, "video/mp4")
+	}
+	var next int32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddInt32(&next, 1))
+		for pb.Next() {
+			if items.Get(keys[i%len(keys)]) == nil {
+				b.Fatal("cached key isn't found")
+			}
+			i++
+		}
+	})
+}
+
+// BenchmarkAddParallel measure PUT of segments of different streams, it is serialized by fileMut
+func BenchmarkAddParallel(b *testing.B) {
+	items := newTestItems(b, time.Second)
+	data := make([]byte, 1024)
+	var stream int32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		name := fmt.Sprintf("/bench/cam%d", atomic.AddInt32(&stream, 1))
+		i := 0
+		for pb.Next() {
+			items.Add(fmt.Sprintf("%s/chunk-stream0-%05d.m4s", name, i%100), data, "video/mp4")
+			i++
+		}
+	})
+}
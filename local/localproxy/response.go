@@ -3,8 +3,10 @@ package localproxy
 type RespType int
 
 const (
-	OK       RespType = 0
-	NotFound          = 1
+	OK          RespType = 0
+	NotFound             = 1
+	ProbeFailed          = 2
+	BadName              = 3
 )
 
 // Response is describe out json
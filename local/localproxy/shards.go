@@ -0,0 +1,169 @@
+package localproxy
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// ItemShards - number of parts of cache map, every part has own lock
+	ItemShards int = 32
+)
+
+type itemCond struct {
+	mut     *sync.Mutex
+	data    *Item
+	changed chan struct{} // закрывается при каждой смене data, так просыпаются ожидающие в Get и Wait
+	used    time.Time     // последняя отдача клиенту, для вытеснения по LRU
+}
+
+func newItemCond() *itemCond {
+	res := itemCond{mut: new(sync.Mutex), changed: make(chan struct{})}
+	return &res
+}
+
+// load return data and channel which is closed on next change of data
+func (i *itemCond) load() (*Item, <-chan struct{}) {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	return i.data, i.changed
+}
+
+func (i *itemCond) item() *Item {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	return i.data
+}
+
+// swap replace data and wake up waiting for it, return previous data
+func (i *itemCond) swap(data *Item) *Item {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	res := i.data
+	i.data = data
+	if data != nil {
+		i.used = data.created
+	}
+	close(i.changed)
+	i.changed = make(chan struct{})
+	return res
+}
+
+func (i *itemCond) touch() {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	i.used = time.Now()
+}
+
+func (i *itemCond) lastUsed() time.Time {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	return i.used
+}
+
+type itemShard struct {
+	mut   *sync.RWMutex
+	items map[string]*itemCond
+}
+
+// itemMap is map of cache split by hash of key: requests of different keys don't wait one lock.
+// Keys are added by Get without fileMut, data is changed and keys are deleted only under fileMut
+type itemMap []*itemShard
+
+func newItemMap() itemMap {
+	res := make(itemMap, ItemShards)
+	for i := range res {
+		res[i] = &itemShard{mut: new(sync.RWMutex), items: make(map[string]*itemCond)}
+	}
+	return res
+}
+
+// shard return part of map by FNV-1a hash of key
+func (m itemMap) shard(key string) *itemShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return m[h%uint32(len(m))]
+}
+
+func (m itemMap) load(key string) (*itemCond, bool) {
+	s := m.shard(key)
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	res, isFind := s.items[key]
+	return res, isFind
+}
+
+// create return element by key, new empty element is added if key isn't found
+func (m itemMap) create(key string) *itemCond {
+	s := m.shard(key)
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	res, isFind := s.items[key]
+	if !isFind {
+		res = newItemCond()
+		s.items[key] = res
+	}
+	return res
+}
+
+// wait return element by key with its data and channel of change, new empty element is added if key isn't found.
+// Data is read under lock of shard, so remove after it closes returned channel
+func (m itemMap) wait(key string) (*itemCond, *Item, <-chan struct{}, bool) {
+	s := m.shard(key)
+	// попадание в кеш берет только блокировку на чтение
+	s.mut.RLock()
+	res, isFind := s.items[key]
+	if isFind {
+		data, changed := res.load()
+		s.mut.RUnlock()
+		return res, data, changed, false
+	}
+	s.mut.RUnlock()
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	res, isFind = s.items[key]
+	if !isFind {
+		res = newItemCond()
+		s.items[key] = res
+	}
+	data, changed := res.load()
+	return res, data, changed, !isFind
+}
+
+// remove delete element by key and wake up waiting for it, return its data
+func (m itemMap) remove(key string) (*Item, bool) {
+	s := m.shard(key)
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	find, isFind := s.items[key]
+	if !isFind {
+		return nil, false
+	}
+	delete(s.items, key)
+	return find.swap(nil), true
+}
+
+// each call fn for every element, fn must not change map
+func (m itemMap) each(fn func(key string, find *itemCond)) {
+	for _, s := range m {
+		s.mut.RLock()
+		for key, find := range s.items {
+			fn(key, find)
+		}
+		s.mut.RUnlock()
+	}
+}
+
+func (m itemMap) count() int {
+	res := 0
+	for _, s := range m {
+		s.mut.RLock()
+		res += len(s.items)
+		s.mut.RUnlock()
+	}
+	return res
+}
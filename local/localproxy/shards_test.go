@@ -0,0 +1,75 @@
+package localproxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestItemMap(t *testing.T) {
+	m := newItemMap()
+	if _, isFind := m.load("/user/cam/a.m4s"); isFind {
+		t.Fatal("empty map has key")
+	}
+
+	find, data, changed, isNew := m.wait("/user/cam/a.m4s")
+	if data != nil || !isNew {
+		t.Fatalf("first wait: data %v, new %v", data, isNew)
+	}
+	if _, _, _, isNew := m.wait("/user/cam/a.m4s"); isNew {
+		t.Error("second wait created key again")
+	}
+	if m.create("/user/cam/a.m4s") != find {
+		t.Error("create return other element for existing key")
+	}
+
+	item := &Item{data: []byte("a"), created: time.Now()}
+	if old := find.swap(item); old != nil {
+		t.Errorf("swap of empty element return %v", old)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Error("swap doesn't wake up waiting")
+	}
+	if _, data, _, _ := m.wait("/user/cam/a.m4s"); data != item {
+		t.Error("wait doesn't return data")
+	}
+
+	_, _, changed, _ = m.wait("/user/cam/a.m4s")
+	if res, isFind := m.remove("/user/cam/a.m4s"); !isFind || res != item {
+		t.Errorf("remove = %v, %v", res, isFind)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Error("remove doesn't wake up waiting")
+	}
+	if _, isFind := m.remove("/user/cam/a.m4s"); isFind {
+		t.Error("removed key is found")
+	}
+}
+
+func TestItemMapShards(t *testing.T) {
+	m := newItemMap()
+	const count = 3200
+	for i := 0; i < count; i++ {
+		m.create(fmt.Sprintf("/user/cam%d/chunk-stream0-%05d.m4s", i%10, i))
+	}
+	if n := m.count(); n != count {
+		t.Fatalf("count %d, want %d", n, count)
+	}
+	keys := 0
+	m.each(func(key string, find *itemCond) {
+		keys++
+	})
+	if keys != count {
+		t.Errorf("each visit %d keys, want %d", keys, count)
+	}
+	// ключи одного потока не должны собираться в одной части
+	for i, s := range m {
+		if n := len(s.items); n < count/ItemShards/2 || n > count/ItemShards*2 {
+			t.Errorf("shard %d has %d keys of %d", i, n, count)
+		}
+	}
+}
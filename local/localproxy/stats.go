@@ -0,0 +1,154 @@
+package localproxy
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"camctl/local/localconf"
+)
+
+// streamStats count requests to cache of one stream, counters are changed atomically
+type streamStats struct {
+	puts     int64
+	hits     int64 // данные были в кеше
+	waits    int64 // данные дождались за WaitDataInCache
+	timeouts int64 // за WaitDataInCache данные не пришли
+}
+
+// stats return counters of stream dir, it is called under fileMut
+func (f *Items) stats(dir string) *streamStats {
+	res, isFind := f.counters[dir]
+	if !isFind {
+		res = &streamStats{}
+		f.counters[dir] = res
+	}
+	return res
+}
+
+// counter return counters of stream dir, exclusive lock is taken only for new stream
+func (f *Items) counter(dir string) *streamStats {
+	f.fileMut.RLock()
+	res, isFind := f.counters[dir]
+	f.fileMut.RUnlock()
+	if isFind {
+		return res
+	}
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	return f.stats(dir)
+}
+
+// countPut count PUT of key from ffmpeg
+func (f *Items) countPut(key string) {
+	atomic.AddInt64(&f.counter(filepath.Dir(key)).puts, 1)
+	atomic.AddInt64(&f.total.puts, 1)
+}
+
+// countGet count result of Get for client request of key
+func (f *Items) countGet(key string, item *Item, waited bool) {
+	for _, s := range []*streamStats{f.counter(filepath.Dir(key)), f.total} {
+		switch {
+		case item == nil:
+			atomic.AddInt64(&s.timeouts, 1)
+		case waited:
+			atomic.AddInt64(&s.waits, 1)
+		default:
+			atomic.AddInt64(&s.hits, 1)
+		}
+	}
+}
+
+// load copy counters into res
+func (s *streamStats) load(res *CacheStats) {
+	res.Puts = atomic.LoadInt64(&s.puts)
+	res.Hits = atomic.LoadInt64(&s.hits)
+	res.Waits = atomic.LoadInt64(&s.waits)
+	res.Timeouts = atomic.LoadInt64(&s.timeouts)
+}
+
+// dropStats forget counters of stopped streams, it is called under fileMut. Stream is stopped when it has no data
+// in cache and no segment for timeout of cache: stop of stream forgets its last arrival, edge has no stop and waits timeout
+func (f *Items) dropStats(now time.Time) {
+	stopped := func(dir string) bool {
+		if _, isFind := f.streamBytes[dir]; isFind {
+			return false
+		}
+		arrival, isFind := f.arrivals[dir]
+		return !isFind || now.Sub(arrival) > f.timeout
+	}
+	for dir := range f.counters {
+		if stopped(dir) {
+			delete(f.counters, dir)
+		}
+	}
+	for dir := range f.evicted {
+		if stopped(dir) {
+			delete(f.evicted, dir)
+		}
+	}
+}
+
+// fill add counters and age of newest segment of stream dir into res, it is called under fileMut
+func (f *Items) fill(res *CacheStats, dir string) {
+	if s, isFind := f.counters[dir]; isFind {
+		s.load(res)
+	}
+	if arrival, isFind := f.arrivals[dir]; isFind {
+		res.SegmentAge = time.Since(arrival).Seconds()
+	}
+}
+
+// StreamsStats return stats of all streams in cache by dir
+func (f *Items) StreamsStats() map[string]CacheStats {
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	return f.streamsStats()
+}
+
+// streamsStats is called under fileMut
+func (f *Items) streamsStats() map[string]CacheStats {
+	res := make(map[string]CacheStats)
+	f.items.each(func(key string, find *itemCond) {
+		dir := filepath.Dir(key)
+		curr := res[dir]
+		curr.Items++
+		res[dir] = curr
+	})
+	for dir := range f.counters {
+		res[dir] = res[dir]
+	}
+	for dir, curr := range res {
+		curr.Bytes = f.streamBytes[dir]
+		curr.MaxBytes = f.maxStreamBytes
+		curr.Evicted = f.evicted[dir]
+		f.fill(&curr, dir)
+		res[dir] = curr
+	}
+	return res
+}
+
+// GroupStats return stats of streams inside prefix summed by first depth parts of name
+func (f *Items) GroupStats(prefix string, depth int) map[string]CacheStats {
+	res := make(map[string]CacheStats)
+	for dir, curr := range f.StreamsStats() {
+		if !localconf.HasPathPrefix(dir, prefix) {
+			continue
+		}
+		group := localconf.GroupName(dir, depth)
+		sum, isFind := res[group]
+		if !isFind || curr.SegmentAge < sum.SegmentAge {
+			// возраст группы - по самому свежему потоку
+			sum.SegmentAge = curr.SegmentAge
+		}
+		sum.Items += curr.Items
+		sum.Bytes += curr.Bytes
+		sum.Evicted += curr.Evicted
+		sum.Puts += curr.Puts
+		sum.Hits += curr.Hits
+		sum.Waits += curr.Waits
+		sum.Timeouts += curr.Timeouts
+		res[group] = sum
+	}
+	return res
+}
@@ -0,0 +1,64 @@
+package localproxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStreamStats(t *testing.T) {
+	items := newTestItems(t, 20*time.Millisecond)
+	dir := "/user/cam"
+	key := dir + "/chunk-stream0-00001.m4s"
+	items.countPut(key)
+	items.Add(key, []byte("data"), "video/mp4")
+	if item := items.getCounted(context.Background(), key); item == nil {
+		t.Fatal("segment isn't found")
+	}
+	if item := items.getCounted(context.Background(), dir+"/chunk-stream0-00002.m4s"); item != nil {
+		t.Fatal("missing segment is found")
+	}
+
+	// клиент ушел раньше таймаута: ключ создал другой запрос, этот только ждет
+	missing := dir + "/chunk-stream0-00003.m4s"
+	done := make(chan struct{})
+	go func() {
+		items.Get(missing)
+		close(done)
+	}()
+	for {
+		if _, isFind := items.items.load(missing); isFind {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	items.getCounted(ctx, missing)
+	cancel()
+	<-done
+
+	check := func(when string, puts, hits, timeouts int64) {
+		t.Helper()
+		res := items.Stats(dir)
+		if res.Puts != puts || res.Hits != hits || res.Timeouts != timeouts {
+			t.Errorf("%s: puts %d hits %d timeouts %d, want %d %d %d", when, res.Puts, res.Hits, res.Timeouts, puts, hits, timeouts)
+		}
+	}
+	check("running", 1, 1, 1)
+
+	// ffmpeg удалил последний сегмент до PUT нового: кеш потока пуст, но поток работает
+	items.Del(key)
+	items.Clean()
+	check("empty cache of running stream", 1, 1, 1)
+	items.Add(dir+"/chunk-stream0-00004.m4s", []byte("data"), "video/mp4")
+	check("next segment", 1, 1, 1)
+
+	// остановка потока: данные удалены, время прихода сегментов забыто
+	items.Del(dir + "/chunk-stream0-00004.m4s")
+	items.DelArrival(dir)
+	items.Clean()
+	check("stopped stream", 0, 0, 0)
+	if _, isFind := items.StreamsStats()[dir]; isFind {
+		t.Error("stopped stream is left in stats")
+	}
+}
@@ -0,0 +1,299 @@
+package localproxy
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antchfx/xmlquery"
+
+	"camctl/local/localconf"
+)
+
+const (
+	// TrackRateWindow - number of last segments for bandwidth of track
+	TrackRateWindow int = 10
+)
+
+// TrackInfo describe track of stream parsed from init and media segments in cache
+type TrackInfo struct {
+	ID           int     `json:"id"` // RepresentationID из имени init сегмента
+	Type         string  `json:"type"`
+	Codec        string  `json:"codec"`
+	Width        int     `json:"width,omitempty"`
+	Height       int     `json:"height,omitempty"`
+	FrameRate    float64 `json:"framerate,omitempty"`
+	SampleRate   int     `json:"samplerate,omitempty"`
+	Channels     int     `json:"channels,omitempty"`
+	Bandwidth    int64   `json:"bandwidth,omitempty"`    // пиковый битрейт последних сегментов, бит/с
+	AvgBandwidth int64   `json:"avgbandwidth,omitempty"` // средний битрейт последних сегментов, бит/с
+	timescale    uint32
+	duration     uint32    // длительность кадра по умолчанию из trex
+	rates        []float64 // битрейт последних сегментов
+	partTarget   float64   // самая длинная часть CMAF полных сегментов, секунды
+}
+
+func (t *TrackInfo) isVideo() bool {
+	return t.Type == "video"
+}
+
+// addRate add bitrate of segment and recalculate bandwidth, return true if peak bandwidth is changed noticeably
+func (t *TrackInfo) addRate(rate float64) bool {
+	t.rates = append(t.rates, rate)
+	if len(t.rates) > TrackRateWindow {
+		t.rates = t.rates[1:]
+	}
+	peak := 0.0
+	sum := 0.0
+	for _, r := range t.rates {
+		sum += r
+		if r > peak {
+			peak = r
+		}
+	}
+	prev := t.Bandwidth
+	t.Bandwidth = int64(peak)
+	t.AvgBandwidth = int64(sum / float64(len(t.rates)))
+	// master.m3u8 переписываем только при заметном изменении
+	return prev == 0 || math.Abs(float64(t.Bandwidth-prev)) > float64(prev)/5
+}
+
+// addInit parse init segment of stream and store its track
+func (f *Items) addInit(key string, data []byte, channel int) {
+	parsed, errParse := parseInit(data)
+	if errParse != nil {
+		f.log.Sugar().Warnf("parse init segment %s: %s", key, errParse.Error())
+		return
+	}
+	track := &TrackInfo{ID: channel, Type: parsed.handler, Codec: parsed.codec, Width: parsed.width, Height: parsed.height, SampleRate: parsed.sampleRate, Channels: parsed.channels, timescale: parsed.timescale, duration: parsed.defaultDuration}
+	switch parsed.handler {
+	case "vide":
+		track.Type = "video"
+	case "soun":
+		track.Type = "audio"
+	}
+
+	name := filepath.Dir(key)
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	tracks, isFind := f.tracks[name]
+	if !isFind {
+		tracks = make(map[int]*TrackInfo)
+		f.tracks[name] = tracks
+	}
+	if prev, isFind := tracks[channel]; isFind && prev.Codec == track.Codec && prev.Width == track.Width && prev.Height == track.Height {
+		// ffmpeg после перезапуска пишет тот же init, статистику сегментов не теряем
+		return
+	}
+	tracks[channel] = track
+}
+
+// addSegment measure frame rate and bitrate of media segment, return true if master playlist must be updated
+func (f *Items) addSegment(key string, data []byte) bool {
+	channel := parseNumberAfter(key, localconf.ChunkSegmentName)
+	if channel == -1 {
+		return false
+	}
+	name := filepath.Dir(key)
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	track, isFind := f.tracks[name][channel]
+	if !isFind || track.timescale == 0 {
+		return false
+	}
+	count, duration := parseFragments(data, track.duration)
+	if count == 0 || duration == 0 {
+		return false
+	}
+	seconds := float64(duration) / float64(track.timescale)
+	for _, part := range parseParts(data, track.timescale, track.duration) {
+		if part.duration > track.partTarget {
+			track.partTarget = part.duration
+		}
+	}
+	changed := false
+	if track.isVideo() {
+		fps := math.Round(float64(count)/seconds*1000) / 1000
+		changed = track.FrameRate == 0 && fps > 0
+		track.FrameRate = fps
+	}
+	return track.addRate(float64(len(data))*8/seconds) || changed
+}
+
+// Tracks return tracks of stream name sorted by id
+func (f *Items) Tracks(name string) []TrackInfo {
+	f.fileMut.RLock()
+	defer f.fileMut.RUnlock()
+	res := make([]TrackInfo, 0, len(f.tracks[name]))
+	for _, track := range f.tracks[name] {
+		copyTrack := *track
+		copyTrack.rates = nil
+		res = append(res, copyTrack)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// DelTracks forget tracks of stream name
+func (f *Items) DelTracks(name string) {
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	delete(f.tracks, name)
+}
+
+// masterProcessing write track info and manifest rules into master playlist key, processing is repeatable
+func (f *Items) masterProcessing(key string, data []byte) []byte {
+	data = hlsProcessing(data)
+	data = hlsTracks(data, f.Tracks(filepath.Dir(key)))
+	rules, _ := f.GetManifestRules(filepath.Dir(key))
+	return hlsRules(data, key, rules)
+}
+
+// updateMaster rewrite cached master playlist of stream in place with new track info. It doesn't go
+// through Add: manifest publishes pending generation, and segments of new run must stay hidden until ffmpeg writes it
+func (f *Items) updateMaster(name string) {
+	key := name + "/master.m3u8"
+	item := f.peek(key)
+	if item == nil || item.partial != nil {
+		return
+	}
+	// обработка манифеста повторяемая, поэтому обрабатываем уже обработанный
+	data := f.masterProcessing(key, item.data)
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	if f.staging(name) != nil {
+		// треки нового запуска не описывают master прежнего, свой master новый запуск еще выпустит
+		return
+	}
+	find, isFind := f.items.load(key)
+	if !isFind || find.item() != item {
+		// ffmpeg успел записать новый master
+		return
+	}
+	updated := &Item{data: data, contentType: item.contentType, created: time.Now(), timeout: item.timeout, pinned: item.pinned}
+	f.account(key, find.swap(updated), updated)
+}
+
+// formatFrameRate format frame rate for MPD: 25 or 29970/1000
+func formatFrameRate(fps float64) string {
+	if math.Abs(fps-math.Round(fps)) < 0.01 {
+		return strconv.Itoa(int(math.Round(fps)))
+	}
+	return fmt.Sprintf("%d/1000", int(math.Round(fps*1000)))
+}
+
+// xmlTracks write codecs, resolution, frame rate and bandwidth of tracks into Representation of MPD
+func xmlTracks(doc *xmlquery.Node, tracks []TrackInfo) {
+	for i := range tracks {
+		track := &tracks[i]
+		nodes, errQuery := xmlquery.QueryAll(doc, fmt.Sprintf("//Representation[@id='%d']", track.ID))
+		if errQuery != nil {
+			continue
+		}
+		for _, node := range nodes {
+			addAttr(node, xml.Attr{Name: xml.Name{Local: "codecs"}, Value: track.Codec})
+			if track.isVideo() {
+				addAttr(node, xml.Attr{Name: xml.Name{Local: "width"}, Value: strconv.Itoa(track.Width)})
+				addAttr(node, xml.Attr{Name: xml.Name{Local: "height"}, Value: strconv.Itoa(track.Height)})
+				if track.FrameRate > 0 {
+					addAttr(node, xml.Attr{Name: xml.Name{Local: "frameRate"}, Value: formatFrameRate(track.FrameRate)})
+				}
+			} else if track.SampleRate > 0 {
+				addAttr(node, xml.Attr{Name: xml.Name{Local: "audioSamplingRate"}, Value: strconv.Itoa(track.SampleRate)})
+			}
+			if track.Bandwidth > 0 {
+				addAttr(node, xml.Attr{Name: xml.Name{Local: "bandwidth"}, Value: strconv.FormatInt(track.Bandwidth, 10)})
+			}
+		}
+	}
+}
+
+// hlsTracks write codecs, resolution, frame rate and bandwidth of tracks into EXT-X-STREAM-INF of master playlist
+func hlsTracks(data []byte, tracks []TrackInfo) []byte {
+	if len(tracks) == 0 {
+		return data
+	}
+	lines := splitLines(data)
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			continue
+		}
+		// ffmpeg называет плейлист представления media_<RepresentationID>.m3u8
+		id := -1
+		for j := i + 1; j < len(lines); j++ {
+			if len(lines[j]) > 0 && !strings.HasPrefix(lines[j], "#") {
+				id = parseNumberAfter(lines[j], "media_")
+				break
+			}
+		}
+		attrs := streamInfAttrs(tracks, id, strings.Contains(line, "AUDIO="))
+		if len(attrs) == 0 {
+			continue
+		}
+		lines[i] = "#EXT-X-STREAM-INF:" + setHLSAttrs(line[18:], &localconf.ManifestRule{Attrs: attrs})
+	}
+	return joinLines(lines)
+}
+
+// streamInfAttrs build attributes of EXT-X-STREAM-INF for video track id and audio tracks
+func streamInfAttrs(tracks []TrackInfo, id int, withAudio bool) map[string]string {
+	var video *TrackInfo
+	for i := range tracks {
+		if tracks[i].isVideo() && (video == nil || tracks[i].ID == id) {
+			video = &tracks[i]
+		}
+	}
+	codecs := make([]string, 0, len(tracks))
+	bandwidth := int64(0)
+	avgBandwidth := int64(0)
+	if video != nil {
+		codecs = append(codecs, video.Codec)
+		bandwidth += video.Bandwidth
+		avgBandwidth += video.AvgBandwidth
+	}
+	if withAudio || video == nil {
+		audioBandwidth := int64(0)
+		audioAvg := int64(0)
+		for i := range tracks {
+			track := &tracks[i]
+			if track.isVideo() {
+				continue
+			}
+			// из группы играет одна дорожка, поэтому считаем самую тяжелую
+			if track.Bandwidth > audioBandwidth {
+				audioBandwidth = track.Bandwidth
+				audioAvg = track.AvgBandwidth
+			}
+			isFind := false
+			for _, codec := range codecs {
+				isFind = isFind || codec == track.Codec
+			}
+			if !isFind {
+				codecs = append(codecs, track.Codec)
+			}
+		}
+		bandwidth += audioBandwidth
+		avgBandwidth += audioAvg
+	}
+
+	res := make(map[string]string)
+	if len(codecs) > 0 {
+		res["CODECS"] = "\"" + strings.Join(codecs, ",") + "\""
+	}
+	if video != nil && video.Width > 0 && video.Height > 0 {
+		res["RESOLUTION"] = fmt.Sprintf("%dx%d", video.Width, video.Height)
+	}
+	if video != nil && video.FrameRate > 0 {
+		res["FRAME-RATE"] = fmt.Sprintf("%.3f", video.FrameRate)
+	}
+	if bandwidth > 0 {
+		res["BANDWIDTH"] = strconv.FormatInt(bandwidth, 10)
+		res["AVERAGE-BANDWIDTH"] = strconv.FormatInt(avgBandwidth, 10)
+	}
+	return res
+}
@@ -0,0 +1,44 @@
+package localproxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTracks(t *testing.T) {
+	items := newTestItems(t, time.Millisecond)
+	items.addInit("/user/cam/init-stream0.m4s", testTrackInit("vide", testMdhd, testVisualEntry("avc1", 1920, 1080, testAvcC)), 0)
+	items.addInit("/user/cam/init-stream1.m4s", testTrackInit("soun", testMdhd, testAudioEntry(2, 48000, testESDS(0x11, 0x90))), 1)
+	// битый init не затирает разобранный
+	items.addInit("/user/cam/init-stream0.m4s", []byte("broken"), 0)
+
+	// у видео init без trex, длительность кадра из tfhd: 40 мс - 25 кадров в секунду
+	segment := testSegment(4, 25)
+	if !items.addSegment("/user/cam/chunk-stream0-00001.m4s", segment) {
+		t.Error("first segment doesn't update master")
+	}
+	tracks := items.Tracks("/user/cam")
+	if len(tracks) != 2 {
+		t.Fatalf("Tracks = %+v", tracks)
+	}
+	video := tracks[0]
+	if video.Type != "video" || video.Codec != "avc1.64001f" || video.Width != 1920 || video.Height != 1080 || video.FrameRate != 25 {
+		t.Errorf("video track %+v", video)
+	}
+	// 4 секунды сегмента
+	if want := int64(len(segment) * 8 / 4); video.Bandwidth != want || video.AvgBandwidth != want {
+		t.Errorf("video bandwidth %d/%d, want %d", video.Bandwidth, video.AvgBandwidth, want)
+	}
+	if audio := tracks[1]; audio.Type != "audio" || audio.Codec != "mp4a.40.2" || audio.SampleRate != 48000 || audio.Channels != 2 {
+		t.Errorf("audio track %+v", audio)
+	}
+
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1,AUDIO=\"group_A1\"\nmedia_0.m3u8\n"
+	res := string(hlsTracks([]byte(master), tracks))
+	for _, attr := range []string{`CODECS="avc1.64001f,mp4a.40.2"`, "RESOLUTION=1920x1080", "FRAME-RATE=25.000"} {
+		if !strings.Contains(res, attr) {
+			t.Errorf("%s isn't found in:\n%s", attr, res)
+		}
+	}
+}
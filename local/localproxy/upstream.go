@@ -0,0 +1,213 @@
+package localproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"camctl/local/localconf"
+)
+
+// upstreamPoll is min pause between requests to upstream while blocking reload waits, even if -upstreamTTL is 0
+const upstreamPoll = 50 * time.Millisecond
+
+// wait return max time of waiting data in Get: on edge data may come from upstream which waits too
+func (f *Items) wait() time.Duration {
+	if f.conf.IsEdge() {
+		return f.waitData + time.Duration(*f.conf.UpstreamTimeout)*time.Second
+	}
+	return f.waitData
+}
+
+// upstreamURL build url of upstream camctl for path and query
+func (f *Items) upstreamURL(path string, query string) string {
+	res := strings.TrimSuffix(*f.conf.Upstream, "/") + path
+	if len(query) > 0 {
+		res += "?" + query
+	}
+	return res
+}
+
+// startFetch fetch key from upstream camctl, requests of the same key wait one fetch
+func (f *Items) startFetch(key string) {
+	if !f.conf.IsEdge() {
+		return
+	}
+	f.fileMut.Lock()
+	if f.fetching[key] {
+		f.fileMut.Unlock()
+		return
+	}
+	f.fetching[key] = true
+	f.fileMut.Unlock()
+	// Add до запуска горутины, иначе Wait при остановке может ее не дождаться
+	f.wg.Add(1)
+	go f.fetch(key)
+}
+
+func (f *Items) fetch(key string) {
+	defer f.wg.Done()
+	defer func() {
+		f.fileMut.Lock()
+		delete(f.fetching, key)
+		f.fileMut.Unlock()
+	}()
+
+	resp, errGet := f.client.Get(f.upstreamURL("/get"+key, ""))
+	if errGet != nil {
+		f.log.Sugar().Warnf("upstream %s: %s", key, errGet.Error())
+		// устаревший манифест лучше, чем ничего, а ожидающих пустой ключ отпускаем сразу
+		f.delEmpty(key)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// кеш edge общий для всех зрителей: ошибку upstream получает только пустой ключ, закешированное отдается устаревшим,
+		// а остановленный поток уберет Clean
+		f.log.Sugar().Infof("upstream %s: status %d", key, resp.StatusCode)
+		f.delEmpty(key)
+		return
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if isProgressive(key) {
+		// сегмент отдается зрителям edge по мере прихода с upstream
+		if _, _, errUpload := f.Upload(key, resp.Body, contentType); errUpload != nil {
+			f.log.Sugar().Warnf("upstream %s: %s", key, errUpload.Error())
+		}
+		return
+	}
+	body, errRead := ioutil.ReadAll(resp.Body)
+	if errRead != nil {
+		f.log.Sugar().Warnf("upstream %s: %s", key, errRead.Error())
+		f.delEmpty(key)
+		return
+	}
+	f.Add(key, body, contentType)
+}
+
+// delEmpty delete key if nobody put data by it, waiting requests get no content
+func (f *Items) delEmpty(key string) {
+	f.fileMut.Lock()
+	defer f.fileMut.Unlock()
+	if find, isFind := f.items.load(key); isFind && find.item() == nil {
+		f.del(key)
+	}
+}
+
+// refresh fetch manifest from upstream again if it is older than -upstreamTTL. Playlist in cache is shared by all
+// viewers of edge, so blocking reload _HLS_msn and _HLS_part isn't passed to upstream: refresh polls upstream
+// every -upstreamTTL until playlist has segment msn or its part, msn -1 - request isn't blocking
+func (f *Items) refresh(ctx context.Context, key string, msn int64, part int64) {
+	if !f.conf.IsEdge() || isProgressive(key) || strings.Contains(key, localconf.InitSegmentName) {
+		return
+	}
+	old := f.peek(key)
+	if old == nil {
+		// промах - загрузку начнет Get
+		return
+	}
+	ttl := time.Duration(*f.conf.UpstreamTTL * float64(time.Second))
+	if msn < 0 {
+		if time.Since(old.created) < ttl {
+			return
+		}
+		f.startFetch(key)
+		f.Wait(ctx, key, func(curr *Item) (bool, <-chan struct{}) { return curr != old, nil }, f.wait())
+		return
+	}
+	// ждем столько же, сколько servePlaylist ждет блокирующий запрос
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(3*parseHLS(old.data).target*float64(time.Second)))
+	defer cancel()
+	if ttl < upstreamPoll {
+		ttl = upstreamPoll
+	}
+	for {
+		curr := f.peek(key)
+		if curr == nil {
+			return
+		}
+		data, _ := f.llhlsParts(key, curr.data)
+		playlist := parseHLS(data)
+		if playlist.has(msn, part) || msn > playlist.lastMsn()+2 {
+			// дальше разберется servePlaylist
+			return
+		}
+		if pause := ttl - time.Since(curr.created); pause > 0 {
+			timer := time.NewTimer(pause)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+		f.startFetch(key)
+		if _, ok := f.Wait(ctx, key, func(next *Item) (bool, <-chan struct{}) { return next != curr, nil }, f.wait()); !ok {
+			return
+		}
+	}
+}
+
+// relay pass request to upstream camctl and copy its response, return false if upstream isn't available
+func (f *Items) relay(c *gin.Context) bool {
+	resp, errGet := f.client.Get(f.upstreamURL(c.Request.URL.Path, c.Request.URL.RawQuery))
+	if errGet != nil {
+		f.log.Sugar().Warnf("upstream %s: %s", c.Request.URL.Path, errGet.Error())
+		return false
+	}
+	defer resp.Body.Close()
+	body, errRead := ioutil.ReadAll(resp.Body)
+	if errRead != nil {
+		f.log.Sugar().Warnf("upstream %s: %s", c.Request.URL.Path, errRead.Error())
+		return false
+	}
+	c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	return true
+}
+
+// StreamList return streams for player pages: on edge it is list of upstream, own cache has only streams which are watched.
+// If upstream isn't available list of own cache is returned
+func (f *Items) StreamList() map[string]int {
+	if !f.conf.IsEdge() {
+		return f.GetTranslations()
+	}
+	res, errList := f.upstreamList()
+	if errList != nil {
+		f.log.Sugar().Warnf("upstream /info: %s", errList.Error())
+		return f.GetTranslations()
+	}
+	return res
+}
+
+// upstreamList get /info of upstream camctl
+func (f *Items) upstreamList() (map[string]int, error) {
+	resp, errGet := f.client.Get(f.upstreamURL("/info", ""))
+	if errGet != nil {
+		return nil, errGet
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var res struct {
+		Errno RespType       `json:"errno,omitempty"`
+		Error string         `json:"error,omitempty"`
+		Data  map[string]int `json:"data,omitempty"`
+	}
+	if errDecode := json.NewDecoder(resp.Body).Decode(&res); errDecode != nil {
+		return nil, errDecode
+	}
+	if res.Errno != OK {
+		return nil, fmt.Errorf("%s", res.Error)
+	}
+	if res.Data == nil {
+		res.Data = make(map[string]int)
+	}
+	return res.Data, nil
+}
@@ -0,0 +1,69 @@
+package localproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpstreamErrorKeepsCache(t *testing.T) {
+	var mut sync.Mutex
+	status := http.StatusOK
+	queries := make([]string, 0)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		defer mut.Unlock()
+		queries = append(queries, r.URL.RawQuery)
+		if status != http.StatusOK {
+			http.Error(w, "bad _HLS_msn", status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Write([]byte(testPlaylist))
+	}))
+	defer upstream.Close()
+
+	items := newTestItems(t, time.Second)
+	ttl := 0.0
+	items.conf.Upstream = &upstream.URL
+	items.conf.UpstreamTTL = &ttl
+	key := "/user/cam/media_0.m3u8"
+	if item := items.Get(key); item == nil {
+		t.Fatal("playlist isn't fetched from upstream")
+	}
+
+	// блокирующий запрос следующего сегмента опрашивает upstream без _HLS_msn
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	items.refresh(ctx, key, 14, -1)
+	cancel()
+	mut.Lock()
+	if len(queries) < 2 {
+		t.Errorf("%d requests to upstream while blocking reload, want polling", len(queries))
+	}
+	mut.Unlock()
+
+	// ошибка upstream не удаляет плейлист, который смотрят другие зрители
+	mut.Lock()
+	status = http.StatusBadRequest
+	mut.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	items.refresh(ctx, key, 100, -1)
+	cancel()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	items.refresh(ctx, key, -1, -1)
+	cancel()
+	if items.peek(key) == nil {
+		t.Error("cached playlist is deleted by error of upstream")
+	}
+
+	mut.Lock()
+	defer mut.Unlock()
+	for _, query := range queries {
+		if len(query) > 0 {
+			t.Errorf("query %q of viewer is passed to upstream", query)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package localtmpl
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -8,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -28,6 +30,8 @@ type TmplHandlers struct {
 	items   *localproxy.Items
 	stream  *localffmpeg.StreamHandler
 	storage *localffmpeg.StorageHandler
+	cmd     *localffmpeg.CmdHandler
+	cameras *localffmpeg.Cameras
 }
 
 func (h *TmplHandlers) loadFiles() error {
@@ -60,6 +64,9 @@ func (h *TmplHandlers) loadFiles() error {
 			case "create.html":
 				h.engine.GET("/create.html", h.CreateHandler)
 				h.engine.POST("/create.html", h.CreateHandler)
+			case "cameras.html":
+				h.engine.GET("/cameras.html", h.CamerasHandler)
+				h.engine.POST("/cameras.html", h.CamerasHandler)
 			case "info.html":
 				h.engine.GET("/info.html", h.InfoHandler)
 				h.engine.POST("/info.html", h.InfoHandler)
@@ -91,8 +98,8 @@ func (h *TmplHandlers) RawHandler(c *gin.Context) {
 }
 
 // NewTmplHandlers парсит шаблоны привязывыет урлы и строит объект TmplHandlers
-func NewTmplHandlers(engine *gin.Engine, logger *zap.Logger, config *localconf.Config, items *localproxy.Items, stream *localffmpeg.StreamHandler, storage *localffmpeg.StorageHandler) *TmplHandlers {
-	res := TmplHandlers{engine: engine, log: logger, conf: config, items: items, stream: stream, storage: storage}
+func NewTmplHandlers(engine *gin.Engine, logger *zap.Logger, config *localconf.Config, items *localproxy.Items, stream *localffmpeg.StreamHandler, storage *localffmpeg.StorageHandler, cmd *localffmpeg.CmdHandler, cameras *localffmpeg.Cameras) *TmplHandlers {
+	res := TmplHandlers{engine: engine, log: logger, conf: config, items: items, stream: stream, storage: storage, cmd: cmd, cameras: cameras}
 	res.engine.Delims("{{", "}}")
 	res.engine.SetFuncMap(template.FuncMap{
 		"formatAsDate": formatAsDate,
@@ -142,15 +149,30 @@ type webhookDesc struct {
 
 // streamDesc структура для парсинга параметров при создании вещания - локальная
 type streamDesc struct {
-	URL     string        `json:"url,omitempty"`
-	User    string        `json:"user,omitempty"`
-	Cam     string        `json:"cam,omitempty"`
-	Type    string        `json:"type,omitempty"`
-	WorkDir string        `json:"workdir,omitempty"`
-	Notify  []notifyDesc  `json:"notify,omitempty"`
-	OnStart []webhookDesc `json:"onstart,omitempty"`
-	OnStop  []webhookDesc `json:"onstop,omitempty"`
-	OnError []webhookDesc `json:"onerror,omitempty"`
+	Name      string        `json:"-"` // полное имя потока любой глубины: org/site/cam
+	URL       string        `json:"url,omitempty"`
+	User      string        `json:"user,omitempty"`
+	Cam       string        `json:"cam,omitempty"`
+	Type      string        `json:"type,omitempty"`
+	Cmd       string        `json:"cmd,omitempty"`
+	Params    []string      `json:"params,omitempty"`
+	Probe     string        `json:"probe,omitempty"`
+	Timeshift string        `json:"timeshift,omitempty"`
+	WorkDir   string        `json:"workdir,omitempty"`
+	Notify    []notifyDesc  `json:"notify,omitempty"`
+	OnStart   []webhookDesc `json:"onstart,omitempty"`
+	OnStop    []webhookDesc `json:"onstop,omitempty"`
+	OnError   []webhookDesc `json:"onerror,omitempty"`
+}
+
+// setName fill full name of stream, its first part as user and last part as camera
+func (s *streamDesc) setName(name string) {
+	s.Name = strings.Trim(name, "/")
+	arr := strings.Split(s.Name, "/")
+	s.User = arr[0]
+	if len(arr) > 1 {
+		s.Cam = arr[len(arr)-1]
+	}
 }
 
 func (s *streamDesc) buildFFMPEGStartURL(host string) (string, error) {
@@ -181,6 +203,28 @@ func (s *streamDesc) buildFFMPEGStartURL(host string) (string, error) {
 		return sb.String(), fmt.Errorf("'URL' parse error %s", errParse)
 	}
 	sb.WriteString(url.QueryEscape(s.URL))
+	if len(s.Cmd) > 0 {
+		sb.WriteString("&cmd=")
+		sb.WriteString(url.QueryEscape(s.Cmd))
+	}
+	if len(s.Probe) > 0 {
+		sb.WriteString("&probe=")
+		sb.WriteString(url.QueryEscape(s.Probe))
+	}
+	if len(s.Timeshift) > 0 {
+		sb.WriteString("&timeshift=")
+		sb.WriteString(url.QueryEscape(s.Timeshift))
+	}
+	for _, param := range s.Params {
+		if len(param) == 0 {
+			continue
+		}
+		if !strings.Contains(param, "|") {
+			return sb.String(), fmt.Errorf("'Params' must be 'name|value': %s", param)
+		}
+		sb.WriteString("&param=")
+		sb.WriteString(url.QueryEscape(param))
+	}
 	for _, notify := range s.Notify {
 		var add strings.Builder
 		if len(notify.URL) == 0 {
@@ -272,6 +316,16 @@ func (s *streamDesc) buildFFMPEGStopURL(host string) (string, error) {
 	return sb.String(), nil
 }
 
+// formatParams переводит параметры шаблона в вид name|value
+func formatParams(params map[string]string) []string {
+	res := make([]string, 0, len(params))
+	for name, value := range params {
+		res = append(res, name+"|"+value)
+	}
+	sort.Strings(res)
+	return res
+}
+
 // CreateHandler создает поток
 func (h *TmplHandlers) CreateHandler(c *gin.Context) {
 	data := c.Request.FormValue("data")
@@ -302,7 +356,7 @@ func (h *TmplHandlers) CreateHandler(c *gin.Context) {
 			}
 		}
 	} else {
-		c.HTML(http.StatusOK, "create.html", nil)
+		c.HTML(http.StatusOK, "create.html", h.cmd.List())
 	}
 }
 
@@ -330,9 +384,9 @@ func (h *TmplHandlers) CloseHandler(c *gin.Context) {
 	}
 }
 
-// InfoHandler выводит текущие потоки либо проигрывает указанный
+// InfoHandler выводит текущие потоки со статистикой кеша либо проигрывает указанный
 func (h *TmplHandlers) InfoHandler(c *gin.Context) {
-	curr := h.items.GetTranslations()
+	curr := h.items.StreamsStats()
 	c.HTML(http.StatusOK, "info.html", curr)
 }
 
@@ -341,6 +395,8 @@ type desc struct {
 	Keys    []localproxy.Key
 	Stream  streamDesc
 	Entries []zapcore.Entry
+	Stats   *localffmpeg.StreamStats
+	Camera  *localffmpeg.Camera
 }
 
 // LogHandler выводит детальную информацию о потоке
@@ -350,20 +406,20 @@ func (h *TmplHandlers) LogHandler(c *gin.Context) {
 		c.HTML(http.StatusOK, "mess.html", Mess{Mess: "'path' is empty"})
 	} else {
 		res := desc{Keys: make([]localproxy.Key, 0)}
+		if camera, isFind := h.cameras.ByName(path); isFind {
+			res.Camera = &camera
+		}
 		if strings.HasSuffix(c.Request.URL.Path, "streamlog.html") {
 			res.Keys = h.items.GetFiles(path)
+			res.Stats = h.stream.GetStats(path)
 			stream := h.stream.GetProcArgs(path)
 			res.Stream.Type = "stream"
 			if stream != nil {
 				res.Entries = stream.Log.Buffer(200)
-				res.Stream.URL = stream.URLIn
-				arr := strings.Split(stream.Name, "/")
-				if len(arr) > 0 {
-					res.Stream.User = arr[0]
-				}
-				if len(arr) > 1 {
-					res.Stream.Cam = arr[1]
-				}
+				res.Stream.URL = localffmpeg.HideUser(stream.URLIn)
+				res.Stream.Cmd = stream.Cmd
+				res.Stream.Params = formatParams(stream.Params)
+				res.Stream.setName(stream.Name)
 				res.Stream.WorkDir = filepath.Join(*h.conf.WorkDir, stream.Name)
 				res.Stream.Notify = make([]notifyDesc, 0)
 				for _, n := range stream.Notifications {
@@ -379,14 +435,10 @@ func (h *TmplHandlers) LogHandler(c *gin.Context) {
 			res.Stream.Type = "storage"
 			if stream != nil {
 				res.Entries = stream.Log.Buffer(200)
-				res.Stream.URL = stream.URLIn
-				arr := strings.Split(stream.Name, "/")
-				if len(arr) > 0 {
-					res.Stream.User = arr[0]
-				}
-				if len(arr) > 1 {
-					res.Stream.Cam = arr[1]
-				}
+				res.Stream.URL = localffmpeg.HideUser(stream.URLIn)
+				res.Stream.Cmd = stream.Cmd
+				res.Stream.Params = formatParams(stream.Params)
+				res.Stream.setName(stream.Name)
 				res.Stream.WorkDir = filepath.Join(*h.conf.StoreDir, stream.Name)
 				res.Stream.Notify = make([]notifyDesc, 0)
 				for _, n := range stream.Notifications {
@@ -405,11 +457,97 @@ func (h *TmplHandlers) LogHandler(c *gin.Context) {
 	}
 }
 
+// camerasDesc структура для рендеринга cameras.html
+type camerasDesc struct {
+	Cameras []localffmpeg.Camera
+	Edit    localffmpeg.Camera
+	Cmd     localffmpeg.CmdList
+}
+
+// getMess выполняет запрос к себе и выводит ответ в mess.html
+func (h *TmplHandlers) getMess(c *gin.Context, path string) {
+	req, errReq := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d%s", *h.conf.Port, path), nil)
+	if errReq != nil {
+		c.HTML(http.StatusOK, "mess.html", Mess{Mess: errReq.Error()})
+		return
+	}
+	h.doMess(c, req)
+}
+
+// doMess выполняет запрос и выводит ответ в mess.html
+func (h *TmplHandlers) doMess(c *gin.Context, req *http.Request) {
+	resp, errGet := http.DefaultClient.Do(req)
+	if errGet != nil {
+		c.HTML(http.StatusOK, "mess.html", Mess{Mess: errGet.Error()})
+		return
+	}
+	defer resp.Body.Close()
+	body, errRead := ioutil.ReadAll(resp.Body)
+	if errRead != nil {
+		c.HTML(http.StatusOK, "mess.html", Mess{Mess: errRead.Error()})
+		return
+	}
+	c.HTML(http.StatusOK, "mess.html", Mess{Mess: string(body)})
+}
+
+// CamerasHandler выводит инвентарь камер, сохраняет камеру из data и запускает ее поток или запись
+func (h *TmplHandlers) CamerasHandler(c *gin.Context) {
+	// страница показывает url и логины камер, а ее запросы к себе проходят проверку ip /camera, /stream и /storage
+	if !h.conf.IsTrustedIP(c.Request.RemoteAddr) {
+		h.log.Sugar().Errorf("forbidden by remote ip %s", c.Request.RemoteAddr)
+		c.HTML(http.StatusForbidden, "mess.html", Mess{Mess: "forbidden"})
+		return
+	}
+	id := c.Request.FormValue("id")
+	switch c.Request.FormValue("action") {
+	case "stream":
+		h.getMess(c, "/stream/start/?camera="+url.QueryEscape(id))
+		return
+	case "record":
+		h.getMess(c, "/storage/start/?camera="+url.QueryEscape(id))
+		return
+	case "del":
+		h.getMess(c, "/camera/del/"+url.PathEscape(id))
+		return
+	}
+	data := c.Request.FormValue("data")
+	if len(data) > 0 {
+		var camera localffmpeg.Camera
+		if errUnmarshal := json.Unmarshal([]byte(data), &camera); errUnmarshal != nil {
+			c.HTML(http.StatusOK, "mess.html", Mess{Mess: errUnmarshal.Error()})
+			return
+		}
+		// пароль страница не показывает, пустой - оставляем прежний
+		if old, isFind := h.cameras.Get(camera.ID); isFind && len(camera.Password) == 0 {
+			camera.Password = old.Password
+		}
+		// сохраняем через /camera/set, там же проверка записи
+		body, errMarshal := json.Marshal(camera)
+		if errMarshal != nil {
+			c.HTML(http.StatusOK, "mess.html", Mess{Mess: errMarshal.Error()})
+			return
+		}
+		req, errReq := http.NewRequest(http.MethodPut, fmt.Sprintf("http://127.0.0.1:%d/camera/set/%s", *h.conf.Port, url.PathEscape(camera.ID)), bytes.NewReader(body))
+		if errReq != nil {
+			c.HTML(http.StatusOK, "mess.html", Mess{Mess: errReq.Error()})
+			return
+		}
+		h.doMess(c, req)
+		return
+	}
+	res := camerasDesc{Cameras: h.cameras.List(c.Request.FormValue("tag")), Cmd: h.cmd.List()}
+	if camera, isFind := h.cameras.Get(id); isFind {
+		res.Edit = camera
+		res.Edit.Password = ""
+	}
+	c.HTML(http.StatusOK, "cameras.html", res)
+}
+
 // HlsHandler выводит текущие потоки либо проигрывает указанный
 func (h *TmplHandlers) HlsHandler(c *gin.Context) {
 	url := c.Request.FormValue("url")
 	if len(url) == 0 {
-		curr := h.items.GetTranslations()
+		curr := h.items.StreamList()
 		c.HTML(http.StatusOK, "hls.html", curr)
 		return
 	}
@@ -420,7 +558,7 @@ func (h *TmplHandlers) HlsHandler(c *gin.Context) {
 func (h *TmplHandlers) ShakaHandler(c *gin.Context) {
 	url := c.Request.FormValue("url")
 	if len(url) == 0 {
-		curr := h.items.GetTranslations()
+		curr := h.items.StreamList()
 		c.HTML(http.StatusOK, "shaka.html", curr)
 		return
 	}
@@ -431,7 +569,7 @@ func (h *TmplHandlers) ShakaHandler(c *gin.Context) {
 func (h *TmplHandlers) DashHandler(c *gin.Context) {
 	url := c.Request.FormValue("url")
 	if len(url) == 0 {
-		curr := h.items.GetTranslations()
+		curr := h.items.StreamList()
 		c.HTML(http.StatusOK, "dash.html", curr)
 		return
 	}
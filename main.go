@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
 
 	"go.uber.org/zap"
@@ -84,39 +89,67 @@ func main() {
 	var wg sync.WaitGroup
 
 	proxy := localproxy.NewItems(&wg, blStream.Log, conf, time.Duration(*conf.ChankDur)*time.Second*2, MaxCacheTimeout, WaitDataInCache)
-	server.Engine.GET("/info/:user/:cam", proxy.ServeHTTP)
-	server.Engine.POST("/info/:user/:cam", proxy.ServeHTTP)
-	server.Engine.GET("/info/:user", proxy.ServeHTTP)
-	server.Engine.POST("/info/:user", proxy.ServeHTTP)
+	// имена потоков любой глубины: /org/site/building/cam, поэтому маршруты с *name
+	server.Engine.GET("/info/*name", proxy.ServeHTTP)
+	server.Engine.POST("/info/*name", proxy.ServeHTTP)
+	server.Engine.GET("/cache", proxy.ServeHTTP)
+	server.Engine.GET("/cache/*name", proxy.ServeHTTP)
 	server.Engine.GET("/info", proxy.ServeHTTP)
 	server.Engine.POST("/info", proxy.ServeHTTP)
-	server.Engine.GET("/get/:user/:cam/:file", proxy.ServeHTTP)
-	server.Engine.POST("/get/:user/:cam/:file", proxy.ServeHTTP)
-	server.Engine.PUT("/put/:user/:cam/:file", proxy.ServeHTTP)
-	server.Engine.POST("/put/:user/:cam/:file", proxy.ServeHTTP)
-	server.Engine.DELETE("/put/:user/:cam/:file", proxy.ServeHTTP)
-	server.Engine.DELETE("/put/:user/:cam", proxy.ServeHTTP)
-	server.Engine.DELETE("/put/:user", proxy.ServeHTTP)
-
-	stream := localffmpeg.NewStreamHandler(blStream.Log, conf, proxy)
-	server.Engine.GET("/stream/start/:user/:cam", stream.ServeHTTP)
-	server.Engine.POST("/stream/start/:user/:cam", stream.ServeHTTP)
-	server.Engine.GET("/stream/stop/:user/:cam", stream.ServeHTTP)
-	server.Engine.POST("/stream/stop/:user/:cam", stream.ServeHTTP)
+	server.Engine.GET("/get/*key", proxy.ServeHTTP)
+	server.Engine.POST("/get/*key", proxy.ServeHTTP)
+	server.Engine.HEAD("/get/*key", proxy.ServeHTTP)
+	server.Engine.PUT("/put/*key", proxy.ServeHTTP)
+	server.Engine.POST("/put/*key", proxy.ServeHTTP)
+	server.Engine.DELETE("/put/*key", proxy.ServeHTTP)
+
+	// общий лимит для потоков и записей, чтобы записи не ждали за просмотрами
+	limiter := localffmpeg.NewLimiter(*conf.MaxJobs, map[string]float64{localffmpeg.ClassStream: *conf.MaxStreams, localffmpeg.ClassStorage: *conf.MaxStorages}, int(*conf.MaxQueue))
+
+	// инвентарь камер: потоки и записи запускаются по ?camera=id с настройками камеры
+	cameras := localffmpeg.NewCameras(blStream.Log, filepath.Join(*conf.WorkDir, localffmpeg.CameraFile))
+	camera := localffmpeg.NewCameraHandler(blStream.Log, conf, cameras)
+	server.Engine.GET("/camera/list", camera.ServeHTTP)
+	server.Engine.POST("/camera/list", camera.ServeHTTP)
+	server.Engine.GET("/camera/get/*id", camera.ServeHTTP)
+	server.Engine.PUT("/camera/set/*id", camera.ServeHTTP)
+	server.Engine.POST("/camera/set/*id", camera.ServeHTTP)
+	server.Engine.GET("/camera/del/*id", camera.ServeHTTP)
+	server.Engine.DELETE("/camera/del/*id", camera.ServeHTTP)
+
+	stream := localffmpeg.NewStreamHandler(blStream.Log, conf, proxy, limiter, cameras)
+	server.Engine.GET("/stream/start/*name", stream.ServeHTTP)
+	server.Engine.POST("/stream/start/*name", stream.ServeHTTP)
+	server.Engine.GET("/stream/stop/*name", stream.ServeHTTP)
+	server.Engine.POST("/stream/stop/*name", stream.ServeHTTP)
+	server.Engine.GET("/stream/stats/*name", stream.ServeHTTP)
+	server.Engine.POST("/stream/stats/*name", stream.ServeHTTP)
+	server.Engine.GET("/stream/probe/*name", stream.ServeHTTP)
+	server.Engine.POST("/stream/probe/*name", stream.ServeHTTP)
+	server.Engine.GET("/stream/manifest/*name", stream.ServeHTTP)
+	server.Engine.PUT("/stream/manifest/*name", stream.ServeHTTP)
+	server.Engine.GET("/stream/list", stream.ServeHTTP)
+	server.Engine.POST("/stream/list", stream.ServeHTTP)
 
 	server.Engine.StaticFS("/history", http.Dir(*conf.StoreDir))
 
-	storage := localffmpeg.NewStorageHandler(blStream.Log, conf)
-	server.Engine.GET("/storage/start/:user/:cam", storage.ServeHTTP)
-	server.Engine.GET("/storage/stop/:user/:cam", storage.ServeHTTP)
+	cmd := localffmpeg.NewCmdHandler(blStream.Log, conf)
+	server.Engine.GET("/cmd/list", cmd.ServeHTTP)
+	server.Engine.POST("/cmd/list", cmd.ServeHTTP)
+
+	storage := localffmpeg.NewStorageHandler(blStream.Log, conf, limiter, cameras)
+	server.Engine.GET("/storage/start/*name", storage.ServeHTTP)
+	server.Engine.GET("/storage/stop/*name", storage.ServeHTTP)
+	server.Engine.GET("/storage/list", storage.ServeHTTP)
+	server.Engine.POST("/storage/list", storage.ServeHTTP)
 
 	file := localproxy.NewFiles(&wg, blStream.Log, conf, time.Duration(*conf.ChankDur)*time.Duration(*conf.Chanks)*2*time.Second)
 	server.Engine.GET("/allhistory", file.ServeHTTP)
 	server.Engine.POST("/allhistory", file.ServeHTTP)
-	server.Engine.GET("/allhistory/:user", file.ServeHTTP)
-	server.Engine.POST("/allhistory/:user", file.ServeHTTP)
+	server.Engine.GET("/allhistory/*name", file.ServeHTTP)
+	server.Engine.POST("/allhistory/*name", file.ServeHTTP)
 
-	tmplHandler := localtmpl.NewTmplHandlers(server.Engine, blStream.Log, conf, proxy, stream, storage)
+	tmplHandler := localtmpl.NewTmplHandlers(server.Engine, blStream.Log, conf, proxy, stream, storage, cmd, cameras)
 
 	wsHandler := localws.NewWebsocketLog(stream, storage, blStream.Log)
 	server.Engine.GET("/ws", wsHandler.ServeHTTP)
@@ -133,7 +166,54 @@ func main() {
 
 	blStream.Log.Sugar().Info("Start server")
 
-	server.Engine.Run(*conf.Addr)
+	// сервер слушает до подъема потоков: ffmpeg сразу шлет сегменты на /put, а статус виден в /stream/list
+	srv := &http.Server{Addr: *conf.Addr, Handler: server.Engine}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	errServe := make(chan error, 1)
+	listener, errListen := net.Listen("tcp", srv.Addr)
+	if errListen != nil {
+		errServe <- errListen
+	} else {
+		go func() {
+			errServe <- srv.Serve(listener)
+		}()
+
+		// поднимаем потоки и записи, которые работали до перезапуска
+		blStream.Log.Sugar().Infof("Restore streams %d", stream.Restore())
+		blStream.Log.Sugar().Infof("Restore storages %d", storage.Restore())
+		// камеры с отметкой запуска при старте, уже поднятые из state пропускаются
+		blStream.Log.Sugar().Infof("Boot streams %d", stream.Boot())
+		blStream.Log.Sugar().Infof("Boot storages %d", storage.Boot())
+	}
+
+	select {
+	case s := <-sig:
+		blStream.Log.Sugar().Warnf("Receive signal %s", s)
+	case errListen := <-errServe:
+		blStream.Log.Error("listen", zap.Error(errListen))
+	}
+
+	// штатное завершение: новые потоки и записи не запускаются, ffmpeg останавливаем, пока сервер работает -
+	// последние сегменты и манифесты доходят в кеш, ждем нотификации и webhooks, затем сервер перестает
+	// принимать запросы и ждет ожидающих /get
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*conf.ShutdownTimeout)*time.Second)
+	defer cancel()
+	// потоки и записи останавливаются одновременно, иначе одни съедят срок других и ожидающих /get
+	var shutdownWg sync.WaitGroup
+	shutdownWg.Add(2)
+	go func() {
+		defer shutdownWg.Done()
+		blStream.Log.Sugar().Warnf("Shutdown streams %d", stream.Shutdown(ctx))
+	}()
+	go func() {
+		defer shutdownWg.Done()
+		blStream.Log.Sugar().Warnf("Shutdown storages %d", storage.Shutdown(ctx))
+	}()
+	shutdownWg.Wait()
+	if errSrv := srv.Shutdown(ctx); errSrv != nil {
+		blStream.Log.Error("shutdown", zap.Error(errSrv))
+	}
 
 	proxy.Close()
 	file.Close()